@@ -0,0 +1,313 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kataras/iris"
+	"github.com/lrstanley/dnscheck/lookup"
+)
+
+// Scan job states.
+const (
+	ScanPending   = "pending"
+	ScanCompleted = "completed"
+	ScanFailed    = "failed"
+)
+
+// scanJobTTL is how long finished scan jobs are kept in memory for polling. The scans themselves are stored in the database.
+const scanJobTTL = time.Hour
+
+// scanJobPrefix is prefixed to the id of each scan job, so a job id can never
+// be mistaken for the key of a scan (which only contain letters).
+const scanJobPrefix = "job-"
+
+// SavedScan is a single scan which has been saved, along with its stats.
+type SavedScan struct {
+	Key     string
+	Type    string
+	Results *DNSResults
+	Stats   DNSStats
+}
+
+// newSavedScan wraps a saved scan.
+func newSavedScan(key string, results *DNSResults) *SavedScan {
+	scan := &SavedScan{Key: key, Type: results.RType, Results: results}
+	if len(results.Records) > 0 {
+		scan.Stats, _ = results.Stats()
+	}
+
+	return scan
+}
+
+// ScanRequest is the json body of POST /api/v1/scans.
+type ScanRequest struct {
+	// Hosts are domains, or "<ip> <domain> <domain>..." lines, like the
+	// input of the web form.
+	Hosts []string `json:"hosts"`
+	// Types are the record types to look up. Each is saved as its own scan.
+	// Defaults to A.
+	Types []string `json:"types"`
+	// Resolvers is the name of the resolver group. Defaults to the default
+	// group.
+	Resolvers string `json:"resolvers"`
+	Fanout    bool   `json:"fanout"`
+	// Async returns immediately with a pending job, which can be polled.
+	Async bool `json:"async"`
+}
+
+// MonitorRequest is the json body of POST /api/v1/monitors.
+type MonitorRequest struct {
+	Name string `json:"name"`
+	// Hosts are in the same format as ScanRequest.Hosts.
+	Hosts []string `json:"hosts"`
+	Types []string `json:"types"`
+	// Resolvers is the name of the resolver group. Defaults to the default
+	// group.
+	Resolvers string `json:"resolvers"`
+	Fanout    bool   `json:"fanout"`
+	// Schedule is a cron expression, e.g. "*/15 * * * *".
+	Schedule string `json:"schedule"`
+}
+
+// ScanJob is the response of the scan api.
+type ScanJob struct {
+	ID     string       `json:"id"`
+	Status string       `json:"status"`
+	Scans  []*SavedScan `json:"scans,omitempty"`
+	Error  string       `json:"error,omitempty"`
+
+	code     int
+	finished time.Time
+}
+
+// StatusCode returns the http status code of the job.
+func (job *ScanJob) StatusCode() int {
+	if job.code != 0 {
+		return job.code
+	}
+
+	if job.Status == ScanPending {
+		return iris.StatusAccepted
+	}
+
+	return iris.StatusOK
+}
+
+// APIError is the body of any error returned by the scan api.
+type APIError struct {
+	Error    string   `json:"error"`
+	Problems []string `json:"problems,omitempty"`
+}
+
+// scanJobs holds the scan jobs started through the api.
+var scanJobs = struct {
+	sync.Mutex
+	jobs map[string]*ScanJob
+}{jobs: make(map[string]*ScanJob)}
+
+// parseScanRequest decodes and validates a scan request, returning the hosts
+// and resolver group to scan with. limit is the max number of queries each
+// lookup may send.
+func parseScanRequest(body []byte, limit int) (*ScanRequest, []*Host, *ResolverGroup, *APIError) {
+	req := &ScanRequest{}
+
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(req); err != nil {
+		return nil, nil, nil, &APIError{Error: fmt.Sprintf("invalid json: %s", err)}
+	}
+
+	var problems []string
+
+	var hosts []*Host
+	if len(req.Hosts) == 0 {
+		problems = append(problems, "hosts: must contain at least one host")
+	} else {
+		var err error
+		if hosts, err = lookup.ParseHosts(strings.Join(req.Hosts, "\n")); err != nil {
+			problems = append(problems, "hosts: "+err.Error())
+		}
+	}
+
+	if len(req.Types) == 0 {
+		req.Types = []string{"A"}
+	}
+	for _, rtype := range req.Types {
+		if _, ok := lookup.Types[rtype]; !ok || rtype == "" {
+			problems = append(problems, fmt.Sprintf("types: %q is not a supported record type", rtype))
+		}
+	}
+
+	if req.Resolvers == "" {
+		req.Resolvers = defaultResolverGroup()
+	}
+
+	group, ok := conf().Resolvers[req.Resolvers]
+	if !ok {
+		problems = append(problems, fmt.Sprintf("resolvers: %q is not a resolver group", req.Resolvers))
+	}
+
+	if isGeoGroup(req.Resolvers) {
+		req.Fanout = true
+	}
+
+	if ok && len(hosts) > 0 {
+		queries := len(hosts)
+		if req.Fanout {
+			queries *= len(group.Servers)
+		}
+
+		if queries > limit {
+			problems = append(problems, fmt.Sprintf("hosts: %d queries exceeds the limit of %d per lookup", queries, limit))
+		}
+	}
+
+	if len(problems) > 0 {
+		return nil, nil, nil, &APIError{Error: "invalid request", Problems: problems}
+	}
+
+	return req, hosts, group, nil
+}
+
+// defaultResolverGroup returns the name of the default resolver group. If
+// no group is the default (e.g. only the "Custom" group from --resolvers is
+// configured), the first group by name is used.
+func defaultResolverGroup() string {
+	var names []string
+	for name, group := range conf().Resolvers {
+		if group.Default {
+			return name
+		}
+
+		// geographic groups only contain resolvers from the other groups.
+		if !isGeoGroup(name) {
+			names = append(names, name)
+		}
+	}
+
+	if len(names) == 0 {
+		return ""
+	}
+
+	sort.Strings(names)
+
+	return names[0]
+}
+
+// parseMonitorRequest decodes and validates a monitor request, returning the
+// new monitor, attributed to key.
+func parseMonitorRequest(body []byte, key *APIKey) (*Monitor, *APIError) {
+	req := &MonitorRequest{}
+
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(req); err != nil {
+		return nil, &APIError{Error: fmt.Sprintf("invalid json: %s", err)}
+	}
+
+	if req.Resolvers == "" {
+		req.Resolvers = defaultResolverGroup()
+	}
+
+	m, err := newMonitor(req.Name, strings.Join(req.Hosts, "\n"), req.Types, req.Resolvers, req.Fanout, req.Schedule)
+	if err != nil {
+		return nil, &APIError{Error: "invalid request", Problems: []string{err.Error()}}
+	}
+
+	m.APIKey = key.ID
+
+	return m, nil
+}
+
+// runScanRequest runs a lookup for each of the requested types, saving each
+// of them, attributed to key. The quota of the key is charged for every type
+// beforehand, so the types which weren't saved are refunded if a lookup
+// fails.
+func runScanRequest(req *ScanRequest, hosts []*Host, group *ResolverGroup, key *APIKey, job *ScanJob) {
+	fail := func(err error, code int) {
+		job.Status, job.Error, job.code = ScanFailed, err.Error(), code
+
+		if err := refundAPIKey(key.ID, len(req.Types)-len(job.Scans)); err != nil {
+			logger.Printf("unable to refund the quota of api key %s: %s", key.ID, err)
+		}
+	}
+
+	for _, rtype := range req.Types {
+		results, err := LookupAllLimit(hosts, group, rtype, req.Fanout, key.Limit())
+		if err != nil {
+			fail(err, iris.StatusUnprocessableEntity)
+			return
+		}
+
+		metricScans.Inc("lookup")
+		results.APIKey = key.ID
+
+		scanKey, err := saveLookup(results)
+		if err != nil {
+			fail(err, iris.StatusInternalServerError)
+			return
+		}
+
+		notifyScan(scanKey, results)
+		job.Scans = append(job.Scans, newSavedScan(scanKey, results))
+	}
+
+	job.Status, job.code = ScanCompleted, iris.StatusCreated
+}
+
+// storeScanJob stores (or replaces) a job, and removes expired jobs.
+func storeScanJob(job *ScanJob) {
+	scanJobs.Lock()
+	defer scanJobs.Unlock()
+
+	for id, old := range scanJobs.jobs {
+		if !old.finished.IsZero() && time.Since(old.finished) > scanJobTTL {
+			delete(scanJobs.jobs, id)
+		}
+	}
+
+	scanJobs.jobs[job.ID] = job
+}
+
+// StartScan runs the scan request, returning the finished job. If the
+// request is asynchronous, the scan is ran in the background, and the
+// pending job is returned.
+func StartScan(req *ScanRequest, hosts []*Host, group *ResolverGroup, key *APIKey) *ScanJob {
+	id := scanJobPrefix + genWord(5, 6)
+
+	run := func() *ScanJob {
+		job := &ScanJob{ID: id}
+		runScanRequest(req, hosts, group, key, job)
+		job.finished = time.Now()
+
+		storeScanJob(job)
+		return job
+	}
+
+	if !req.Async {
+		return run()
+	}
+
+	job := &ScanJob{ID: id, Status: ScanPending}
+	storeScanJob(job)
+
+	go run()
+
+	return job
+}
+
+// getScanJob returns a scan job, if it hasn't expired.
+func getScanJob(id string) (*ScanJob, bool) {
+	scanJobs.Lock()
+	defer scanJobs.Unlock()
+
+	job, ok := scanJobs.jobs[id]
+
+	return job, ok
+}
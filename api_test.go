@@ -0,0 +1,35 @@
+package main
+
+import "testing"
+
+func TestDefaultResolverGroup(t *testing.T) {
+	prev := conf()
+	defer setConf(prev)
+
+	tests := []struct {
+		groups map[string]*ResolverGroup
+		want   string
+	}{
+		{map[string]*ResolverGroup{}, ""},
+		{map[string]*ResolverGroup{"Custom": {Servers: []string{"1.1.1.1"}}}, "Custom"},
+		{map[string]*ResolverGroup{
+			"Google DNS": {Servers: []string{"8.8.8.8"}},
+			"OpenDNS":    {Servers: []string{"208.67.222.222"}, Default: true},
+		}, "OpenDNS"},
+		{map[string]*ResolverGroup{
+			"OpenDNS":                 {Servers: []string{"208.67.222.222"}},
+			"Google DNS":              {Servers: []string{"8.8.8.8"}},
+			geoGroupPrefix + "Europe": {Servers: []string{"8.8.8.8"}},
+		}, "Google DNS"},
+	}
+
+	for _, tt := range tests {
+		c := *prev
+		c.Resolvers = tt.groups
+		setConf(&c)
+
+		if got := defaultResolverGroup(); got != tt.want {
+			t.Errorf("defaultResolverGroup() with %d groups = %q, want %q", len(tt.groups), got, tt.want)
+		}
+	}
+}
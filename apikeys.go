@@ -0,0 +1,487 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	arg "github.com/alexflint/go-arg"
+	"github.com/kataras/iris"
+)
+
+// API key scopes.
+const (
+	ScopeRead     = "read"
+	ScopeScan     = "scan"
+	ScopeMonitors = "monitors"
+	// ScopeSearch allows searching every scan, including the scans of other
+	// keys and of the web interface.
+	ScopeSearch = "search"
+)
+
+// apiScopes are all of the valid scopes.
+var apiScopes = []string{ScopeRead, ScopeScan, ScopeMonitors, ScopeSearch}
+
+// apiKeyPrefix prefixes every token, so they are easy to recognize (e.g. by
+// secret scanners).
+const apiKeyPrefix = "dnsk"
+
+// apiKeyUsageDays is how many days of usage are kept for each key.
+const apiKeyUsageDays = 31
+
+// errQuotaExceeded is returned when a key has used its daily scans.
+var errQuotaExceeded = errors.New("daily scan quota exceeded")
+
+// APIKey is a key used to authenticate with the api. Only a hash of the
+// secret part of the key is stored.
+type APIKey struct {
+	ID     string
+	Name   string
+	Hash   string
+	Scopes []string
+	// MaxHosts overrides the configured limit on queries per request, if
+	// above 0.
+	MaxHosts int
+	// DailyScans is the number of scans which may be submitted per day (UTC),
+	// if above 0.
+	DailyScans int
+	Created    time.Time
+	LastUsed   time.Time
+	// Usage is the number of scans submitted on each day (YYYY-MM-DD, UTC).
+	Usage map[string]int
+}
+
+// HasScope returns true if the key has been granted scope.
+func (k *APIKey) HasScope(scope string) bool {
+	for _, s := range k.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Limit returns the max number of queries per request for the key.
+func (k *APIKey) Limit() int {
+	if k.MaxHosts > 0 {
+		return k.MaxHosts
+	}
+
+	return conf().Limit
+}
+
+// UsedToday returns the number of scans submitted with the key today.
+func (k *APIKey) UsedToday() int {
+	return k.Usage[time.Now().UTC().Format("2006-01-02")]
+}
+
+// hashSecret returns the hex encoded sha256 hash of secret.
+func hashSecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+
+	return hex.EncodeToString(sum[:])
+}
+
+// randomHex returns n random bytes, hex encoded.
+func randomHex(n int) (string, error) {
+	buf := make([]byte, n)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(buf), nil
+}
+
+// parseScopes validates a list of scopes. Each item may also be a comma
+// separated list.
+func parseScopes(scopes []string) (out []string, err error) {
+	for _, scope := range strings.Split(strings.Join(scopes, ","), ",") {
+		scope = strings.ToLower(strings.TrimSpace(scope))
+		if scope == "" {
+			continue
+		}
+
+		valid := false
+		for _, s := range apiScopes {
+			valid = valid || s == scope
+		}
+
+		if !valid {
+			return nil, fmt.Errorf("invalid scope %q, must be one of: %s", scope, strings.Join(apiScopes, ", "))
+		}
+
+		out = append(out, scope)
+	}
+
+	if len(out) == 0 {
+		return nil, errors.New("at least one scope is required")
+	}
+
+	sort.Strings(out)
+
+	return out, nil
+}
+
+// createAPIKey creates and stores a new key, returning it along with the
+// token, which is only ever available at this point.
+func createAPIKey(name string, scopes []string, maxHosts, dailyScans int) (*APIKey, string, error) {
+	if strings.TrimSpace(name) == "" {
+		return nil, "", errors.New("a name is required")
+	}
+
+	scopes, err := parseScopes(scopes)
+	if err != nil {
+		return nil, "", err
+	}
+
+	if maxHosts < 0 || dailyScans < 0 {
+		return nil, "", errors.New("limits must not be negative")
+	}
+
+	id, err := randomHex(6)
+	if err != nil {
+		return nil, "", err
+	}
+
+	secret, err := randomHex(24)
+	if err != nil {
+		return nil, "", err
+	}
+
+	key := &APIKey{
+		ID:         id,
+		Name:       strings.TrimSpace(name),
+		Hash:       hashSecret(secret),
+		Scopes:     scopes,
+		MaxHosts:   maxHosts,
+		DailyScans: dailyScans,
+		Created:    time.Now(),
+		Usage:      make(map[string]int),
+	}
+
+	db, err := newDB()
+	if err != nil {
+		return nil, "", err
+	}
+	defer db.Clean()
+
+	if err = db.SetStruct("apikeys", key.ID, key); err != nil {
+		return nil, "", err
+	}
+
+	return key, fmt.Sprintf("%s_%s_%s", apiKeyPrefix, id, secret), nil
+}
+
+func getAPIKey(id string) (*APIKey, error) {
+	db, err := newDB()
+	if err != nil {
+		return nil, err
+	}
+	defer db.Clean()
+
+	key := &APIKey{}
+
+	return key, db.GetStruct("apikeys", id, key)
+}
+
+func listAPIKeys() (out []*APIKey, err error) {
+	db, err := newDB()
+	if err != nil {
+		return nil, err
+	}
+	defer db.Clean()
+
+	err = db.ForEach("apikeys", "", func(id string, data []byte) error {
+		key := &APIKey{}
+		if err := db.GetReceivedStruct(data, key); err != nil {
+			return err
+		}
+
+		out = append(out, key)
+		return nil
+	})
+
+	sort.Slice(out, func(i, j int) bool { return out[i].Created.Before(out[j].Created) })
+
+	return out, err
+}
+
+// revokeAPIKey removes a key.
+func revokeAPIKey(id string) error {
+	if _, err := getAPIKey(id); err != nil {
+		return errors.New("an api key with that id does not exist")
+	}
+
+	db, err := newDB()
+	if err != nil {
+		return err
+	}
+	defer db.Clean()
+
+	return db.Delete("apikeys", id)
+}
+
+// authenticate returns the key for token, if it is valid.
+func authenticate(token string) (*APIKey, error) {
+	parts := strings.SplitN(token, "_", 3)
+	if len(parts) != 3 || parts[0] != apiKeyPrefix {
+		return nil, errors.New("malformed api key")
+	}
+
+	key, err := getAPIKey(parts[1])
+	if err != nil {
+		return nil, errors.New("invalid api key")
+	}
+
+	if subtle.ConstantTimeCompare([]byte(hashSecret(parts[2])), []byte(key.Hash)) != 1 {
+		return nil, errors.New("invalid api key")
+	}
+
+	return key, nil
+}
+
+// useAPIKey records that scans were submitted with the key, failing with
+// errQuotaExceeded if the key doesn't have enough of its daily quota left.
+func useAPIKey(id string, scans int) error {
+	db, err := newDB()
+	if err != nil {
+		return err
+	}
+	defer db.Clean()
+
+	key := &APIKey{}
+
+	return db.UpdateStruct("apikeys", id, key, func() error {
+		now := time.Now().UTC()
+		today := now.Format("2006-01-02")
+
+		if key.Usage == nil {
+			key.Usage = make(map[string]int)
+		}
+
+		if key.DailyScans > 0 && key.Usage[today]+scans > key.DailyScans {
+			return errQuotaExceeded
+		}
+
+		key.Usage[today] += scans
+		key.LastUsed = now
+
+		cutoff := now.AddDate(0, 0, -apiKeyUsageDays).Format("2006-01-02")
+		for day := range key.Usage {
+			if day < cutoff {
+				delete(key.Usage, day)
+			}
+		}
+
+		return nil
+	})
+}
+
+// refundAPIKey returns scans to the daily quota of the key, for scans which
+// were charged for (see useAPIKey) but failed.
+func refundAPIKey(id string, scans int) error {
+	if scans <= 0 {
+		return nil
+	}
+
+	db, err := newDB()
+	if err != nil {
+		return err
+	}
+	defer db.Clean()
+
+	key := &APIKey{}
+
+	return db.UpdateStruct("apikeys", id, key, func() error {
+		today := time.Now().UTC().Format("2006-01-02")
+		if key.Usage == nil {
+			return nil
+		}
+
+		if key.Usage[today] -= scans; key.Usage[today] <= 0 {
+			delete(key.Usage, today)
+		}
+
+		return nil
+	})
+}
+
+// requestToken returns the api key sent with the request, either as a bearer
+// token, or in the X-API-Key header.
+func requestToken(ctx *iris.Context) string {
+	if auth := ctx.RequestHeader("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		return strings.TrimSpace(strings.TrimPrefix(auth, "Bearer "))
+	}
+
+	return strings.TrimSpace(ctx.RequestHeader("X-API-Key"))
+}
+
+// authAPIKey authenticates the request, and checks that the key has been
+// granted scope. If not, an error is written and false is returned.
+func authAPIKey(ctx *iris.Context, scope string) (*APIKey, bool) {
+	token := requestToken(ctx)
+	if token == "" {
+		ctx.SetHeader("WWW-Authenticate", `Bearer realm="dnscheck"`)
+		ctx.JSON(iris.StatusUnauthorized, &APIError{Error: "an api key is required"})
+		return nil, false
+	}
+
+	key, err := authenticate(token)
+	if err != nil {
+		ctx.SetHeader("WWW-Authenticate", `Bearer realm="dnscheck", error="invalid_token"`)
+		ctx.JSON(iris.StatusUnauthorized, &APIError{Error: err.Error()})
+		return nil, false
+	}
+
+	if !key.HasScope(scope) {
+		ctx.JSON(iris.StatusForbidden, &APIError{Error: fmt.Sprintf("the api key does not have the %q scope", scope)})
+		return nil, false
+	}
+
+	return key, true
+}
+
+// authAdmin checks the basic auth credentials of the request against the
+// admin token. If the admin pages are disabled, or the credentials are
+// wrong, an error is written and false is returned.
+func authAdmin(ctx *iris.Context) bool {
+	token := conf().AdminToken
+	if token == "" {
+		ctx.MustRender("404.html", "")
+		return false
+	}
+
+	var user, pass string
+	if auth := ctx.RequestHeader("Authorization"); strings.HasPrefix(auth, "Basic ") {
+		if raw, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(auth, "Basic ")); err == nil {
+			user, pass = splitPair(string(raw), ":")
+		}
+	}
+
+	userOK := subtle.ConstantTimeCompare([]byte(user), []byte("admin")) == 1
+	passOK := subtle.ConstantTimeCompare([]byte(hashSecret(pass)), []byte(hashSecret(token))) == 1
+	if !userOK || !passOK {
+		ctx.SetHeader("WWW-Authenticate", `Basic realm="dnscheck admin"`)
+		ctx.Text(iris.StatusUnauthorized, "unauthorized")
+		return false
+	}
+
+	return true
+}
+
+// splitPair splits s at the first sep.
+func splitPair(s, sep string) (string, string) {
+	parts := strings.SplitN(s, sep, 2)
+	if len(parts) != 2 {
+		return parts[0], ""
+	}
+
+	return parts[0], parts[1]
+}
+
+// apikeyArgs are the flags of "dnscheck apikey".
+type apikeyArgs struct {
+	Action     string   `arg:"positional,required,help:create; list or revoke"`
+	ID         string   `arg:"positional,help:id of the key to revoke"`
+	ConfigFile string   `arg:"--config,help:path to a json configuration file"`
+	Database   string   `arg:"help:file path to the database for dnscheck (overrides the configuration)"`
+	Name       string   `arg:"help:name of the new key"`
+	Scopes     []string `arg:"--scope,help:scopes granted to the new key (read; scan; monitors; search) separated by commas"`
+	MaxHosts   int      `arg:"--max-hosts,help:max queries per request (0 uses the configured limit)"`
+	DailyScans int      `arg:"--daily-scans,help:max scans per day (0 is unlimited)"`
+}
+
+// apikeyCommand manages api keys from the command line, e.g.
+// "dnscheck apikey create --name ci --scope scan".
+func apikeyCommand(argv []string) error {
+	args := apikeyArgs{}
+
+	p, err := arg.NewParser(arg.Config{Program: "dnscheck apikey"}, &args)
+	if err != nil {
+		return err
+	}
+
+	if err = p.Parse(argv); err != nil {
+		p.Fail(err.Error())
+	}
+
+	fn := args.ConfigFile
+	if fn == "" {
+		fn = os.Getenv(envPrefix + "CONFIG")
+	}
+
+	c, err := fileConfig(fn)
+	if err != nil {
+		return err
+	}
+
+	if args.Database != "" {
+		c.Database = args.Database
+	}
+	setConf(&c)
+
+	logger = log.New(os.Stderr, "", 0)
+	initDatabase()
+	defer closeDatabase()
+
+	switch args.Action {
+	case "create":
+		key, token, err := createAPIKey(args.Name, args.Scopes, args.MaxHosts, args.DailyScans)
+		if err != nil {
+			return err
+		}
+
+		fmt.Printf("created key %s (%s) with scopes: %s\n", key.ID, key.Name, strings.Join(key.Scopes, ", "))
+		fmt.Println("copy the key now, it won't be shown again:")
+		fmt.Println(token)
+	case "list":
+		keys, err := listAPIKeys()
+		if err != nil {
+			return err
+		}
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "ID\tNAME\tSCOPES\tHOSTS\tTODAY\tCREATED\tLAST USED")
+		for _, key := range keys {
+			daily := fmt.Sprintf("%d", key.UsedToday())
+			if key.DailyScans > 0 {
+				daily += fmt.Sprintf("/%d", key.DailyScans)
+			}
+
+			lastUsed := "never"
+			if !key.LastUsed.IsZero() {
+				lastUsed = key.LastUsed.Format("2006-01-02 15:04:05")
+			}
+
+			fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%s\t%s\t%s\n", key.ID, key.Name, strings.Join(key.Scopes, ","),
+				key.Limit(), daily, key.Created.Format("2006-01-02 15:04:05"), lastUsed)
+		}
+
+		return w.Flush()
+	case "revoke":
+		if args.ID == "" {
+			p.Fail("the id of the key to revoke is required")
+		}
+
+		if err := revokeAPIKey(args.ID); err != nil {
+			return err
+		}
+
+		fmt.Printf("revoked key %s\n", args.ID)
+	default:
+		p.Fail(fmt.Sprintf("unknown action %q, must be one of create, list or revoke", args.Action))
+	}
+
+	return nil
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestAPIKeyQuota(t *testing.T) {
+	defer useMemoryStore()()
+
+	key, _, err := createAPIKey("ci", []string{ScopeScan}, 0, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	usage := func() int {
+		key, err := getAPIKey(key.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return key.Usage[time.Now().UTC().Format("2006-01-02")]
+	}
+
+	if err = useAPIKey(key.ID, 2); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = useAPIKey(key.ID, 2); err != errQuotaExceeded {
+		t.Errorf("useAPIKey over quota = %v, want %v", err, errQuotaExceeded)
+	}
+
+	if n := usage(); n != 2 {
+		t.Errorf("usage = %d, want 2", n)
+	}
+
+	// scans which failed are returned to the quota.
+	if err = refundAPIKey(key.ID, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	if n := usage(); n != 1 {
+		t.Errorf("usage after refund = %d, want 1", n)
+	}
+
+	if err = useAPIKey(key.ID, 2); err != nil {
+		t.Errorf("useAPIKey after refund = %v", err)
+	}
+
+	if err = refundAPIKey(key.ID, 5); err != nil {
+		t.Fatal(err)
+	}
+
+	if n := usage(); n != 0 {
+		t.Errorf("usage after refunding more than was used = %d, want 0", n)
+	}
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lrstanley/dnscheck/lookup"
+	"github.com/miekg/dns"
+)
+
+// benchQuery is a single query within the benchmark battery.
+type benchQuery struct {
+	Name  string
+	QType uint16
+}
+
+// benchBattery is the standard set of queries sent to each resolver when
+// benchmarking. These should all be well known, highly available names.
+var benchBattery = []benchQuery{
+	{"google.com", dns.TypeA},
+	{"facebook.com", dns.TypeA},
+	{"wikipedia.org", dns.TypeAAAA},
+	{"amazon.com", dns.TypeMX},
+	{"cloudflare.com", dns.TypeNS},
+	{"github.com", dns.TypeTXT},
+	{"microsoft.com", dns.TypeA},
+	{"apple.com", dns.TypeAAAA},
+}
+
+const (
+	// benchRounds is how many times the battery is sent to each resolver.
+	benchRounds = 3
+	// dnssecSignedName is a name with a valid DNSSEC chain of trust.
+	dnssecSignedName = "isc.org"
+	// dnssecBrokenName is a name which intentionally fails DNSSEC validation.
+	dnssecBrokenName = "dnssec-failed.org"
+)
+
+// BenchResults represents a benchmark of all configured resolvers.
+type BenchResults struct {
+	Servers  []*BenchServer
+	ScanTime string
+	Expiry
+}
+
+// BenchServer contains the benchmark results for a single resolver.
+type BenchServer struct {
+	Group        string
+	Server       string
+	Sent         int
+	Answered     int
+	Errors       int
+	Availability float32
+	ErrorRate    float32
+	Latency      BenchLatency
+	DNSSEC       bool
+	NXRewrite    bool
+	LastError    string
+}
+
+// Healthy returns true if the resolver answered every query without errors.
+func (s *BenchServer) Healthy() bool {
+	return s.Sent > 0 && s.Answered == s.Sent && s.Errors == 0
+}
+
+// BenchLatency is the latency distribution of a resolver.
+type BenchLatency struct {
+	Min string
+	Avg string
+	P50 string
+	P90 string
+	Max string
+}
+
+// exchange sends a single query for name to server, optionally with the
+// DNSSEC OK bit set.
+func exchange(group *ResolverGroup, server, name string, qtype uint16, dnssec bool) (*dns.Msg, time.Duration, error) {
+	msg := new(dns.Msg)
+	msg.SetQuestion(dns.Fqdn(name), qtype)
+
+	if dnssec {
+		msg.SetEdns0(4096, true)
+	}
+
+	return group.Exchange(server, msg)
+}
+
+// probeResolver checks that server (from group) is able to answer a basic
+// query.
+func probeResolver(group *ResolverGroup, server string) error {
+	resp, _, err := exchange(group, server, benchBattery[0].Name, benchBattery[0].QType, false)
+	if err != nil {
+		return err
+	}
+
+	if resp.Rcode != dns.RcodeSuccess {
+		return fmt.Errorf("unexpected response code: %s", dns.RcodeToString[resp.Rcode])
+	}
+
+	return nil
+}
+
+// percentile returns the p'th percentile from sorted durations.
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+
+	i := int(float64(len(sorted)-1) * p)
+
+	return sorted[i]
+}
+
+// benchServer runs the benchmark battery against a single resolver.
+func benchServer(budget *lookup.Budget, name string, group *ResolverGroup, server string) *BenchServer {
+	res := &BenchServer{Group: name, Server: server}
+	servers := []string{server}
+
+	var rtts []time.Duration
+	var total time.Duration
+
+	for round := 0; round < benchRounds; round++ {
+		for _, query := range benchBattery {
+			_, release := budget.Acquire(servers)
+			resp, rtt, err := exchange(group, server, query.Name, query.QType, false)
+			release()
+
+			res.Sent++
+
+			if err != nil {
+				res.Errors++
+				res.LastError = err.Error()
+				continue
+			}
+
+			res.Answered++
+			rtts = append(rtts, rtt)
+			total += rtt
+
+			if resp.Rcode != dns.RcodeSuccess {
+				res.Errors++
+				res.LastError = fmt.Sprintf("%s: %s", query.Name, dns.RcodeToString[resp.Rcode])
+			}
+		}
+	}
+
+	res.Availability = float32(res.Answered) / float32(res.Sent) * 100
+	res.ErrorRate = float32(res.Errors) / float32(res.Sent) * 100
+
+	if len(rtts) > 0 {
+		sort.Slice(rtts, func(i, j int) bool { return rtts[i] < rtts[j] })
+
+		res.Latency = BenchLatency{
+			Min: lookup.FormatRTT(rtts[0]),
+			Avg: lookup.FormatRTT(total / time.Duration(len(rtts))),
+			P50: lookup.FormatRTT(percentile(rtts, 0.5)),
+			P90: lookup.FormatRTT(percentile(rtts, 0.9)),
+			Max: lookup.FormatRTT(rtts[len(rtts)-1]),
+		}
+	}
+
+	// a validating resolver sets the AD flag on signed responses, and returns
+	// SERVFAIL for responses which fail validation.
+	_, release := budget.Acquire(servers)
+	signed, _, signedErr := exchange(group, server, dnssecSignedName, dns.TypeA, true)
+	release()
+
+	_, release = budget.Acquire(servers)
+	broken, _, brokenErr := exchange(group, server, dnssecBrokenName, dns.TypeA, true)
+	release()
+
+	if signedErr == nil && brokenErr == nil {
+		res.DNSSEC = signed.AuthenticatedData && broken.Rcode == dns.RcodeServerFailure
+	}
+
+	// a name which should never exist. if we get an answer back, the resolver
+	// is rewriting NXDOMAIN responses (e.g. to a search or ad page).
+	_, release = budget.Acquire(servers)
+	nx, _, err := exchange(group, server, fmt.Sprintf("dnscheck-nx-%s.com", genWord(4, 5)), dns.TypeA, false)
+	release()
+
+	if err == nil && nx.Rcode == dns.RcodeSuccess && len(nx.Answer) > 0 {
+		res.NXRewrite = true
+	}
+
+	return res
+}
+
+// BenchmarkResolvers benchmarks every resolver within groups.
+func BenchmarkResolvers(groups map[string]*ResolverGroup) (*BenchResults, error) {
+	if len(groups) == 0 {
+		return nil, errors.New("no resolvers configured")
+	}
+
+	metricScans.Inc("bench")
+
+	out := &BenchResults{ScanTime: time.Now().Format(time.RFC3339)}
+
+	budget := scheduler.NewScan()
+	defer budget.Done()
+
+	var lock sync.Mutex
+	var wg sync.WaitGroup
+
+	for name, group := range groups {
+		// geographic groups only contain resolvers from the other groups.
+		if isGeoGroup(name) {
+			continue
+		}
+
+		for _, server := range group.Servers {
+			wg.Add(1)
+
+			go func(name string, group *ResolverGroup, server string) {
+				defer wg.Done()
+
+				res := benchServer(budget, name, group, server)
+
+				lock.Lock()
+				out.Servers = append(out.Servers, res)
+				lock.Unlock()
+			}(name, group, server)
+		}
+	}
+
+	wg.Wait()
+
+	sort.Slice(out.Servers, func(i, j int) bool {
+		if out.Servers[i].Group != out.Servers[j].Group {
+			return strings.ToLower(out.Servers[i].Group) < strings.ToLower(out.Servers[j].Group)
+		}
+
+		return out.Servers[i].Server < out.Servers[j].Server
+	})
+
+	return out, nil
+}
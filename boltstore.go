@@ -0,0 +1,342 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+// boltOpenTimeout is how long to wait for the lock on the database file, e.g.
+// if another dnscheck process has it open.
+const boltOpenTimeout = 5 * time.Second
+
+// boltStore stores everything within a single bolt database file. It's the
+// default storage.
+type boltStore struct {
+	db *bolt.DB
+}
+
+// openBolt opens the bolt database at fn.
+func openBolt(fn string) (*bolt.DB, error) {
+	db, err := bolt.Open(fn, 0600, &bolt.Options{Timeout: boltOpenTimeout})
+	if err == bolt.ErrTimeout {
+		return nil, fmt.Errorf("%s is locked, is dnscheck already running?", fn)
+	}
+
+	return db, err
+}
+
+// openBoltStore opens the bolt database at fn, and initializes the needed
+// structure of the database, so these checks don't have to be completed for
+// every query (e.g. if a bucket is created). Older databases are migrated
+// to the current storage format.
+// One would assume a bucket is not removed while the bot is running.
+func openBoltStore(fn string) (*boltStore, error) {
+	db, err := openBolt(fn)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, name := range defaultBuckets {
+		err = db.Update(func(tx *bolt.Tx) error {
+			_, err := tx.CreateBucketIfNotExists([]byte(name))
+			return err
+		})
+		if err != nil {
+			db.Close()
+			return nil, fmt.Errorf("unable to create/access bucket %s: %s", name, err)
+		}
+	}
+
+	if err = migrateDatabase(db); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("unable to migrate database: %s", err)
+	}
+
+	return &boltStore{db: db}, nil
+}
+
+// bucket returns name from tx. Buckets are created by openBoltStore, so
+// reads don't have to create them.
+func bucket(tx *bolt.Tx, name string) (*bolt.Bucket, error) {
+	b := tx.Bucket([]byte(name))
+	if b == nil {
+		return nil, bolt.ErrBucketNotFound
+	}
+
+	return b, nil
+}
+
+func (s *boltStore) Get(name, key string) (out []byte, err error) {
+	err = s.db.View(func(tx *bolt.Tx) error {
+		b, err := bucket(tx, name)
+		if err != nil {
+			return err
+		}
+
+		// the value is only valid within the transaction.
+		if value := b.Get([]byte(key)); value != nil {
+			out = append([]byte{}, value...)
+		}
+
+		return nil
+	})
+
+	return out, err
+}
+
+// Put sets the value of key. Concurrent writes are batched into a single
+// transaction, so value must not be modified afterwards (the transaction
+// may be retried, see bolt.DB.Batch).
+func (s *boltStore) Put(name, key string, value []byte) error {
+	return s.db.Batch(func(tx *bolt.Tx) error {
+		b, err := bucket(tx, name)
+		if err != nil {
+			return err
+		}
+
+		return b.Put([]byte(key), value)
+	})
+}
+
+// PutMany sets the value of each key within values. Concurrent writes are
+// batched into a single transaction, as with Put.
+func (s *boltStore) PutMany(name string, values map[string][]byte) error {
+	return s.db.Batch(func(tx *bolt.Tx) error {
+		b, err := bucket(tx, name)
+		if err != nil {
+			return err
+		}
+
+		for key, value := range values {
+			if err := b.Put([]byte(key), value); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+// Update isn't batched, so fn is only ever called once.
+func (s *boltStore) Update(name, key string, fn func(value []byte) ([]byte, error)) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b, err := bucket(tx, name)
+		if err != nil {
+			return err
+		}
+
+		value, err := fn(b.Get([]byte(key)))
+		if err != nil {
+			return err
+		}
+
+		return b.Put([]byte(key), value)
+	})
+}
+
+// Delete removes key. Concurrent writes are batched into a single
+// transaction.
+func (s *boltStore) Delete(name, key string) error {
+	return s.db.Batch(func(tx *bolt.Tx) error {
+		b, err := bucket(tx, name)
+		if err != nil {
+			return err
+		}
+
+		return b.Delete([]byte(key))
+	})
+}
+
+// DeleteMany removes each of keys. Concurrent writes are batched into a
+// single transaction.
+func (s *boltStore) DeleteMany(name string, keys []string) error {
+	return s.db.Batch(func(tx *bolt.Tx) error {
+		b, err := bucket(tx, name)
+		if err != nil {
+			return err
+		}
+
+		for _, key := range keys {
+			if err := b.Delete([]byte(key)); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+// DeletePrefix removes every key starting with prefix. Concurrent writes are
+// batched into a single transaction.
+func (s *boltStore) DeletePrefix(name, prefix string) error {
+	return s.db.Batch(func(tx *bolt.Tx) error {
+		b, err := bucket(tx, name)
+		if err != nil {
+			return err
+		}
+
+		c := b.Cursor()
+
+		for k, _ := c.Seek([]byte(prefix)); k != nil && bytes.HasPrefix(k, []byte(prefix)); k, _ = c.Seek([]byte(prefix)) {
+			if err := c.Delete(); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+func (s *boltStore) ForEach(name, prefix string, fn func(key string, value []byte) error) error {
+	return s.db.View(func(tx *bolt.Tx) error {
+		b, err := bucket(tx, name)
+		if err != nil {
+			return err
+		}
+
+		c := b.Cursor()
+
+		for k, v := c.Seek([]byte(prefix)); k != nil && bytes.HasPrefix(k, []byte(prefix)); k, v = c.Next() {
+			if err := fn(string(k), v); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+func (s *boltStore) ForEachReverse(name, prefix string, n int, fn func(key string, value []byte) error) error {
+	return s.db.View(func(tx *bolt.Tx) error {
+		b, err := bucket(tx, name)
+		if err != nil {
+			return err
+		}
+
+		c := b.Cursor()
+
+		// seek past the last key with prefix, then step back.
+		k, v := c.Seek(append([]byte(prefix), 0xff))
+		if k == nil {
+			k, v = c.Last()
+		} else {
+			k, v = c.Prev()
+		}
+
+		for i := 0; k != nil && bytes.HasPrefix(k, []byte(prefix)) && (n <= 0 || i < n); i++ {
+			if err := fn(string(k), v); err != nil {
+				return err
+			}
+
+			k, v = c.Prev()
+		}
+
+		return nil
+	})
+}
+
+func (s *boltStore) Close() error {
+	return s.db.Close()
+}
+
+// Compact copies the database into a new file, and replaces the original
+// with it. bolt never shrinks the file when data is removed, so this
+// reclaims the space left by deleted results.
+func (s *boltStore) Compact() (before, after int64, err error) {
+	fn := s.db.Path()
+	tmp := fn + ".compact"
+
+	os.Remove(tmp)
+	dst, err := bolt.Open(tmp, 0600, &bolt.Options{Timeout: boltOpenTimeout})
+	if err != nil {
+		return 0, 0, err
+	}
+
+	err = s.db.View(func(stx *bolt.Tx) error {
+		return dst.Update(func(dtx *bolt.Tx) error {
+			return stx.ForEach(func(name []byte, b *bolt.Bucket) error {
+				nb, err := dtx.CreateBucketIfNotExists(name)
+				if err != nil {
+					return err
+				}
+
+				// keys are written in order, so the pages can be filled.
+				nb.FillPercent = 1
+
+				return b.ForEach(func(k, v []byte) error {
+					if v == nil {
+						return nil // nested buckets aren't used.
+					}
+
+					return nb.Put(k, v)
+				})
+			})
+		})
+	})
+
+	if cerr := dst.Close(); err == nil {
+		err = cerr
+	}
+
+	if err != nil {
+		os.Remove(tmp)
+		return 0, 0, err
+	}
+
+	if fi, err := os.Stat(fn); err == nil {
+		before = fi.Size()
+	}
+
+	if fi, err := os.Stat(tmp); err == nil {
+		after = fi.Size()
+	}
+
+	// the original has to be closed before it's replaced, and reopened after.
+	// it's kept until the compacted copy has been opened, so it can be put
+	// back if anything fails.
+	if err = s.db.Close(); err != nil {
+		os.Remove(tmp)
+		return 0, 0, err
+	}
+
+	old := fn + ".old"
+	if err = os.Rename(fn, old); err != nil {
+		os.Remove(tmp)
+		return 0, 0, s.reopen(fn, err)
+	}
+
+	if err = os.Rename(tmp, fn); err != nil {
+		os.Remove(tmp)
+		os.Rename(old, fn)
+		return 0, 0, s.reopen(fn, err)
+	}
+
+	db, err := openBolt(fn)
+	if err != nil {
+		os.Remove(fn)
+		os.Rename(old, fn)
+		return 0, 0, s.reopen(fn, err)
+	}
+
+	s.db = db
+	os.Remove(old)
+
+	return before, after, nil
+}
+
+// reopen reopens the database at fn after compacting it failed with err,
+// returning err. If the database can't be reopened, dnscheck exits, as
+// nothing can be stored without it.
+func (s *boltStore) reopen(fn string, err error) error {
+	db, oerr := openBolt(fn)
+	if oerr != nil {
+		logger.Fatalf("unable to reopen database after compacting failed (%s): %s", err, oerr)
+	}
+	s.db = db
+
+	return err
+}
@@ -0,0 +1,281 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	arg "github.com/alexflint/go-arg"
+	"github.com/lrstanley/dnscheck/lookup"
+)
+
+// Exit codes of "dnscheck lookup".
+const (
+	exitPassed = 0
+	// exitFailed means the match rate was below the threshold.
+	exitFailed = 1
+	// exitError means the lookup couldn't be ran at all (e.g. invalid input).
+	exitError = 2
+)
+
+// lookupArgs are the flags of "dnscheck lookup".
+type lookupArgs struct {
+	Input      string  `arg:"positional,help:file containing the hosts to lookup (stdin if omitted or -)"`
+	ConfigFile string  `arg:"--config,help:path to a json configuration file"`
+	Resolvers  string  `arg:"-r,help:resolvers to query (ip or ip:port) separated by commas instead of the configured groups"`
+	Group      string  `arg:"-g,--group,help:name of the configured resolver group to query (the default group if empty)"`
+	Types      string  `arg:"-t,--types,help:record types to lookup separated by commas (A if empty)"`
+	Fanout     bool    `arg:"help:query every resolver of the group for each host"`
+	JSON       bool    `arg:"--json,help:print the results as json rather than a table"`
+	Threshold  float64 `arg:"help:minimum percentage (0-100) of answers which must match"`
+	Limit      int     `arg:"help:max queries per lookup (overrides the configuration)"`
+}
+
+// LookupReport is the outcome of "dnscheck lookup", as printed with --json.
+type LookupReport struct {
+	Group     string        `json:"group"`
+	Total     int           `json:"total"`
+	Matched   int           `json:"matched"`
+	Errors    int           `json:"errors"`
+	MatchRate float64       `json:"match_rate"`
+	Threshold float64       `json:"threshold"`
+	Passed    bool          `json:"passed"`
+	Results   []*DNSResults `json:"results"`
+}
+
+// splitList splits a comma separated list, ignoring empty items.
+func splitList(list string) (out []string) {
+	for _, item := range strings.Split(list, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			out = append(out, item)
+		}
+	}
+
+	return out
+}
+
+// readLookupInput reads the hosts from fn, or stdin if fn is empty or "-".
+func readLookupInput(fn string) (string, error) {
+	var r io.Reader = os.Stdin
+
+	if fn != "" && fn != "-" {
+		f, err := os.Open(fn)
+		if err != nil {
+			return "", err
+		}
+		defer f.Close()
+
+		r = f
+	}
+
+	data, err := ioutil.ReadAll(r)
+
+	return string(data), err
+}
+
+// lookupCommand looks up hosts from the command line, without the webserver
+// or database, returning the exit code. It's intended as a deploy gate, e.g.
+// "dnscheck lookup --threshold 100 hosts.txt".
+func lookupCommand(argv []string) int {
+	args := lookupArgs{Threshold: 100}
+
+	p, err := arg.NewParser(arg.Config{Program: "dnscheck lookup"}, &args)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "error:", err)
+		return exitError
+	}
+
+	if err = p.Parse(argv); err != nil {
+		p.Fail(err.Error())
+	}
+
+	if args.Threshold < 0 || args.Threshold > 100 {
+		p.Fail("threshold must be between 0 and 100")
+	}
+
+	report, err := runLookupCommand(&args)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "error:", err)
+		return exitError
+	}
+
+	if args.JSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "    ")
+		if err = enc.Encode(report); err != nil {
+			fmt.Fprintln(os.Stderr, "error:", err)
+			return exitError
+		}
+	} else if err = writeLookupReport(os.Stdout, report); err != nil {
+		fmt.Fprintln(os.Stderr, "error:", err)
+		return exitError
+	}
+
+	if !report.Passed {
+		return exitFailed
+	}
+
+	return exitPassed
+}
+
+// runLookupCommand loads the configuration and resolvers, and looks up each
+// of the requested types.
+func runLookupCommand(args *lookupArgs) (*LookupReport, error) {
+	// logs (e.g. resolvers which aren't responding) shouldn't end up in the
+	// output, which may be json.
+	logger = log.New(os.Stderr, "", 0)
+
+	types := splitList(strings.ToUpper(args.Types))
+	if len(types) == 0 {
+		types = []string{"A"}
+	}
+
+	for _, rtype := range types {
+		if _, ok := lookup.Types[rtype]; !ok {
+			return nil, fmt.Errorf("%q is not a supported record type", rtype)
+		}
+	}
+
+	fn := args.ConfigFile
+	if fn == "" {
+		fn = os.Getenv(envPrefix + "CONFIG")
+	}
+
+	c, err := fileConfig(fn)
+	if err != nil {
+		return nil, err
+	}
+
+	group := args.Group
+	if args.Resolvers != "" {
+		if group != "" {
+			return nil, fmt.Errorf("--group and --resolvers can't be used together")
+		}
+
+		// only query the resolvers given.
+		c.CustomResolvers, c.Groups, c.ResolverFile = splitList(args.Resolvers), nil, ""
+		group = "Custom"
+	}
+
+	if args.Limit > 0 {
+		c.Limit = args.Limit
+	}
+
+	if err = c.Validate(); err != nil {
+		return nil, err
+	}
+
+	scheduler = lookup.NewScheduler(c.MaxInflight, c.ResolverQPS)
+
+	if args.Resolvers != "" {
+		// resolvers given explicitly aren't probed first. Lookups sent to
+		// any which aren't responding fail, which counts against the
+		// threshold.
+		if c.Resolvers == nil {
+			c.Resolvers = make(map[string]*ResolverGroup)
+		}
+		c.Resolvers[group] = &ResolverGroup{Servers: c.CustomResolvers}
+	} else if err = genResolvers(&c); err != nil {
+		return nil, err
+	}
+	setConf(&c)
+
+	if group == "" {
+		group = defaultResolverGroup()
+	}
+
+	resolvers, ok := c.Resolvers[group]
+	if !ok {
+		var names []string
+		for name := range c.Resolvers {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		return nil, fmt.Errorf("resolver group %q does not exist, must be one of: %s", group, strings.Join(names, ", "))
+	}
+
+	input, err := readLookupInput(args.Input)
+	if err != nil {
+		return nil, err
+	}
+
+	hosts, err := lookup.ParseHosts(input)
+	if err != nil {
+		return nil, err
+	}
+
+	report := &LookupReport{Group: group, Threshold: args.Threshold}
+
+	for _, rtype := range types {
+		results, err := LookupAll(hosts, resolvers, rtype, args.Fanout)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, rec := range results.Records {
+			report.Total++
+
+			if rec.IsMatch {
+				report.Matched++
+			}
+
+			if rec.Error != "" {
+				report.Errors++
+			}
+		}
+
+		report.Results = append(report.Results, results)
+	}
+
+	if report.Total > 0 {
+		report.MatchRate = float64(report.Matched) / float64(report.Total) * 100
+	}
+	report.Passed = report.Total > 0 && report.MatchRate >= report.Threshold
+
+	return report, nil
+}
+
+// writeLookupReport writes the report as a table, followed by a summary.
+func writeLookupReport(out io.Writer, report *LookupReport) error {
+	w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "HOST\tTYPE\tEXPECTED\tANSWERS\tSTATE\tRTT\tRESOLVER")
+
+	for _, results := range report.Results {
+		for _, rec := range results.Records {
+			answers := strings.Join(rec.Answers, " ")
+			if rec.Error != "" {
+				answers = rec.Error
+			}
+
+			values := []string{rec.Query, rec.RType, rec.Want, answers, hostState(rec), rec.ResponseTime, rec.Resolver}
+			for i := range values {
+				if values[i] == "" {
+					values[i] = "-"
+				}
+			}
+
+			fmt.Fprintln(w, strings.Join(values, "\t"))
+		}
+	}
+
+	if err := w.Flush(); err != nil {
+		return err
+	}
+
+	result := "PASS"
+	if !report.Passed {
+		result = "FAIL"
+	}
+
+	_, err := fmt.Fprintf(out, "\n%s: %d/%d answers matched (%.1f%%, threshold %.1f%%), %d errors, using %q\n",
+		result, report.Matched, report.Total, report.MatchRate, report.Threshold, report.Errors, report.Group)
+
+	return err
+}
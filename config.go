@@ -0,0 +1,356 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	arg "github.com/alexflint/go-arg"
+)
+
+// Config represents the configuration for the app
+type Config struct {
+	ConfigFile      string                    `arg:"--config,help:path to a json configuration file" json:"-"`
+	Debug           bool                      `arg:"-d,help:enable debugging mode" json:"debug"`
+	Host            string                    `arg:"-h,help:host/ip for which to bind to" json:"host"`
+	Port            int                       `arg:"-p,help:port which to bind to" json:"port"`
+	Database        string                    `arg:"help:file path to the database for dnscheck" json:"database"`
+	Storage         string                    `arg:"--storage,help:where results are stored: bolt (the database file) or memory or postgres" json:"storage"`
+	DatabaseURL     string                    `arg:"--database-url,help:connection url of the postgres database when using the postgres storage" json:"database_url"`
+	GeoDb           string                    `arg:"help:GeoIP database location" json:"geo_db"`
+	GeoURL          string                    `arg:"--geo-url,help:url to download the gzipped GeoIP database from" json:"geo_url"`
+	NoGeoUpdate     bool                      `arg:"--no-geo-update,help:disable automatic GeoIP database updates" json:"no_geo_update"`
+	CustomResolvers []string                  `arg:"-r,help:resolver to use to resolve query lookups" json:"custom_resolvers"`
+	Groups          map[string]*ResolverGroup `arg:"-" json:"resolvers"` // resolver groups from the configuration file
+	Resolvers       map[string]*ResolverGroup `arg:"-" json:"-"`         // underlying resolver map, created during startup
+	ResolverInfo    map[string]*ResolverInfo  `arg:"-" json:"-"`         // geolocation of each resolver, created during startup
+	ResolverFile    string                    `arg:"--resolver-file,help:public-dns.info style resolver list (csv or json) to build resolver groups from" json:"resolver_file"`
+	ResolverCountry []string                  `arg:"--resolver-country,help:build a resolver group for each of these country codes from the resolver list" json:"resolver_country"`
+	MinReliability  float64                   `arg:"--min-reliability,help:minimum reliability (0-1) of resolvers used from the resolver list" json:"min_reliability"`
+	DNSSECOnly      bool                      `arg:"--dnssec-only,help:only use resolvers from the resolver list which validate DNSSEC" json:"dnssec_only"`
+	MaxGroupSize    int                       `arg:"--max-group-size,help:max number of resolvers in each group built from the resolver list" json:"max_group_size"`
+	Concurrency     int                       `arg:"-c,help:number of records to use for resolving records" json:"concurrency"`
+	MaxInflight     int                       `arg:"--max-inflight,help:max in-flight queries across all concurrent scans" json:"max_inflight"`
+	ResolverQPS     float64                   `arg:"--resolver-qps,help:max queries per second sent to each resolver (0 to disable)" json:"resolver_qps"`
+	Limit           int                       `arg:"-l,help:max queries per request" json:"limit"`
+	WatchInterval   int                       `arg:"--watch-interval,help:seconds between checks for configuration changes (0 to disable)" json:"watch_interval"`
+	RetentionDays   int                       `arg:"--retention-days,help:days scan results are kept unless pinned (0 to keep them forever)" json:"retention_days"`
+	SweepInterval   int                       `arg:"--sweep-interval,help:minutes between removing expired results and compacting the database (0 to disable)" json:"sweep_interval"`
+	Webhooks        []string                  `arg:"--webhook,help:url to POST scan and monitor notifications to" json:"webhooks"`
+	WebhookSecret   string                    `arg:"--webhook-secret,help:secret used to sign webhook payloads (HMAC-SHA256)" json:"webhook_secret"`
+	AdminToken      string                    `arg:"--admin-token,help:password for the admin pages (user admin) which are disabled if empty" json:"admin_token"`
+	ExposureChecks  bool                      `arg:"--exposure-checks,help:test delegated nameservers for zone transfers and open recursion" json:"exposure_checks"`
+}
+
+// defaultConfig returns the default configuration, before the configuration
+// file, environment and flags are applied.
+func defaultConfig() Config {
+	return Config{
+		Debug:           false,
+		Host:            "localhost",
+		Port:            3000,
+		Database:        "dns.db",
+		Storage:         "bolt",
+		GeoDb:           "geoip.db",
+		GeoURL:          "http://geolite.maxmind.com/download/geoip/database/GeoLite2-City.mmdb.gz",
+		CustomResolvers: []string{},
+		Groups:          make(map[string]*ResolverGroup),
+		Resolvers:       make(map[string]*ResolverGroup),
+		ResolverInfo:    make(map[string]*ResolverInfo),
+		ResolverCountry: []string{},
+		Webhooks:        []string{},
+		MinReliability:  0.9,
+		MaxGroupSize:    10,
+		Concurrency:     10,
+		MaxInflight:     50,
+		ResolverQPS:     20,
+		Limit:           500,
+		WatchInterval:   10,
+		RetentionDays:   30,
+		SweepInterval:   60,
+	}
+}
+
+// envPrefix is the prefix of all environment variables which override the
+// configuration. E.g. DNSCHECK_PORT overrides "port".
+const envPrefix = "DNSCHECK_"
+
+// Duration is a time.Duration which is represented as a string (e.g. "2s")
+// within the configuration file.
+type Duration time.Duration
+
+// UnmarshalJSON parses a duration string.
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var raw string
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return errors.New("durations must be strings, like \"2s\"")
+	}
+
+	dur, err := time.ParseDuration(raw)
+	if err != nil {
+		return err
+	}
+
+	*d = Duration(dur)
+
+	return nil
+}
+
+// MarshalJSON encodes the duration as a string.
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+// loadConfig builds the configuration from (in order of precedence) flags,
+// environment variables, the configuration file and the defaults, and then
+// validates it.
+func loadConfig() (*Config, error) {
+	// flags are parsed once to find the configuration file, then again once
+	// the file and environment have been applied, so they take precedence.
+	out := defaultConfig()
+	arg.MustParse(&out)
+
+	fn := out.ConfigFile
+	if fn == "" {
+		fn = os.Getenv(envPrefix + "CONFIG")
+	}
+
+	out, err := fileConfig(fn)
+	if err != nil {
+		return nil, err
+	}
+
+	arg.MustParse(&out)
+	out.ConfigFile = fn
+
+	if err := out.Validate(); err != nil {
+		return nil, err
+	}
+
+	return &out, nil
+}
+
+// fileConfig returns the defaults, with the configuration file fn (if not
+// empty) and the environment applied, but not flags.
+func fileConfig(fn string) (Config, error) {
+	out := defaultConfig()
+	if fn != "" {
+		if err := readConfigFile(fn, &out); err != nil {
+			return out, err
+		}
+	}
+
+	if err := applyEnv(&out); err != nil {
+		return out, err
+	}
+
+	out.ConfigFile = fn
+
+	return out, nil
+}
+
+// readConfigFile reads the json configuration file fn into c.
+func readConfigFile(fn string, c *Config) error {
+	f, err := os.Open(fn)
+	if err != nil {
+		return fmt.Errorf("unable to open config file: %s", err)
+	}
+	defer f.Close()
+
+	decoder := json.NewDecoder(f)
+	decoder.DisallowUnknownFields()
+
+	if err = decoder.Decode(c); err != nil {
+		return fmt.Errorf("unable to parse config file %q: %s", fn, err)
+	}
+
+	return nil
+}
+
+// applyEnv applies any environment variable overrides to c.
+func applyEnv(c *Config) error {
+	v := reflect.ValueOf(c).Elem()
+	t := v.Type()
+
+	for i := 0; i < t.NumField(); i++ {
+		name := strings.Split(t.Field(i).Tag.Get("json"), ",")[0]
+		if name == "" || name == "-" {
+			continue
+		}
+
+		env := envPrefix + strings.ToUpper(name)
+		raw, ok := os.LookupEnv(env)
+		if !ok {
+			continue
+		}
+
+		field := v.Field(i)
+		var err error
+
+		switch field.Kind() {
+		case reflect.String:
+			field.SetString(raw)
+		case reflect.Bool:
+			var b bool
+			b, err = strconv.ParseBool(raw)
+			field.SetBool(b)
+		case reflect.Int:
+			var n int64
+			n, err = strconv.ParseInt(raw, 10, 0)
+			field.SetInt(n)
+		case reflect.Float64:
+			var f float64
+			f, err = strconv.ParseFloat(raw, 64)
+			field.SetFloat(f)
+		case reflect.Slice:
+			var items []string
+			for _, item := range strings.Split(raw, ",") {
+				if item = strings.TrimSpace(item); item != "" {
+					items = append(items, item)
+				}
+			}
+			field.Set(reflect.ValueOf(items))
+		default:
+			err = errors.New("cannot be set from the environment")
+		}
+
+		if err != nil {
+			return fmt.Errorf("invalid value for %s: %s", env, err)
+		}
+	}
+
+	return nil
+}
+
+// validServer returns true if server is an ip, or an ip:port pair.
+func validServer(server string) bool {
+	if net.ParseIP(server) != nil {
+		return true
+	}
+
+	host, port, err := net.SplitHostPort(server)
+	if err != nil || net.ParseIP(host) == nil {
+		return false
+	}
+
+	_, err = strconv.ParseUint(port, 10, 16)
+
+	return err == nil
+}
+
+// Validate checks the configuration, returning an error listing every
+// problem found.
+func (c *Config) Validate() error {
+	var problems []string
+
+	fail := func(format string, args ...interface{}) {
+		problems = append(problems, fmt.Sprintf(format, args...))
+	}
+
+	if c.Port < 1 || c.Port > 65535 {
+		fail("port: must be between 1 and 65535 (got %d)", c.Port)
+	}
+	switch c.Storage {
+	case "bolt":
+		if c.Database == "" {
+			fail("database: must not be empty")
+		}
+	case "memory":
+	case "postgres":
+		if c.DatabaseURL == "" {
+			fail("database_url: must not be empty when using the postgres storage")
+		}
+	default:
+		fail("storage: must be one of bolt, memory or postgres (got %q)", c.Storage)
+	}
+	if c.GeoDb == "" {
+		fail("geo_db: must not be empty")
+	}
+	if c.Concurrency < 1 {
+		fail("concurrency: must be at least 1 (got %d)", c.Concurrency)
+	}
+	if c.MaxInflight < 1 {
+		fail("max_inflight: must be at least 1 (got %d)", c.MaxInflight)
+	}
+	if c.ResolverQPS < 0 {
+		fail("resolver_qps: must not be negative (got %g)", c.ResolverQPS)
+	}
+	if c.Limit < 1 {
+		fail("limit: must be at least 1 (got %d)", c.Limit)
+	}
+	if c.MinReliability < 0 || c.MinReliability > 1 {
+		fail("min_reliability: must be between 0 and 1 (got %g)", c.MinReliability)
+	}
+	if c.WatchInterval < 0 {
+		fail("watch_interval: must not be negative (got %d)", c.WatchInterval)
+	}
+	if c.RetentionDays < 0 {
+		fail("retention_days: must not be negative (got %d)", c.RetentionDays)
+	}
+	if c.SweepInterval < 0 {
+		fail("sweep_interval: must not be negative (got %d)", c.SweepInterval)
+	}
+	if c.MaxGroupSize < 0 {
+		fail("max_group_size: must not be negative (got %d)", c.MaxGroupSize)
+	}
+
+	for _, hook := range c.Webhooks {
+		if u, err := url.Parse(hook); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			fail("webhooks: %q is not a valid http(s) url", hook)
+		}
+	}
+
+	for _, server := range c.CustomResolvers {
+		if !validServer(server) {
+			fail("custom_resolvers: %q is not a valid ip or ip:port", server)
+		}
+	}
+
+	var defaults []string
+	for name, group := range c.Groups {
+		if name == "" {
+			fail("resolvers: group names must not be empty")
+		}
+		if group == nil || len(group.Servers) == 0 {
+			fail("resolvers.%s: must contain at least one server", name)
+			continue
+		}
+
+		for _, server := range group.Servers {
+			if !validServer(server) {
+				fail("resolvers.%s: %q is not a valid ip or ip:port", name, server)
+			}
+		}
+
+		switch group.Transport {
+		case "", "udp", "tcp", "tcp-tls":
+		default:
+			fail("resolvers.%s: transport must be one of udp, tcp or tcp-tls (got %q)", name, group.Transport)
+		}
+
+		if group.Timeout < 0 {
+			fail("resolvers.%s: timeout must not be negative", name)
+		}
+
+		if group.Default {
+			defaults = append(defaults, name)
+		}
+	}
+
+	if len(defaults) > 1 {
+		fail("resolvers: only one group may be the default (got %s)", strings.Join(defaults, ", "))
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("invalid configuration:\n  - %s", strings.Join(problems, "\n  - "))
+	}
+
+	return nil
+}
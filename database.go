@@ -1,142 +1,210 @@
 package main
 
 import (
-	"bytes"
-	"encoding/gob"
+	"errors"
 	"log"
+	"sync"
 	"time"
-
-	"github.com/boltdb/bolt"
 )
 
-// DB allows us to embed the bolt db so we can implement custom methods upon it
+// DB wraps the configured Store, encoding structs as records (see
+// encodeRecord), and recording metrics of each query.
 type DB struct {
-	*bolt.DB
+	store Store
 }
 
-var defaultBuckets = []string{"records"}
+var defaultBuckets = []string{"records", "benchmarks", "email", "delegation", "monitors", "monitor-runs", "webhooks", "apikeys", "leases", hostIndex, answerIndex, metaBucket}
+
+var errDatabaseClosed = errors.New("database is closed")
+
+// sharedDB is the process-wide database handle, opened by initDatabase.
+var sharedDB *DB
+
+// dbLock is held (for reading) while the shared handle is in use, so it can
+// be compacted (see compactDatabase) or closed (see closeDatabase) once
+// nothing is using it.
+var dbLock sync.RWMutex
 
-// newDB returns a new DB object. If there are no errors, db.Clean() should ALWAYS be ran
-// to clean up and close the database.
+// newDB returns the shared database handle. If there are no errors,
+// db.Clean() should ALWAYS be ran once done with it.
 func newDB() (*DB, error) {
-	boltdb, err := bolt.Open(conf.Database, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	dbLock.RLock()
 
-	if err != nil {
-		return nil, err
+	if sharedDB == nil {
+		dbLock.RUnlock()
+		return nil, errDatabaseClosed
 	}
 
-	db := &DB{boltdb}
-
-	return db, nil
+	return sharedDB, nil
 }
 
-// initDatabase initializes the needed structure of the database, so these checks don't
-// have to be completed for every query (e.g. if a bucket is created).
-// One would assume a bucket is not removed while the bot is running.
+// initDatabase opens the configured storage as the shared database handle,
+// and builds the search indexes if needed.
 func initDatabase() {
-	db, err := newDB()
+	store, err := openStore(conf())
 	if err != nil {
-		logger.Fatal("unable to instantiate database:", err)
+		logger.Fatal("unable to instantiate database: ", err)
 	}
-	defer db.Clean()
 
-	for _, bucket := range defaultBuckets {
-		if err := db.VerifyBucket(bucket); err != nil {
-			logger.Fatalf("unable to create/access bucket %s: %s", bucket, err)
-		}
+	dbLock.Lock()
+	sharedDB = &DB{store: store}
+	dbLock.Unlock()
+
+	if err = buildSearchIndex(); err != nil {
+		logger.Println("unable to build the search index:", err)
 	}
 
 	return
 }
 
-// Clean is a wrapper around db.Close() that runs regardless of error.
-func (db *DB) Clean() {
-	_ = db.Close()
+// closeDatabase waits for any in-flight queries, and closes the shared
+// database handle. Any later queries return errDatabaseClosed.
+func closeDatabase() error {
+	dbLock.Lock()
+	defer dbLock.Unlock()
 
-	return
+	if sharedDB == nil {
+		return nil
+	}
+
+	err := sharedDB.store.Close()
+	sharedDB = nil
+
+	return err
 }
 
-// VerifyBucket is used to verify that a bucket exists and that the database is readable.
-func (db *DB) VerifyBucket(bucket string) error {
-	return db.Update(func(tx *bolt.Tx) error {
-		_, err := tx.CreateBucketIfNotExists([]byte(bucket))
+// Clean releases the handle returned by newDB. It runs regardless of error.
+func (db *DB) Clean() {
+	dbLock.RUnlock()
 
-		return err
-	})
+	return
 }
 
-// Count returns the number of keys in name
-func (db *DB) Count(name string) (stats int, err error) {
-	if err = db.VerifyBucket(name); err != nil {
-		return stats, err
-	}
+// compactDatabase reclaims the space left by removed keys, if the storage
+// supports it (see Compacter). It returns the size of the database before
+// and after, or errNotCompactable.
+func compactDatabase() (before, after int64, err error) {
+	dbLock.Lock()
+	defer dbLock.Unlock()
 
-	err = db.View(func(tx *bolt.Tx) error {
-		stats = tx.Bucket([]byte(name)).Stats().KeyN
+	if sharedDB == nil {
+		return 0, 0, errDatabaseClosed
+	}
 
-		return nil
-	})
+	store, ok := sharedDB.store.(Compacter)
+	if !ok {
+		return 0, 0, errNotCompactable
+	}
 
-	return stats, err
+	return store.Compact()
 }
 
-// SetStruct sets data{} into bytes(key) on bytes(bucket)
-func (db *DB) SetStruct(bucket, key string, data interface{}) error {
-	if err := db.VerifyBucket(bucket); err != nil {
+// SetStruct sets data{} into bytes(key) on bytes(bucket), as a record (see
+// encodeRecord).
+func (db *DB) SetStruct(bucket, key string, data interface{}) (err error) {
+	defer func(start time.Time) { observeDB("set", bucket, start, err) }(time.Now())
+
+	value, err := encodeRecord(data)
+	if err != nil {
+		log.Println("encode:", err)
 		return err
 	}
 
-	return db.Update(func(tx *bolt.Tx) error {
-		buffer := new(bytes.Buffer)
-		encoder := gob.NewEncoder(buffer)
+	return db.store.Put(bucket, key, value)
+}
+
+// SetStructs sets each of data{} into bytes(key) on bytes(bucket), as with
+// SetStruct, within a single transaction.
+func (db *DB) SetStructs(bucket string, data map[string]interface{}) (err error) {
+	defer func(start time.Time) { observeDB("set", bucket, start, err) }(time.Now())
 
-		if err := encoder.Encode(data); err != nil {
+	values := make(map[string][]byte, len(data))
+	for key, input := range data {
+		if values[key], err = encodeRecord(input); err != nil {
 			log.Println("encode:", err)
 			return err
 		}
+	}
 
-		return tx.Bucket([]byte(bucket)).Put([]byte(key), buffer.Bytes())
-	})
+	return db.store.PutMany(bucket, values)
 }
 
 // GetStruct gets bytes from bytes(key) on bytes(bucket) and sets into &input{}
-func (db *DB) GetStruct(bucket, key string, input interface{}) error {
-	if err := db.VerifyBucket(bucket); err != nil {
+func (db *DB) GetStruct(bucket, key string, input interface{}) (err error) {
+	defer func(start time.Time) { observeDB("get", bucket, start, err) }(time.Now())
+
+	value, err := db.store.Get(bucket, key)
+	if err != nil {
 		return err
 	}
 
-	return db.View(func(tx *bolt.Tx) error {
-		return gob.NewDecoder(bytes.NewBuffer(tx.Bucket([]byte(bucket)).Get([]byte(key)))).Decode(input)
+	return decodeRecord(value, input)
+}
+
+// UpdateStruct gets bytes(key) on bytes(bucket) into &data{}, calls fn, and
+// then sets data{} back into bytes(key), all within a single transaction. If
+// fn returns an error, nothing is written.
+func (db *DB) UpdateStruct(bucket, key string, data interface{}, fn func() error) (err error) {
+	defer func(start time.Time) { observeDB("update", bucket, start, err) }(time.Now())
+
+	return db.store.Update(bucket, key, func(value []byte) ([]byte, error) {
+		if err := decodeRecord(value, data); err != nil {
+			return nil, err
+		}
+
+		if err := fn(); err != nil {
+			return nil, err
+		}
+
+		value, err := encodeRecord(data)
+		if err != nil {
+			log.Println("encode:", err)
+		}
+
+		return value, err
 	})
 }
 
 // GetReceivedStruct takes bytes (e.g. from iterating over db) and sets into &input{}
 func (db *DB) GetReceivedStruct(data []byte, input interface{}) error {
-	return gob.NewDecoder(bytes.NewBuffer(data)).Decode(input)
+	return decodeRecord(data, input)
 }
 
-// Set sets string(data) into bytes(key) on bytes(bucket)
-func (db *DB) Set(bucket, key string, data string) error {
-	if err := db.VerifyBucket(bucket); err != nil {
-		return err
-	}
+// Delete removes bytes(key) from bytes(bucket).
+func (db *DB) Delete(bucket, key string) (err error) {
+	defer func(start time.Time) { observeDB("delete", bucket, start, err) }(time.Now())
 
-	return db.Update(func(tx *bolt.Tx) error {
-		return tx.Bucket([]byte(bucket)).Put([]byte(key), []byte(data))
-	})
+	return db.store.Delete(bucket, key)
 }
 
-// Get gets type(string) from bytes(key) on bytes(bucket)
-func (db *DB) Get(bucket, key string) (out string, err error) {
-	if err = db.VerifyBucket(bucket); err != nil {
-		return "", err
-	}
+// DeleteKeys removes each of keys from bytes(bucket), within a single
+// transaction.
+func (db *DB) DeleteKeys(bucket string, keys []string) (err error) {
+	defer func(start time.Time) { observeDB("delete", bucket, start, err) }(time.Now())
 
-	err = db.View(func(tx *bolt.Tx) error {
-		out = string(tx.Bucket([]byte(bucket)).Get([]byte(key))[:])
+	return db.store.DeleteMany(bucket, keys)
+}
 
-		return nil
-	})
+// DeletePrefix removes every key on bytes(bucket) starting with prefix.
+func (db *DB) DeletePrefix(bucket, prefix string) (err error) {
+	defer func(start time.Time) { observeDB("delete", bucket, start, err) }(time.Now())
+
+	return db.store.DeletePrefix(bucket, prefix)
+}
+
+// ForEach calls fn for every key on bytes(bucket) starting with prefix, in
+// key order. data is only valid within fn. Returning an error from fn stops
+// the iteration.
+func (db *DB) ForEach(bucket, prefix string, fn func(key string, data []byte) error) (err error) {
+	defer func(start time.Time) { observeDB("list", bucket, start, err) }(time.Now())
+
+	return db.store.ForEach(bucket, prefix, fn)
+}
+
+// ForEachReverse is like ForEach, but iterates in reverse key order, and
+// stops after n keys (if n is above 0).
+func (db *DB) ForEachReverse(bucket, prefix string, n int, fn func(key string, data []byte) error) (err error) {
+	defer func(start time.Time) { observeDB("list", bucket, start, err) }(time.Now())
 
-	return out, err
+	return db.store.ForEachReverse(bucket, prefix, n, fn)
 }
@@ -0,0 +1,464 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lrstanley/dnscheck/lookup"
+	sempool "github.com/lrstanley/go-sempool"
+	"github.com/miekg/dns"
+)
+
+// DelegationReport contains the delegation checks for a list of domains.
+type DelegationReport struct {
+	Domains  []*DelegationResult
+	ScanTime string
+	Expiry
+}
+
+// NameserverResult is the result of querying a single delegated nameserver
+// directly.
+type NameserverResult struct {
+	Name          string
+	Addrs         []string
+	Glue          []string
+	Authoritative bool
+	NS            []string
+	Serial        uint32
+	Error         string
+
+	// AXFR and IXFR are the number of records within the first message of a
+	// zone transfer, if the nameserver allowed it.
+	AXFR         int
+	IXFR         int
+	OpenResolver bool
+
+	// addr is the address of the nameserver which answered, of Addrs.
+	addr string
+}
+
+// Lame returns true if the nameserver doesn't answer authoritatively for the
+// domain.
+func (ns *NameserverResult) Lame() bool {
+	return !ns.Authoritative
+}
+
+// DelegationResult contains the delegation checks for a single domain.
+type DelegationResult struct {
+	Domain    string
+	Parent    string
+	ParentNS  []string
+	Delegated []string
+	ChildNS   []string
+	Servers   []*NameserverResult
+	Findings  []*Finding
+	Error     string
+	// Exposure is true if the nameservers were tested for zone transfers and
+	// open recursion (see checkExposure).
+	Exposure bool
+}
+
+func (r *DelegationResult) finding(severity, format string, args ...interface{}) {
+	r.Findings = append(r.Findings, &Finding{Severity: severity, Message: fmt.Sprintf(format, args...)})
+}
+
+// Grade returns the most severe finding for the domain.
+func (r *DelegationResult) Grade() string {
+	if r.Error != "" {
+		return SeverityError
+	}
+
+	grade := SeverityOK
+	for _, f := range r.Findings {
+		if severityRank[f.Severity] > severityRank[grade] {
+			grade = f.Severity
+		}
+	}
+
+	return grade
+}
+
+// normalizeName lower-cases name, and strips the trailing dot.
+func normalizeName(name string) string {
+	return strings.ToLower(strings.TrimSuffix(name, "."))
+}
+
+// inBailiwick returns true if name is within (or is) zone.
+func inBailiwick(name, zone string) bool {
+	return dns.IsSubDomain(dns.Fqdn(zone), dns.Fqdn(name))
+}
+
+// recursiveQuery sends a query for name to one of the resolvers in group.
+func recursiveQuery(group *ResolverGroup, budget *lookup.Budget, name string, qtype uint16) (*dns.Msg, error) {
+	msg := new(dns.Msg)
+	msg.SetQuestion(dns.Fqdn(name), qtype)
+
+	server, release := budget.Acquire(group.Servers)
+	resp, _, err := group.Exchange(server, msg)
+	release()
+
+	return resp, err
+}
+
+// resolveAddrs resolves the ipv4 and ipv6 addresses of name using group,
+// ipv4 first.
+func resolveAddrs(group *ResolverGroup, budget *lookup.Budget, name string) (out []string, err error) {
+	for _, qtype := range []uint16{dns.TypeA, dns.TypeAAAA} {
+		resp, qerr := recursiveQuery(group, budget, name, qtype)
+		if qerr == nil && resp.Rcode != dns.RcodeSuccess {
+			qerr = fmt.Errorf("unable to resolve %s: %s", name, dns.RcodeToString[resp.Rcode])
+		}
+
+		if qerr != nil {
+			err = qerr
+			continue
+		}
+
+		for _, rr := range resp.Answer {
+			switch r := rr.(type) {
+			case *dns.A:
+				out = append(out, r.A.String())
+			case *dns.AAAA:
+				out = append(out, r.AAAA.String())
+			}
+		}
+	}
+
+	if len(out) > 0 {
+		return out, nil
+	}
+
+	if err == nil {
+		err = fmt.Errorf("%s has no A or AAAA records", name)
+	}
+
+	return nil, err
+}
+
+// directQuery sends a non-recursive query for name directly to the server at
+// ip (e.g. an authoritative nameserver), retrying over tcp if the response is
+// truncated.
+func directQuery(group *ResolverGroup, budget *lookup.Budget, ip, name string, qtype uint16, recurse bool) (*dns.Msg, error) {
+	msg := new(dns.Msg)
+	msg.SetQuestion(dns.Fqdn(name), qtype)
+	msg.RecursionDesired = recurse
+
+	client := &dns.Client{Timeout: lookup.DefaultTimeout}
+	if group.Timeout > 0 {
+		client.Timeout = time.Duration(group.Timeout)
+	}
+
+	addr := net.JoinHostPort(ip, "53")
+
+	_, release := budget.Acquire([]string{ip})
+	resp, rtt, err := client.Exchange(msg, addr)
+	if err == nil && resp.Truncated {
+		client.Net = "tcp"
+		resp, rtt, err = client.Exchange(msg, addr)
+	}
+	release()
+
+	// nameservers are labelled as one, as there's no bound on how many
+	// distinct ones are queried.
+	observeQuery("authoritative", resp, rtt, err)
+
+	return resp, err
+}
+
+// findParent finds the closest enclosing zone of domain, returning the zone
+// and its nameservers.
+func findParent(group *ResolverGroup, budget *lookup.Budget, domain string) (string, []string, error) {
+	labels := dns.SplitDomainName(domain)
+
+	for i := 1; i < len(labels); i++ {
+		zone := strings.Join(labels[i:], ".")
+
+		resp, err := recursiveQuery(group, budget, zone, dns.TypeNS)
+		if err != nil {
+			return "", nil, err
+		}
+
+		var servers []string
+		for _, rr := range resp.Answer {
+			if ns, ok := rr.(*dns.NS); ok && normalizeName(ns.Hdr.Name) == zone {
+				servers = append(servers, normalizeName(ns.Ns))
+			}
+		}
+
+		if len(servers) > 0 {
+			sort.Strings(servers)
+			return zone, servers, nil
+		}
+	}
+
+	return "", nil, errors.New("unable to find the parent zone")
+}
+
+// diffSets returns the items in a which aren't in b.
+func diffSets(a, b []string) (out []string) {
+	known := make(map[string]bool)
+	for _, item := range b {
+		known[item] = true
+	}
+
+	for _, item := range a {
+		if !known[item] {
+			out = append(out, item)
+		}
+	}
+
+	return out
+}
+
+// queryNameserver resolves the addresses of a delegated nameserver, and asks
+// it directly for the NS set and SOA serial of domain.
+func queryNameserver(group *ResolverGroup, budget *lookup.Budget, domain string, ns *NameserverResult) {
+	addrs, err := resolveAddrs(group, budget, ns.Name)
+	if err != nil && len(ns.Glue) == 0 {
+		ns.Error = err.Error()
+		return
+	}
+
+	ns.Addrs = addrs
+	if len(ns.Addrs) == 0 {
+		ns.Addrs = ns.Glue
+	}
+
+	// the nameserver may not be reachable over every address, e.g. its ipv6
+	// addresses without ipv6 connectivity.
+	var resp *dns.Msg
+	for _, addr := range ns.Addrs {
+		if resp, err = directQuery(group, budget, addr, domain, dns.TypeNS, false); err == nil {
+			ns.addr = addr
+			break
+		}
+	}
+
+	if err != nil {
+		ns.Error = err.Error()
+		return
+	}
+
+	if resp.Rcode != dns.RcodeSuccess {
+		ns.Error = dns.RcodeToString[resp.Rcode]
+		return
+	}
+
+	ns.Authoritative = resp.Authoritative
+
+	for _, rr := range resp.Answer {
+		if r, ok := rr.(*dns.NS); ok {
+			ns.NS = append(ns.NS, normalizeName(r.Ns))
+		}
+	}
+	sort.Strings(ns.NS)
+
+	if soa, err := directQuery(group, budget, ns.addr, domain, dns.TypeSOA, false); err == nil {
+		for _, rr := range soa.Answer {
+			if r, ok := rr.(*dns.SOA); ok {
+				ns.Serial = r.Serial
+			}
+		}
+	}
+}
+
+// checkDelegation compares the NS set served by the parent zone of domain
+// with the NS set served by its own nameservers, checks the glue records,
+// and finds nameservers which don't answer authoritatively (lame
+// delegations), allow zone transfers, or are open resolvers.
+func checkDelegation(group *ResolverGroup, budget *lookup.Budget, domain string) *DelegationResult {
+	res := &DelegationResult{Domain: normalizeName(domain)}
+
+	if len(dns.SplitDomainName(res.Domain)) < 2 {
+		res.Error = "domain must have at least two labels"
+		return res
+	}
+
+	var err error
+	res.Parent, res.ParentNS, err = findParent(group, budget, res.Domain)
+	if err != nil {
+		res.Error = err.Error()
+		return res
+	}
+
+	// ask the parent's nameservers for the delegation (referral).
+	var referral *dns.Msg
+	for _, ns := range res.ParentNS {
+		addrs, err := resolveAddrs(group, budget, ns)
+		if err != nil {
+			continue
+		}
+
+		for _, addr := range addrs {
+			if referral, err = directQuery(group, budget, addr, res.Domain, dns.TypeNS, false); err == nil && referral.Rcode == dns.RcodeSuccess {
+				break
+			}
+
+			referral = nil
+		}
+
+		if referral != nil {
+			break
+		}
+	}
+
+	if referral == nil {
+		res.Error = fmt.Sprintf("none of the nameservers for %s returned a delegation", res.Parent)
+		return res
+	}
+
+	glue := make(map[string][]string)
+	for _, rr := range append(referral.Ns, referral.Answer...) {
+		if ns, ok := rr.(*dns.NS); ok && normalizeName(ns.Hdr.Name) == res.Domain {
+			res.Delegated = append(res.Delegated, normalizeName(ns.Ns))
+		}
+	}
+	for _, rr := range referral.Extra {
+		name := normalizeName(rr.Header().Name)
+
+		switch r := rr.(type) {
+		case *dns.A:
+			glue[name] = append(glue[name], r.A.String())
+		case *dns.AAAA:
+			glue[name] = append(glue[name], r.AAAA.String())
+		}
+	}
+	sort.Strings(res.Delegated)
+
+	if len(res.Delegated) == 0 {
+		res.Error = fmt.Sprintf("%s is not delegated from %s", res.Domain, res.Parent)
+		return res
+	}
+
+	if len(res.Delegated) < 2 {
+		res.finding(SeverityWarning, "only one nameserver is delegated, at least two are recommended (RFC 1034 4.1)")
+	}
+
+	// query each delegated nameserver directly.
+	var wg sync.WaitGroup
+	res.Exposure = conf().ExposureChecks
+
+	for _, name := range res.Delegated {
+		ns := &NameserverResult{Name: name, Glue: glue[name]}
+		res.Servers = append(res.Servers, ns)
+
+		wg.Add(1)
+		go func(ns *NameserverResult) {
+			defer wg.Done()
+
+			queryNameserver(group, budget, res.Domain, ns)
+
+			if res.Exposure && ns.addr != "" {
+				checkExposure(group, budget, res.Domain, ns)
+			}
+		}(ns)
+	}
+
+	wg.Wait()
+
+	child := make(map[string]bool)
+	for _, ns := range res.Servers {
+		for _, name := range ns.NS {
+			if !child[name] {
+				child[name] = true
+				res.ChildNS = append(res.ChildNS, name)
+			}
+		}
+	}
+	sort.Strings(res.ChildNS)
+
+	// parent/child consistency.
+	if missing := diffSets(res.ChildNS, res.Delegated); len(missing) > 0 {
+		res.finding(SeverityWarning, "nameservers published by the zone, but not delegated by %s: %s", res.Parent, strings.Join(missing, ", "))
+	}
+	if missing := diffSets(res.Delegated, res.ChildNS); len(missing) > 0 && len(res.ChildNS) > 0 {
+		res.finding(SeverityWarning, "nameservers delegated by %s, but not published by the zone: %s", res.Parent, strings.Join(missing, ", "))
+	}
+
+	serials := make(map[uint32][]string)
+
+	for _, ns := range res.Servers {
+		switch {
+		case ns.Error != "":
+			res.finding(SeverityError, "%s is lame: %s", ns.Name, ns.Error)
+		case !ns.Authoritative:
+			res.finding(SeverityError, "%s is lame: it does not answer authoritatively for %s", ns.Name, res.Domain)
+		default:
+			serials[ns.Serial] = append(serials[ns.Serial], ns.Name)
+		}
+
+		if ns.AXFR > 0 {
+			res.finding(SeverityError, "%s allows zone transfers (AXFR) of %s to anyone, exposing its records", ns.Name, res.Domain)
+		}
+		if ns.IXFR > 0 {
+			res.finding(SeverityError, "%s allows incremental zone transfers (IXFR) of %s to anyone, exposing its records", ns.Name, res.Domain)
+		}
+		if ns.OpenResolver {
+			res.finding(SeverityError, "%s is an open resolver, it answered a recursive query for an unrelated name", ns.Name)
+		}
+
+		// glue is required for nameservers within the zone itself, and must
+		// match the addresses the zone publishes.
+		if inBailiwick(ns.Name, res.Domain) {
+			if len(ns.Glue) == 0 {
+				res.finding(SeverityError, "%s is within %s, but the parent has no glue for it", ns.Name, res.Domain)
+			} else if len(ns.Addrs) > 0 && len(diffSets(ns.Glue, ns.Addrs))+len(diffSets(ns.Addrs, ns.Glue)) > 0 {
+				res.finding(SeverityWarning, "glue for %s (%s) does not match its A/AAAA records (%s)", ns.Name, strings.Join(ns.Glue, ", "), strings.Join(ns.Addrs, ", "))
+			}
+		}
+	}
+
+	if len(serials) > 1 {
+		var parts []string
+		for serial, names := range serials {
+			parts = append(parts, fmt.Sprintf("%d (%s)", serial, strings.Join(names, ", ")))
+		}
+		sort.Strings(parts)
+
+		res.finding(SeverityWarning, "nameservers are serving different SOA serials: %s", strings.Join(parts, "; "))
+	}
+
+	return res
+}
+
+// CheckDelegations runs the delegation checks for every domain, using the
+// resolvers in group to find the parent zones and nameserver addresses.
+func CheckDelegations(domains []*Host, group *ResolverGroup) (*DelegationReport, error) {
+	if len(domains) == 0 {
+		return nil, errors.New("no domains to check")
+	}
+
+	c := conf()
+	if len(domains) > c.Limit {
+		return nil, errors.New("too many queries to process")
+	}
+
+	metricScans.Inc("delegation")
+
+	out := &DelegationReport{ScanTime: time.Now().Format(time.RFC3339)}
+
+	budget := scheduler.NewScan()
+	defer budget.Done()
+
+	pool := sempool.New(c.Concurrency)
+	out.Domains = make([]*DelegationResult, len(domains))
+
+	for i, domain := range domains {
+		pool.Slot()
+
+		go func(i int, domain string) {
+			defer pool.Free()
+
+			out.Domains[i] = checkDelegation(group, budget, domain)
+		}(i, domain.Name)
+	}
+
+	pool.Wait()
+
+	return out, nil
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/lrstanley/dnscheck/lookup"
+	"github.com/miekg/dns"
+)
+
+// Diff states of a single host.
+const (
+	DiffAdded     = "added"
+	DiffRemoved   = "removed"
+	DiffChanged   = "changed"
+	DiffUnchanged = "unchanged"
+)
+
+// HostDiff is the difference between the answers for a single host (and
+// resolver, if both scans were fanned out) in two scans.
+type HostDiff struct {
+	Query    string
+	Resolver string
+	State    string
+
+	Before *DNSAnswer
+	After  *DNSAnswer
+
+	Added     []string
+	Removed   []string
+	Unchanged []string
+
+	MatchChanged bool
+	ErrorChanged bool
+
+	// LatencyBefore and LatencyAfter are in milliseconds, and are 0 if the
+	// lookup failed.
+	LatencyBefore float64
+	LatencyAfter  float64
+}
+
+// LatencyDelta returns the change in latency, in milliseconds.
+func (d *HostDiff) LatencyDelta() float64 {
+	if d.LatencyBefore == 0 || d.LatencyAfter == 0 {
+		return 0
+	}
+
+	return d.LatencyAfter - d.LatencyBefore
+}
+
+// ScanDiff is the difference between two scans.
+type ScanDiff struct {
+	A      string
+	B      string
+	Before *DNSResults
+	After  *DNSResults
+	Hosts  []*HostDiff
+
+	Changed   int
+	Unchanged int
+}
+
+// parseLatency converts a response time (as formatted by lookup.FormatRTT) back into
+// milliseconds.
+func parseLatency(rtt string) float64 {
+	ms, err := strconv.ParseFloat(strings.TrimSuffix(rtt, "ms"), 64)
+	if err != nil {
+		return 0
+	}
+
+	return ms
+}
+
+// answerValue returns answer as it's compared between scans. Scans made
+// before lookups were sent directly to the resolvers may have stored whole
+// records (e.g. "example.com.\t300\tIN\tA\t93.184.216.34"), or values with
+// a trailing dot, so both are reduced to the value as it's stored now (see
+// lookup.RecordValue).
+//
+// TXT values are stored as is (the segments joined, without quotes), so
+// they're only parsed if they're a whole record, or quoted as they were
+// before, as parsing would otherwise drop their spaces.
+func answerValue(rtype, answer string) string {
+	trimmed := strings.TrimSpace(answer)
+
+	if rr, err := dns.NewRR(trimmed); err == nil && rr != nil && dns.TypeToString[rr.Header().Rrtype] == rtype {
+		return lookup.RecordValue(rr)
+	}
+
+	if rtype == "TXT" {
+		if !strings.HasPrefix(trimmed, `"`) {
+			return answer
+		}
+
+		if rr, err := dns.NewRR(". IN TXT " + trimmed); err == nil && rr != nil {
+			return lookup.RecordValue(rr)
+		}
+
+		return answer
+	}
+
+	answer = trimmed
+
+	if rr, err := dns.NewRR(". IN " + rtype + " " + answer); err == nil && rr != nil {
+		return lookup.RecordValue(rr)
+	}
+
+	return strings.TrimSuffix(answer, ".")
+}
+
+// diffAnswers returns the answers within a which aren't within b, compared
+// by their value (see answerValue).
+func diffAnswers(rtype string, a, b []string) (out []string) {
+	known := make(map[string]bool)
+	for _, item := range b {
+		known[answerValue(rtype, item)] = true
+	}
+
+	for _, item := range a {
+		if !known[answerValue(rtype, item)] {
+			out = append(out, item)
+		}
+	}
+
+	return out
+}
+
+// errorClass returns the kind of error a lookup failed with, so errors are
+// compared between scans by what went wrong, rather than by their message
+// (which may differ between versions of dnscheck).
+func errorClass(err string) string {
+	err = strings.ToLower(err)
+
+	switch {
+	case err == "":
+		return ""
+	case strings.Contains(err, "nxdomain") || strings.Contains(err, "no such host"):
+		return "nxdomain"
+	case strings.Contains(err, "servfail") || strings.Contains(err, "server failure"):
+		return "servfail"
+	case strings.Contains(err, "refused"):
+		return "refused"
+	case strings.Contains(err, "timeout") || strings.Contains(err, "timed out"):
+		return "timeout"
+	}
+
+	return "error"
+}
+
+// diffKey returns the key used to pair up answers from both scans. Answers
+// are only compared per-resolver if both scans were fanned out, otherwise
+// the first answer for each host is used.
+func diffKey(ans *DNSAnswer, perResolver bool) string {
+	if perResolver {
+		return ans.Query + "|" + ans.Resolver
+	}
+
+	return ans.Query
+}
+
+// DiffResults compares two scans (a before b), returning which answers were
+// added, removed or changed for each host, along with changes in match state
+// and latency.
+func DiffResults(a, b string, before, after *DNSResults) *ScanDiff {
+	out := &ScanDiff{A: a, B: b, Before: before, After: after}
+	perResolver := before.Fanout && after.Fanout
+
+	index := make(map[string]*HostDiff)
+	get := func(ans *DNSAnswer) *HostDiff {
+		key := diffKey(ans, perResolver)
+
+		if _, ok := index[key]; !ok {
+			index[key] = &HostDiff{Query: ans.Query}
+			if perResolver {
+				index[key].Resolver = ans.Resolver
+			}
+
+			out.Hosts = append(out.Hosts, index[key])
+		}
+
+		return index[key]
+	}
+
+	for _, ans := range before.Records {
+		if d := get(ans); d.Before == nil {
+			d.Before = ans
+		}
+	}
+
+	for _, ans := range after.Records {
+		if d := get(ans); d.After == nil {
+			d.After = ans
+		}
+	}
+
+	for _, d := range out.Hosts {
+		switch {
+		case d.Before == nil:
+			d.State = DiffAdded
+			d.Added = d.After.Answers
+		case d.After == nil:
+			d.State = DiffRemoved
+			d.Removed = d.Before.Answers
+		default:
+			rtype := d.After.RType
+			d.Added = diffAnswers(rtype, d.After.Answers, d.Before.Answers)
+			d.Removed = diffAnswers(rtype, d.Before.Answers, d.After.Answers)
+			d.Unchanged = diffSets(d.After.Answers, d.Added)
+			d.MatchChanged = d.Before.IsMatch != d.After.IsMatch
+			d.ErrorChanged = errorClass(d.Before.Error) != errorClass(d.After.Error)
+			d.LatencyBefore = parseLatency(d.Before.ResponseTime)
+			d.LatencyAfter = parseLatency(d.After.ResponseTime)
+
+			d.State = DiffUnchanged
+			if len(d.Added) > 0 || len(d.Removed) > 0 || d.MatchChanged || d.ErrorChanged {
+				d.State = DiffChanged
+			}
+		}
+
+		if d.State == DiffUnchanged {
+			out.Unchanged++
+		} else {
+			out.Changed++
+		}
+	}
+
+	// changes first, then by host.
+	sort.SliceStable(out.Hosts, func(i, j int) bool {
+		ci, cj := out.Hosts[i].State != DiffUnchanged, out.Hosts[j].State != DiffUnchanged
+		if ci != cj {
+			return ci
+		}
+
+		if out.Hosts[i].Query != out.Hosts[j].Query {
+			return out.Hosts[i].Query < out.Hosts[j].Query
+		}
+
+		return out.Hosts[i].Resolver < out.Hosts[j].Resolver
+	})
+
+	return out
+}
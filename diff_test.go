@@ -0,0 +1,87 @@
+package main
+
+import "testing"
+
+func TestAnswerValue(t *testing.T) {
+	tests := []struct {
+		rtype  string
+		answer string
+		want   string
+	}{
+		{"A", "93.184.216.34", "93.184.216.34"},
+		{"A", "example.com.\t300\tIN\tA\t93.184.216.34", "93.184.216.34"},
+		{"AAAA", "2606:2800:0220:0001:0248:1893:25c8:1946", "2606:2800:220:1:248:1893:25c8:1946"},
+		{"CNAME", "target.example.com.", "target.example.com"},
+		{"CNAME", "www.example.com.\t60\tIN\tCNAME\ttarget.example.com.", "target.example.com"},
+		{"MX", "10 mx.example.com.", "10 mx.example.com"},
+		{"MX", "10 mx.example.com", "10 mx.example.com"},
+		{"TXT", `"v=spf1 -all"`, "v=spf1 -all"},
+		{"TXT", "example.com.\t300\tIN\tTXT\t\"v=spf1 \" \"-all\"", "v=spf1 -all"},
+		{"TXT", "v=spf1 include:_spf.google.com -all", "v=spf1 include:_spf.google.com -all"},
+		{"TXT", `"v=spf1 include:_spf.google.com -all"`, "v=spf1 include:_spf.google.com -all"},
+		{"TXT", `"v=spf1 include:_spf.google.com" " -all"`, "v=spf1 include:_spf.google.com -all"},
+		{"TXT", "v=spf1 include:_spf.google.com-all", "v=spf1 include:_spf.google.com-all"},
+	}
+
+	for _, tt := range tests {
+		if got := answerValue(tt.rtype, tt.answer); got != tt.want {
+			t.Errorf("answerValue(%q, %q) = %q, want %q", tt.rtype, tt.answer, got, tt.want)
+		}
+	}
+}
+
+func TestDiffResultsFormats(t *testing.T) {
+	before := &DNSResults{Records: Answer{
+		{Query: "example.com", RType: "A", Answers: []string{"example.com.\t300\tIN\tA\t93.184.216.34"}},
+		{Query: "missing.example.com", RType: "A", Error: "NXDOMAIN"},
+	}}
+	after := &DNSResults{Records: Answer{
+		{Query: "example.com", RType: "A", Answers: []string{"93.184.216.34"}},
+		{Query: "missing.example.com", RType: "A", Error: "lookup failed: NXDOMAIN"},
+	}}
+
+	diff := DiffResults("a", "b", before, after)
+	if diff.Changed != 0 {
+		for _, d := range diff.Hosts {
+			t.Logf("%s: %s (added %v, removed %v)", d.Query, d.State, d.Added, d.Removed)
+		}
+		t.Errorf("%d hosts changed, want none", diff.Changed)
+	}
+}
+
+func TestDiffResultsTXT(t *testing.T) {
+	before := &DNSResults{Records: Answer{
+		{Query: "example.com", RType: "TXT", Answers: []string{`"v=spf1 include:_spf.google.com -all"`}},
+	}}
+	after := &DNSResults{Records: Answer{
+		{Query: "example.com", RType: "TXT", Answers: []string{"v=spf1 include:_spf.google.com -all"}},
+	}}
+
+	if diff := DiffResults("a", "b", before, after); diff.Changed != 0 {
+		t.Errorf("%d hosts changed, want none", diff.Changed)
+	}
+
+	// values differing only by their spaces are different records.
+	after.Records[0].Answers = []string{"v=spf1 include:_spf.google.com-all"}
+	if diff := DiffResults("a", "b", before, after); diff.Changed != 1 {
+		t.Errorf("%d hosts changed, want 1", diff.Changed)
+	}
+}
+
+func TestErrorClass(t *testing.T) {
+	tests := map[string]string{
+		"":                                  "",
+		"lookup failed: NXDOMAIN":           "nxdomain",
+		"lookup example.com: no such host":  "nxdomain",
+		"lookup failed: SERVFAIL":           "servfail",
+		"lookup failed: REFUSED":            "refused",
+		"read udp 10.0.0.1:53: i/o timeout": "timeout",
+		"connection reset by peer":          "error",
+	}
+
+	for in, want := range tests {
+		if got := errorClass(in); got != want {
+			t.Errorf("errorClass(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
@@ -1,54 +1,43 @@
 package main
 
 import (
-	"errors"
-	"fmt"
+	"context"
 	"net"
-	"regexp"
 	"sort"
-	"strings"
 	"sync"
 	"time"
 
-	ldns "github.com/lrstanley/go-ldns"
+	"github.com/lrstanley/dnscheck/lookup"
 	sempool "github.com/lrstanley/go-sempool"
-	"github.com/miekg/dns"
 )
 
 var recordTypes = [...]string{"A", "AAAA", "CNAME", "MX", "NS", "TXT"}
 
-// ^(?:(?P<ip>\d{1,3}\.\d{1,3}\.\d{1,3}\.\d{1,3})\s{1,})?(?P<domain>(?:(?:[A-Za-z0-9_.-]{2,350}\.[A-Za-z0-9]{2,63})\s+)+)$
-var reDomain = regexp.MustCompile(`^[A-Za-z0-9_.-]{2,350}\.[A-Za-z0-9]{2,63}$`)
-var reRawDomain = regexp.MustCompile(`^(?:(?P<ip>\d{1,3}\.\d{1,3}\.\d{1,3}\.\d{1,3})\s+)?(?P<domains>[A-Za-z0-9_.\s-]{6,})$`)
-var reSpaces = regexp.MustCompile(`^[\t\n\v\f\r ]+|[\t\n\v\f\r ]+$`)
-var reNewlines = regexp.MustCompile(`[\n\r]+`)
-
-// Host represents an item to look up
-type Host struct {
-	Name string
-	Want string
-}
-
-type DNSAnswer struct {
-	Query        string
-	Want         string
-	Raw          []string
-	Answers      []string
-	ResponseTime string
-	Error        string
-	RType        string
-	IsMatch      bool
-}
+// The lookup engine lives in the lookup package, so it can be used outside
+// of dnscheck. These are the names used for its types throughout the app.
+type (
+	Host      = lookup.Host
+	DNSAnswer = lookup.Answer
+	Answer    = lookup.Answers
+)
 
-func (a *DNSAnswer) String() string {
-	return strings.Join(a.Answers, ", ")
-}
+// scheduler is the process-wide query scheduler, shared by every scan.
+var scheduler *lookup.Scheduler
 
 type DNSResults struct {
-	Request  Request
-	Records  Answer
-	RType    string
-	ScanTime string
+	Request   Request
+	Records   Answer
+	RType     string
+	ScanTime  string
+	Fanout    bool
+	Resolvers map[string]*ResolverInfo
+	// APIKey is the id of the api key the scan was submitted with, if any.
+	APIKey string
+	// Created is when the results were saved, and Expires is when they will
+	// be removed (zero if never). Pinned results never expire.
+	Created time.Time
+	Expires time.Time
+	Pinned  bool
 }
 
 type DNSStats struct {
@@ -104,6 +93,87 @@ func (res *DNSResults) IPInfo() (map[string]*IPResult, error) {
 	return out, nil
 }
 
+// GeoAnswer is an answer received for a query by resolvers in a region.
+type GeoAnswer struct {
+	Query     string
+	Continent string
+	Answer    string
+	Resolvers []string
+}
+
+// GeoAnswers groups the answers for each query by the continent of the
+// resolver which received them.
+func (res *DNSResults) GeoAnswers() (out []*GeoAnswer) {
+	index := make(map[string]*GeoAnswer)
+
+	for _, rec := range res.Records {
+		info, ok := res.Resolvers[rec.Resolver]
+		if !ok {
+			continue
+		}
+
+		answer := rec.String()
+		if rec.Error != "" {
+			answer = "error: " + rec.Error
+		}
+
+		key := rec.Query + "|" + info.Continent + "|" + answer
+		if _, ok := index[key]; !ok {
+			index[key] = &GeoAnswer{Query: rec.Query, Continent: info.Continent, Answer: answer}
+			out = append(out, index[key])
+		}
+
+		index[key].Resolvers = append(index[key].Resolvers, rec.Resolver)
+	}
+
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Query != out[j].Query {
+			return out[i].Query < out[j].Query
+		}
+
+		if out[i].Continent != out[j].Continent {
+			return out[i].Continent < out[j].Continent
+		}
+
+		return out[i].Answer < out[j].Answer
+	})
+
+	return out
+}
+
+// MapPoint is a single resolver answer, plotted on the results map.
+type MapPoint struct {
+	Query    string
+	Resolver string
+	Country  string
+	Lat      float64
+	Long     float64
+	Answer   string
+	Error    string
+}
+
+// MapPoints returns every answer which was received by a geolocated resolver.
+func (res *DNSResults) MapPoints() (out []*MapPoint) {
+	for _, rec := range res.Records {
+		info, ok := res.Resolvers[rec.Resolver]
+		if !ok {
+			continue
+		}
+
+		out = append(out, &MapPoint{
+			Query:    rec.Query,
+			Resolver: rec.Resolver,
+			Country:  info.Country,
+			Lat:      info.Lat,
+			Long:     info.Long,
+			Answer:   rec.String(),
+			Error:    rec.Error,
+		})
+	}
+
+	return out
+}
+
 type AnsCountAnswer struct {
 	Answer     string
 	Percentage float32
@@ -177,177 +247,46 @@ func (res *DNSResults) Stats() (stats DNSStats, err error) {
 }
 
 type Request []*Host
-type Answer []*DNSAnswer
-
-func (ans Answer) Len() int {
-	return len(ans)
-}
-
-func (ans Answer) Less(i, j int) bool {
-	// if one is erronous, and one is not
-	if ans[i].Error != "" && ans[j].Error == "" {
-		return true
-	} else if ans[i].Error == "" && ans[j].Error != "" {
-		return false
-	}
-
-	if ans[i].IsMatch == ans[j].IsMatch {
-		return ans[i].Query < ans[j].Query
-	}
-
-	if ans[i].IsMatch {
-		return false
-	}
-
-	return true
-}
-
-func (ans Answer) Swap(i, j int) {
-	ans[i], ans[j] = ans[j], ans[i]
-}
 
-func parseHosts(hosts string) (out []*Host, err error) {
-	input := strings.Split(reNewlines.ReplaceAllString(reSpaces.ReplaceAllString(hosts, ""), "\n"), "\n")
-
-	var knownHosts []string
-
-	for i := 0; i < len(input); i++ {
-		// check if the domain has wildcard records within it, as we are unable to check those
-		if strings.Contains(input[i], "*.") {
-			continue
-		}
-
-		line := reRawDomain.FindStringSubmatch(reSpaces.ReplaceAllString(input[i], ""))
-		if len(line) != 3 {
-			return nil, errors.New("erronous input")
-		}
-
-		for _, domain := range strings.Split(line[2], " ") {
-			if domain == "" {
-				return nil, errors.New("erronous input")
-			}
-
-			domain = strings.Trim(domain, " ")
-			if !reDomain.MatchString(domain) {
-				return nil, errors.New("erronous input")
-			}
-
-			ip, host := line[1], domain
-
-			if host == "" {
-				return nil, errors.New("erronous input")
-			}
-
-			// verify it's not already within the list
-			var alreadyExists bool
-			for k := 0; k < len(knownHosts); k++ {
-				if knownHosts[k] == host {
-					alreadyExists = true
-					break
-				}
-			}
-			if alreadyExists {
-				continue // skip it
-			}
-
-			// track this host to prevent duplicate checks
-			knownHosts = append(knownHosts, host)
-
-			out = append(out, &Host{Name: host, Want: ip})
-		}
-	}
-
-	return out, nil
-}
-
-func fmtTime(t time.Duration) string {
-	ms := float32(t.Nanoseconds()) / 1000000.0
-
-	return fmt.Sprintf("%.2fms", ms)
+// LookupAll looks up every host using the resolvers in group. If fanout is
+// true, every host is looked up using every one of the resolvers (rather
+// than any one of them), so the answers each resolver receives can be
+// compared.
+func LookupAll(hosts []*Host, group *ResolverGroup, rtype string, fanout bool) (*DNSResults, error) {
+	return LookupAllLimit(hosts, group, rtype, fanout, conf().Limit)
 }
 
-func LookupAll(hosts []*Host, servers []string, rtype string) (*DNSResults, error) {
-	if len(hosts) > conf.Limit {
-		return nil, errors.New("too many queries to process")
-	}
-
-	if len(servers) == 0 {
-		return nil, errors.New("no resolvers configured")
-	}
-
-	out := &DNSResults{}
-	out.ScanTime = time.Now().Format(time.RFC3339)
-	out.Request = hosts
-	out.RType = rtype
-	var lookupType uint16
-
-	switch rtype {
-	case "A":
-		lookupType = dns.TypeA
-	case "":
-		lookupType = dns.TypeA
-	case "AAAA":
-		lookupType = dns.TypeAAAA
-	case "CNAME":
-		lookupType = dns.TypeCNAME
-	case "MX":
-		lookupType = dns.TypeMX
-	case "NS":
-		lookupType = dns.TypeNS
-	case "TXT":
-		lookupType = dns.TypeTXT
-	default:
-		return nil, errors.New("invalid lookup type")
-	}
-
-	pool := sempool.New(conf.Concurrency)
-	r, err := ldns.New(servers)
+// LookupAllLimit is like LookupAll, but with a custom limit on the number of
+// queries, rather than the configured limit.
+func LookupAllLimit(hosts []*Host, group *ResolverGroup, rtype string, fanout bool, limit int) (*DNSResults, error) {
+	c := conf()
+
+	res, err := lookup.Run(context.Background(), hosts, lookup.Options{
+		Resolvers:   group.lookupGroup(),
+		Type:        rtype,
+		Fanout:      fanout,
+		Limit:       limit,
+		Concurrency: c.Concurrency,
+		Scheduler:   scheduler,
+	})
 	if err != nil {
 		return nil, err
 	}
 
-	for i := 0; i < len(hosts); i++ {
-		pool.Slot()
-
-		go func(host *Host) {
-			defer pool.Free()
-
-			result, err := r.Lookup(host.Name, lookupType)
-			if err != nil {
-				out.Records = append(out.Records, &DNSAnswer{
-					Query: host.Name,
-					Want:  host.Want,
-					RType: rtype,
-					Error: err.Error(),
-				})
-				return
-			}
-
-			ans := &DNSAnswer{
-				Query:        result.Host,
-				Want:         host.Want,
-				RType:        result.QueryType(),
-				ResponseTime: fmtTime(result.RTT),
-			}
-
-			for a := 0; a < len(result.Records); a++ {
-				ans.Answers = append(ans.Answers, result.Records[a].String())
-
-				if !ans.IsMatch && (result.Records[a].String() == ans.Want || len(ans.Want) == 0 || lookupType != dns.TypeA) {
-					// TODO: currently, only A records are comparable. in the future, this should support anything,
-					// though it would require the user entering this to compare.
-					// TODO: this should be opt-out'able. meaning in the frontend, any returned record is successful.
-					ans.IsMatch = true
-				}
-			}
-
-			out.Records = append(out.Records, ans)
-		}(hosts[i])
+	out := &DNSResults{
+		Request:   res.Hosts,
+		Records:   res.Answers,
+		RType:     rtype,
+		ScanTime:  res.Time.Format(time.RFC3339),
+		Fanout:    fanout,
+		Resolvers: make(map[string]*ResolverInfo),
 	}
 
-	pool.Wait()
-
-	sort.Sort(out.Records)
+	for _, server := range group.Servers {
+		if info, ok := c.ResolverInfo[server]; ok {
+			out.Resolvers[server] = info
+		}
+	}
 
 	return out, nil
 }
@@ -0,0 +1,632 @@
+package main
+
+import (
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lrstanley/dnscheck/lookup"
+)
+
+// Finding severities, from least to most severe.
+const (
+	SeverityOK      = lookup.SeverityOK
+	SeverityInfo    = lookup.SeverityInfo
+	SeverityWarning = lookup.SeverityWarning
+	SeverityError   = lookup.SeverityError
+)
+
+var severityRank = lookup.SeverityRank
+
+// Finding is a single problem (or note) found while auditing a record.
+type Finding = lookup.Finding
+
+// EmailCheck is the result of auditing a single email authentication record
+// type for a domain.
+type EmailCheck struct {
+	Name     string
+	Query    string
+	Records  []string
+	Findings []*Finding
+	Error    string
+}
+
+// add adds a new finding to the check.
+func (c *EmailCheck) add(severity, format string, args ...interface{}) {
+	c.Findings = append(c.Findings, &Finding{Severity: severity, Message: fmt.Sprintf(format, args...)})
+}
+
+// Grade returns the most severe finding of the check.
+func (c *EmailCheck) Grade() string {
+	grade := SeverityOK
+
+	if c.Error != "" {
+		grade = SeverityError
+	}
+
+	for _, f := range c.Findings {
+		if severityRank[f.Severity] > severityRank[grade] {
+			grade = f.Severity
+		}
+	}
+
+	return grade
+}
+
+// EmailDomain contains all email authentication checks for a domain.
+type EmailDomain struct {
+	Domain string
+	Checks []*EmailCheck
+	SPF    *SPFResult
+}
+
+// Grade returns the most severe grade of all checks for the domain.
+func (d *EmailDomain) Grade() string {
+	grade := SeverityOK
+
+	for _, c := range d.Checks {
+		if g := c.Grade(); severityRank[g] > severityRank[grade] {
+			grade = g
+		}
+	}
+
+	return grade
+}
+
+// EmailAudit is the result of an email authentication audit.
+type EmailAudit struct {
+	Domains   []*EmailDomain
+	Selectors []string
+	ScanTime  string
+	Expiry
+}
+
+var reDKIMSelector = regexp.MustCompile(`^[A-Za-z0-9_-]+(?:\.[A-Za-z0-9_-]+)*$`)
+var reSTSID = regexp.MustCompile(`^[A-Za-z0-9]{1,32}$`)
+
+// parseSelectors parses a comma or whitespace separated list of DKIM
+// selectors.
+func parseSelectors(input string) (out []string, err error) {
+	known := make(map[string]bool)
+
+	for _, sel := range strings.FieldsFunc(input, func(r rune) bool { return r == ',' || r == ' ' || r == '\n' || r == '\r' || r == '\t' }) {
+		if !reDKIMSelector.MatchString(sel) {
+			return nil, fmt.Errorf("invalid dkim selector: %q", sel)
+		}
+
+		if !known[sel] {
+			known[sel] = true
+			out = append(out, sel)
+		}
+	}
+
+	return out, nil
+}
+
+// parseTags parses a "tag=value; tag=value" style record (as used by DMARC,
+// DKIM, MTA-STS, TLS-RPT and BIMI), returning the tags in the order they
+// were found.
+func parseTags(record string) (tags map[string]string, order []string, err error) {
+	tags = make(map[string]string)
+
+	for _, part := range strings.Split(record, ";") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+
+		kv := strings.SplitN(part, "=", 2)
+		if len(kv) != 2 {
+			return nil, nil, fmt.Errorf("malformed tag %q", part)
+		}
+
+		key := strings.ToLower(strings.TrimSpace(kv[0]))
+		if _, ok := tags[key]; ok {
+			return nil, nil, fmt.Errorf("duplicate tag %q", key)
+		}
+
+		tags[key] = strings.TrimSpace(kv[1])
+		order = append(order, key)
+	}
+
+	return tags, order, nil
+}
+
+// versioned returns the records which start with the version tag prefix
+// (e.g. "v=DMARC1").
+func versioned(records []string, prefix string) (out []string) {
+	for _, rec := range records {
+		rec = strings.TrimSpace(rec)
+		if len(rec) < len(prefix) || !strings.EqualFold(rec[:len(prefix)], prefix) {
+			continue
+		}
+
+		// the version must be followed by the end of the record, or a separator.
+		if rest := rec[len(prefix):]; rest != "" && rest[0] != ';' && rest[0] != ' ' {
+			continue
+		}
+
+		out = append(out, rec)
+	}
+
+	return out
+}
+
+// checkSPF audits the SPF record of a domain (RFC 7208).
+func checkSPF(c *EmailCheck, records []string) {
+	spf := versioned(records, "v=spf1")
+	c.Records = spf
+
+	if len(spf) == 0 {
+		c.add(SeverityWarning, "no SPF record found")
+		return
+	}
+
+	if len(spf) > 1 {
+		c.add(SeverityError, "multiple SPF records found (%d), which results in a permerror (RFC 7208 4.5)", len(spf))
+		return
+	}
+
+	var all, redirect string
+	var afterAll bool
+
+	for _, term := range strings.Fields(spf[0])[1:] {
+		if all != "" && !afterAll {
+			afterAll = true
+			c.add(SeverityWarning, "terms after %q are ignored", all)
+		}
+
+		// modifiers
+		if kv := strings.SplitN(term, "=", 2); len(kv) == 2 && !strings.ContainsAny(kv[0], ":/") {
+			switch strings.ToLower(kv[0]) {
+			case "redirect":
+				redirect = kv[1]
+			case "exp":
+			default:
+				c.add(SeverityInfo, "unknown modifier %q", kv[0])
+			}
+
+			if kv[1] == "" {
+				c.add(SeverityError, "modifier %q has no value", kv[0])
+			}
+			continue
+		}
+
+		mech := strings.TrimLeft(term, "+-~?")
+		if len(term)-len(mech) > 1 {
+			c.add(SeverityError, "mechanism %q has more than one qualifier", term)
+			continue
+		}
+
+		name, value := mech, ""
+		if i := strings.IndexAny(mech, ":/"); i >= 0 {
+			name, value = mech[:i], mech[i:]
+		}
+
+		switch strings.ToLower(name) {
+		case "all":
+			all = term
+			if value != "" {
+				c.add(SeverityError, "%q does not take a value", term)
+			}
+		case "include", "exists":
+			if !strings.HasPrefix(value, ":") || len(value) < 2 {
+				c.add(SeverityError, "%q requires a domain", term)
+			}
+		case "a", "mx":
+		case "ptr":
+			c.add(SeverityWarning, "the ptr mechanism is deprecated and should not be used (RFC 7208 5.5)")
+		case "ip4", "ip6":
+			addr := strings.TrimPrefix(value, ":")
+			if !strings.HasPrefix(value, ":") || addr == "" {
+				c.add(SeverityError, "%q requires an address", term)
+				continue
+			}
+
+			ip := net.ParseIP(addr)
+			if strings.Contains(addr, "/") {
+				var err error
+				ip, _, err = net.ParseCIDR(addr)
+				if err != nil {
+					ip = nil
+				}
+			}
+
+			if ip == nil || (strings.EqualFold(name, "ip4") != (ip.To4() != nil)) {
+				c.add(SeverityError, "%q is not a valid %s address or range", term, strings.ToLower(name))
+			}
+		default:
+			c.add(SeverityError, "unknown mechanism %q", term)
+		}
+	}
+
+	switch {
+	case all == "" && redirect == "":
+		c.add(SeverityWarning, "no \"all\" mechanism or redirect, so the default result is neutral")
+	case all != "" && redirect != "":
+		c.add(SeverityInfo, "redirect is ignored, as an \"all\" mechanism is present")
+	case all == "+all" || all == "all":
+		c.add(SeverityError, "%q allows anyone to send mail for the domain", all)
+	case all == "?all":
+		c.add(SeverityWarning, "\"?all\" is neutral, and provides no protection")
+	}
+}
+
+// dmarcPolicy returns the DMARC policy of the audited domain, or an empty
+// string if there isn't a valid one.
+func dmarcPolicy(d *EmailDomain) string {
+	for _, c := range d.Checks {
+		if c.Name != "DMARC" || len(c.Records) != 1 {
+			continue
+		}
+
+		if tags, _, err := parseTags(c.Records[0]); err == nil {
+			return strings.ToLower(tags["p"])
+		}
+	}
+
+	return ""
+}
+
+// checkReportURIs validates a comma separated list of DMARC/TLS-RPT report
+// URIs, which must use one of schemes.
+func checkReportURIs(c *EmailCheck, tag, value string, schemes ...string) {
+	for _, uri := range strings.Split(value, ",") {
+		uri = strings.TrimSpace(uri)
+
+		var valid bool
+		for _, scheme := range schemes {
+			if strings.HasPrefix(strings.ToLower(uri), scheme) && len(uri) > len(scheme) {
+				valid = true
+			}
+		}
+
+		if !valid {
+			c.add(SeverityError, "%s: %q is not a valid %s uri", tag, uri, strings.Join(schemes, " or "))
+		}
+	}
+}
+
+// checkDMARC audits the DMARC record of a domain (RFC 7489).
+func checkDMARC(c *EmailCheck, records []string) {
+	dmarc := versioned(records, "v=DMARC1")
+	c.Records = dmarc
+
+	if len(dmarc) == 0 {
+		c.add(SeverityError, "no DMARC record found")
+		return
+	}
+
+	if len(dmarc) > 1 {
+		c.add(SeverityError, "multiple DMARC records found (%d), so all are ignored (RFC 7489 6.6.3)", len(dmarc))
+		return
+	}
+
+	tags, order, err := parseTags(dmarc[0])
+	if err != nil {
+		c.add(SeverityError, "syntax error: %s", err)
+		return
+	}
+
+	if order[0] != "v" {
+		c.add(SeverityError, "the v tag must be first")
+	}
+
+	switch p := strings.ToLower(tags["p"]); p {
+	case "":
+		c.add(SeverityError, "missing required p (policy) tag")
+	case "none":
+		c.add(SeverityWarning, "p=none only monitors, and does not protect the domain")
+	case "quarantine", "reject":
+	default:
+		c.add(SeverityError, "invalid policy p=%s", p)
+	}
+
+	if sp, ok := tags["sp"]; ok {
+		switch strings.ToLower(sp) {
+		case "none", "quarantine", "reject":
+		default:
+			c.add(SeverityError, "invalid subdomain policy sp=%s", sp)
+		}
+	}
+
+	if rua, ok := tags["rua"]; !ok || rua == "" {
+		c.add(SeverityWarning, "no rua (aggregate report) address, so no reports will be received")
+	} else {
+		checkReportURIs(c, "rua", rua, "mailto:")
+	}
+
+	if ruf, ok := tags["ruf"]; ok {
+		checkReportURIs(c, "ruf", ruf, "mailto:")
+	}
+
+	if pct, ok := tags["pct"]; ok {
+		if n, err := strconv.Atoi(pct); err != nil || n < 0 || n > 100 {
+			c.add(SeverityError, "pct must be between 0 and 100 (got %q)", pct)
+		} else if n < 100 {
+			c.add(SeverityInfo, "pct=%d only applies the policy to some mail", n)
+		}
+	}
+
+	for _, tag := range []string{"adkim", "aspf"} {
+		if v, ok := tags[tag]; ok && v != "r" && v != "s" {
+			c.add(SeverityError, "%s must be r or s (got %q)", tag, v)
+		}
+	}
+
+	if ri, ok := tags["ri"]; ok {
+		if _, err := strconv.ParseUint(ri, 10, 32); err != nil {
+			c.add(SeverityError, "ri must be a number of seconds (got %q)", ri)
+		}
+	}
+}
+
+// checkMTASTS audits the MTA-STS policy record of a domain (RFC 8461).
+func checkMTASTS(c *EmailCheck, records []string) {
+	sts := versioned(records, "v=STSv1")
+	c.Records = sts
+
+	if len(sts) == 0 {
+		c.add(SeverityInfo, "no MTA-STS record found")
+		return
+	}
+
+	if len(sts) > 1 {
+		c.add(SeverityError, "multiple MTA-STS records found (%d), so MTA-STS is not used (RFC 8461 3.1)", len(sts))
+		return
+	}
+
+	tags, _, err := parseTags(sts[0])
+	if err != nil {
+		c.add(SeverityError, "syntax error: %s", err)
+		return
+	}
+
+	id := tags["id"]
+	if id == "" {
+		c.add(SeverityError, "missing required id tag")
+	} else if !reSTSID.MatchString(id) {
+		c.add(SeverityError, "id must be 1-32 alphanumeric characters (got %q)", id)
+	}
+}
+
+// checkTLSRPT audits the SMTP TLS reporting record of a domain (RFC 8460).
+func checkTLSRPT(c *EmailCheck, records []string) {
+	rpt := versioned(records, "v=TLSRPTv1")
+	c.Records = rpt
+
+	if len(rpt) == 0 {
+		c.add(SeverityInfo, "no TLS-RPT record found")
+		return
+	}
+
+	if len(rpt) > 1 {
+		c.add(SeverityError, "multiple TLS-RPT records found (%d), so reports will not be sent (RFC 8460 3)", len(rpt))
+		return
+	}
+
+	tags, _, err := parseTags(rpt[0])
+	if err != nil {
+		c.add(SeverityError, "syntax error: %s", err)
+		return
+	}
+
+	if rua := tags["rua"]; rua == "" {
+		c.add(SeverityError, "missing required rua tag")
+	} else {
+		checkReportURIs(c, "rua", rua, "mailto:", "https://")
+	}
+}
+
+// checkBIMI audits the default BIMI record of a domain.
+func checkBIMI(c *EmailCheck, records []string, policy string) {
+	bimi := versioned(records, "v=BIMI1")
+	c.Records = bimi
+
+	if len(bimi) == 0 {
+		c.add(SeverityInfo, "no BIMI record found")
+		return
+	}
+
+	if len(bimi) > 1 {
+		c.add(SeverityError, "multiple BIMI records found (%d)", len(bimi))
+		return
+	}
+
+	tags, _, err := parseTags(bimi[0])
+	if err != nil {
+		c.add(SeverityError, "syntax error: %s", err)
+		return
+	}
+
+	if l := tags["l"]; l != "" && !strings.HasPrefix(strings.ToLower(l), "https://") {
+		c.add(SeverityError, "l (logo) must be an https url (got %q)", l)
+	} else if l != "" && !strings.HasSuffix(strings.ToLower(l), ".svg") {
+		c.add(SeverityWarning, "l (logo) should be an SVG image")
+	}
+
+	if a := tags["a"]; a != "" && !strings.HasPrefix(strings.ToLower(a), "https://") {
+		c.add(SeverityError, "a (authority evidence) must be an https url (got %q)", a)
+	}
+
+	if policy != "quarantine" && policy != "reject" {
+		c.add(SeverityWarning, "BIMI requires an enforced DMARC policy (p=quarantine or p=reject)")
+	}
+}
+
+// checkDKIM audits a DKIM key record (RFC 6376).
+func checkDKIM(c *EmailCheck, records []string) {
+	var keys []string
+	for _, rec := range records {
+		if tags, _, err := parseTags(rec); err == nil {
+			if _, ok := tags["p"]; ok {
+				keys = append(keys, rec)
+			}
+		}
+	}
+	c.Records = keys
+
+	if len(keys) == 0 {
+		c.add(SeverityWarning, "no DKIM key found for this selector")
+		return
+	}
+
+	if len(keys) > 1 {
+		c.add(SeverityError, "multiple DKIM keys found (%d) for this selector", len(keys))
+		return
+	}
+
+	tags, order, _ := parseTags(keys[0])
+
+	if v, ok := tags["v"]; ok {
+		if order[0] != "v" {
+			c.add(SeverityError, "the v tag must be first")
+		}
+		if v != "DKIM1" {
+			c.add(SeverityError, "invalid version v=%s", v)
+		}
+	}
+
+	k := strings.ToLower(tags["k"])
+	switch k {
+	case "", "rsa", "ed25519":
+	default:
+		c.add(SeverityError, "unknown key type k=%s", k)
+	}
+
+	if tags["p"] == "" {
+		c.add(SeverityWarning, "the key has been revoked (empty p tag)")
+		return
+	}
+
+	raw, err := base64.StdEncoding.DecodeString(strings.Join(strings.Fields(tags["p"]), ""))
+	if err != nil {
+		c.add(SeverityError, "the public key is not valid base64")
+		return
+	}
+
+	if k == "ed25519" {
+		if len(raw) != 32 {
+			c.add(SeverityError, "ed25519 keys must be 32 bytes (got %d)", len(raw))
+		}
+		return
+	}
+
+	pub, err := x509.ParsePKIXPublicKey(raw)
+	if err != nil {
+		c.add(SeverityError, "unable to parse the public key: %s", err)
+		return
+	}
+
+	key, ok := pub.(*rsa.PublicKey)
+	if !ok {
+		c.add(SeverityError, "the public key is not an rsa key")
+		return
+	}
+
+	switch bits := key.N.BitLen(); {
+	case bits < 1024:
+		c.add(SeverityError, "%d bit rsa keys are insecure, and ignored by most receivers", bits)
+	case bits < 2048:
+		c.add(SeverityWarning, "%d bit rsa keys are weak, 2048 bits is recommended", bits)
+	}
+}
+
+// emailQueries returns the record name queried for each check of domain.
+func emailQueries(domain string, selectors []string) (names []string, checks []string) {
+	names = []string{domain, "_dmarc." + domain, "_mta-sts." + domain, "_smtp._tls." + domain, "default._bimi." + domain}
+	checks = []string{"SPF", "DMARC", "MTA-STS", "TLS-RPT", "BIMI"}
+
+	for _, sel := range selectors {
+		names = append(names, sel+"._domainkey."+domain)
+		checks = append(checks, "DKIM ("+sel+")")
+	}
+
+	return names, checks
+}
+
+// AuditEmail audits the email authentication records (SPF, DMARC, MTA-STS,
+// TLS-RPT, BIMI and DKIM for each of selectors) of every domain, using the
+// resolvers in group.
+func AuditEmail(domains []*Host, selectors []string, group *ResolverGroup) (*EmailAudit, error) {
+	if len(domains) == 0 {
+		return nil, errors.New("no domains to audit")
+	}
+
+	metricScans.Inc("email")
+
+	var hosts []*Host
+	for _, domain := range domains {
+		names, _ := emailQueries(domain.Name, selectors)
+
+		for _, name := range names {
+			hosts = append(hosts, &Host{Name: name})
+		}
+	}
+
+	results, err := LookupAll(hosts, group, "TXT", false)
+	if err != nil {
+		return nil, err
+	}
+
+	answers := make(map[string]*DNSAnswer)
+	for _, rec := range results.Records {
+		answers[strings.ToLower(rec.Query)] = rec
+	}
+
+	out := &EmailAudit{Selectors: selectors, ScanTime: time.Now().Format(time.RFC3339)}
+
+	for _, domain := range domains {
+		names, checks := emailQueries(domain.Name, selectors)
+		res := &EmailDomain{Domain: domain.Name}
+
+		for i, name := range names {
+			check := &EmailCheck{Name: checks[i], Query: name}
+			res.Checks = append(res.Checks, check)
+
+			ans := answers[strings.ToLower(name)]
+			if ans == nil {
+				check.Error = "no response"
+				continue
+			}
+
+			// a missing record (NXDOMAIN) is graded by the check itself.
+			if ans.Error != "" && !strings.HasSuffix(ans.Error, "NXDOMAIN") {
+				check.Error = ans.Error
+				continue
+			}
+
+			switch check.Name {
+			case "SPF":
+				checkSPF(check, ans.Answers)
+
+				// expand the record, to check it against the lookup limits.
+				if len(check.Records) == 1 {
+					res.SPF = EvaluateSPF(domain.Name, group)
+					check.Findings = append(check.Findings, res.SPF.Findings...)
+				}
+			case "DMARC":
+				checkDMARC(check, ans.Answers)
+			case "MTA-STS":
+				checkMTASTS(check, ans.Answers)
+			case "TLS-RPT":
+				checkTLSRPT(check, ans.Answers)
+			case "BIMI":
+				checkBIMI(check, ans.Answers, dmarcPolicy(res))
+			default:
+				checkDKIM(check, ans.Answers)
+			}
+		}
+
+		out.Domains = append(out.Domains, res)
+	}
+
+	return out, nil
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseTags(t *testing.T) {
+	tests := []struct {
+		in      string
+		tags    map[string]string
+		order   []string
+		wantErr bool
+	}{
+		{"v=DMARC1; p=reject", map[string]string{"v": "DMARC1", "p": "reject"}, []string{"v", "p"}, false},
+		{" v = DMARC1 ;P=none; ", map[string]string{"v": "DMARC1", "p": "none"}, []string{"v", "p"}, false},
+		{"v=DKIM1; p=", map[string]string{"v": "DKIM1", "p": ""}, []string{"v", "p"}, false},
+		{"rua=mailto:a@example.com,mailto:b=c@example.com", map[string]string{"rua": "mailto:a@example.com,mailto:b=c@example.com"}, []string{"rua"}, false},
+		{"", map[string]string{}, nil, false},
+		{"v=DMARC1; p", nil, nil, true},
+		{"v=DMARC1; p=none; P=reject", nil, nil, true},
+	}
+
+	for _, tt := range tests {
+		tags, order, err := parseTags(tt.in)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseTags(%q) error = %v, want error: %v", tt.in, err, tt.wantErr)
+			continue
+		}
+
+		if !reflect.DeepEqual(tags, tt.tags) || !reflect.DeepEqual(order, tt.order) {
+			t.Errorf("parseTags(%q) = %v, %v, want %v, %v", tt.in, tags, order, tt.tags, tt.order)
+		}
+	}
+}
+
+// checkTest is a single record check, which should be graded grade, with a
+// finding containing finding (unless it's empty).
+type checkTest struct {
+	records []string
+	grade   string
+	finding string
+}
+
+func runCheckTests(t *testing.T, name string, check func(c *EmailCheck, records []string), tests []checkTest) {
+	for _, tt := range tests {
+		c := &EmailCheck{}
+		check(c, tt.records)
+
+		var messages []string
+		for _, f := range c.Findings {
+			messages = append(messages, f.Severity+": "+f.Message)
+		}
+
+		if c.Grade() != tt.grade {
+			t.Errorf("%s(%q) graded %s, want %s (%q)", name, tt.records, c.Grade(), tt.grade, messages)
+		}
+
+		if tt.finding != "" && !strings.Contains(strings.Join(messages, "\n"), tt.finding) {
+			t.Errorf("%s(%q) findings = %q, want one containing %q", name, tt.records, messages, tt.finding)
+		}
+	}
+}
+
+func TestCheckSPF(t *testing.T) {
+	runCheckTests(t, "checkSPF", checkSPF, []checkTest{
+		{[]string{"v=spf1 ip4:192.0.2.0/24 include:_spf.example.com -all"}, SeverityOK, ""},
+		{[]string{"google-site-verification=abc", "v=spf1 mx ~all"}, SeverityOK, ""},
+		{[]string{"v=spf1 redirect=_spf.example.com"}, SeverityOK, ""},
+		{nil, SeverityWarning, "no SPF record found"},
+		{[]string{"v=spf10 -all"}, SeverityWarning, "no SPF record found"},
+		{[]string{"v=spf1 -all", "v=spf1 ~all"}, SeverityError, "multiple SPF records"},
+		{[]string{"v=spf1 +all"}, SeverityError, "allows anyone"},
+		{[]string{"v=spf1 mx ?all"}, SeverityWarning, "neutral"},
+		{[]string{"v=spf1 mx"}, SeverityWarning, "no \"all\" mechanism"},
+		{[]string{"v=spf1 -all mx"}, SeverityWarning, "are ignored"},
+		{[]string{"v=spf1 ptr -all"}, SeverityWarning, "deprecated"},
+		{[]string{"v=spf1 ip4:2001:db8::1 -all"}, SeverityError, "not a valid ip4"},
+		{[]string{"v=spf1 ip6:2001:db8::/32 ip4:192.0.2.300 -all"}, SeverityError, "not a valid ip4"},
+		{[]string{"v=spf1 include -all"}, SeverityError, "requires a domain"},
+		{[]string{"v=spf1 -~all"}, SeverityError, "more than one qualifier"},
+		{[]string{"v=spf1 foo:bar -all"}, SeverityError, "unknown mechanism"},
+		{[]string{"v=spf1 redirect= -all"}, SeverityError, "has no value"},
+		{[]string{"v=spf1 mx -all redirect=_spf.example.com"}, SeverityWarning, "are ignored"},
+	})
+}
+
+func TestCheckDMARC(t *testing.T) {
+	runCheckTests(t, "checkDMARC", checkDMARC, []checkTest{
+		{[]string{"v=DMARC1; p=reject; rua=mailto:dmarc@example.com"}, SeverityOK, ""},
+		{[]string{"v=DMARC1; p=quarantine; rua=mailto:dmarc@example.com; pct=100; adkim=s; aspf=r"}, SeverityOK, ""},
+		{nil, SeverityError, "no DMARC record found"},
+		{[]string{"v=DMARC1; p=reject", "v=DMARC1; p=none"}, SeverityError, "multiple DMARC records"},
+		{[]string{"v=DMARC1; p=none; rua=mailto:dmarc@example.com"}, SeverityWarning, "only monitors"},
+		{[]string{"v=DMARC1; p=reject"}, SeverityWarning, "no rua"},
+		{[]string{"v=DMARC1; rua=mailto:dmarc@example.com"}, SeverityError, "missing required p"},
+		{[]string{"v=DMARC1; p=block; rua=mailto:dmarc@example.com"}, SeverityError, "invalid policy"},
+		{[]string{"v=DMARC1; p=reject; sp=block; rua=mailto:dmarc@example.com"}, SeverityError, "invalid subdomain policy"},
+		{[]string{"v=DMARC1; p=reject; rua=https://example.com"}, SeverityError, "not a valid mailto: uri"},
+		{[]string{"v=DMARC1; p=reject; rua=mailto:dmarc@example.com; pct=50"}, SeverityInfo, "only applies the policy to some"},
+		{[]string{"v=DMARC1; p=reject; rua=mailto:dmarc@example.com; pct=101"}, SeverityError, "pct must be"},
+		{[]string{"v=DMARC1; p=reject; rua=mailto:dmarc@example.com; adkim=x"}, SeverityError, "adkim must be"},
+		{[]string{"v=DMARC1; p=reject; rua=mailto:dmarc@example.com; ri=soon"}, SeverityError, "ri must be"},
+		{[]string{"v=DMARC1; p=reject; p=none"}, SeverityError, "syntax error"},
+	})
+}
+
+func TestCheckDKIM(t *testing.T) {
+	rsaKey := func(bits int) string {
+		key, err := rsa.GenerateKey(rand.Reader, bits)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		raw, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return base64.StdEncoding.EncodeToString(raw)
+	}
+
+	strong, weak := rsaKey(2048), rsaKey(1024)
+	ed25519 := base64.StdEncoding.EncodeToString(make([]byte, 32))
+
+	runCheckTests(t, "checkDKIM", checkDKIM, []checkTest{
+		{[]string{"v=DKIM1; k=rsa; p=" + strong}, SeverityOK, ""},
+		{[]string{"k=rsa; p=" + strong[:100] + " " + strong[100:]}, SeverityOK, ""},
+		{[]string{"v=DKIM1; k=ed25519; p=" + ed25519}, SeverityOK, ""},
+		{[]string{"v=DKIM1; k=rsa; p=" + weak}, SeverityWarning, "1024 bit rsa keys are weak"},
+		{nil, SeverityWarning, "no DKIM key found"},
+		{[]string{"v=spf1 -all"}, SeverityWarning, "no DKIM key found"},
+		{[]string{"v=DKIM1; p=" + strong, "v=DKIM1; p=" + strong}, SeverityError, "multiple DKIM keys"},
+		{[]string{"v=DKIM1; p="}, SeverityWarning, "revoked"},
+		{[]string{"k=rsa; v=DKIM1; p=" + strong}, SeverityError, "the v tag must be first"},
+		{[]string{"v=DKIM2; p=" + strong}, SeverityError, "invalid version"},
+		{[]string{"v=DKIM1; k=dsa; p=" + strong}, SeverityError, "unknown key type"},
+		{[]string{"v=DKIM1; p=not*base64"}, SeverityError, "not valid base64"},
+		{[]string{"v=DKIM1; p=" + base64.StdEncoding.EncodeToString([]byte("not a key"))}, SeverityError, "unable to parse"},
+		{[]string{"v=DKIM1; k=ed25519; p=" + base64.StdEncoding.EncodeToString(make([]byte, 31))}, SeverityError, "must be 32 bytes"},
+	})
+}
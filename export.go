@@ -0,0 +1,146 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"text/tabwriter"
+)
+
+// exportColumns are the columns of every export format, in order. They
+// should only ever be appended to, so existing consumers don't break.
+var exportColumns = []string{"host", "type", "expected", "answers", "match", "error", "rtt", "resolver", "geo"}
+
+// exportTypes maps each export format to its content type.
+var exportTypes = map[string]string{
+	"csv":    "text/csv; charset=utf-8",
+	"ndjson": "application/x-ndjson; charset=utf-8",
+	"md":     "text/markdown; charset=utf-8",
+	"txt":    "text/plain; charset=utf-8",
+}
+
+// ExportRow is a single answer, as exported.
+type ExportRow struct {
+	Host     string   `json:"host"`
+	Type     string   `json:"type"`
+	Expected string   `json:"expected"`
+	Answers  []string `json:"answers"`
+	Match    string   `json:"match"`
+	Error    string   `json:"error"`
+	RTT      string   `json:"rtt"`
+	Resolver string   `json:"resolver"`
+	Geo      []string `json:"geo"`
+}
+
+// Values returns the row as strings, in the order of exportColumns.
+func (r *ExportRow) Values() []string {
+	return []string{
+		r.Host, r.Type, r.Expected, strings.Join(r.Answers, " "), r.Match,
+		r.Error, r.RTT, r.Resolver, strings.Join(r.Geo, " "),
+	}
+}
+
+// exportRows converts the results into rows. geo contains the country code
+// of each answer which could be geolocated.
+func exportRows(res *DNSResults) []*ExportRow {
+	ipinfo, _ := res.IPInfo()
+
+	rows := make([]*ExportRow, len(res.Records))
+	for i, rec := range res.Records {
+		row := &ExportRow{
+			Host:     rec.Query,
+			Type:     rec.RType,
+			Expected: rec.Want,
+			Answers:  rec.Answers,
+			Match:    hostState(rec),
+			Error:    rec.Error,
+			RTT:      rec.ResponseTime,
+			Resolver: rec.Resolver,
+		}
+
+		if row.Answers == nil {
+			row.Answers = []string{}
+		}
+
+		row.Geo = []string{}
+		for _, ans := range rec.Answers {
+			if info, ok := ipinfo[ans]; ok && info.CountryCode != "" {
+				row.Geo = append(row.Geo, info.CountryCode)
+			}
+		}
+
+		rows[i] = row
+	}
+
+	return rows
+}
+
+// escapeMarkdown escapes a markdown table cell.
+func escapeMarkdown(cell string) string {
+	return strings.NewReplacer("|", `\|`, "\n", " ", "\r", "").Replace(cell)
+}
+
+// ExportResults encodes the results in format (one of exportTypes).
+func ExportResults(res *DNSResults, format string) ([]byte, error) {
+	if _, ok := exportTypes[format]; !ok {
+		return nil, errors.New("unsupported export format")
+	}
+
+	rows := exportRows(res)
+	buf := new(bytes.Buffer)
+
+	switch format {
+	case "csv":
+		w := csv.NewWriter(buf)
+		w.Write(exportColumns)
+		for _, row := range rows {
+			w.Write(row.Values())
+		}
+		w.Flush()
+
+		return buf.Bytes(), w.Error()
+	case "ndjson":
+		enc := json.NewEncoder(buf)
+		for _, row := range rows {
+			if err := enc.Encode(row); err != nil {
+				return nil, err
+			}
+		}
+	case "md":
+		fmt.Fprintf(buf, "| %s |\n", strings.Join(exportColumns, " | "))
+		fmt.Fprintf(buf, "|%s\n", strings.Repeat(" --- |", len(exportColumns)))
+
+		for _, row := range rows {
+			values := row.Values()
+			for i := range values {
+				values[i] = escapeMarkdown(values[i])
+			}
+
+			fmt.Fprintf(buf, "| %s |\n", strings.Join(values, " | "))
+		}
+	case "txt":
+		w := tabwriter.NewWriter(buf, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, strings.ToUpper(strings.Join(exportColumns, "\t")))
+
+		for _, row := range rows {
+			values := row.Values()
+			for i := range values {
+				values[i] = strings.Replace(values[i], "\t", " ", -1)
+				if values[i] == "" {
+					values[i] = "-"
+				}
+			}
+
+			fmt.Fprintln(w, strings.Join(values, "\t"))
+		}
+
+		if err := w.Flush(); err != nil {
+			return nil, err
+		}
+	}
+
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"net"
+	"time"
+
+	"github.com/lrstanley/dnscheck/lookup"
+	"github.com/miekg/dns"
+)
+
+// recursionProbes are unrelated names used to check if an authoritative
+// nameserver will also recurse for anyone. The second is used if the domain
+// being checked is the first.
+var recursionProbes = []string{"example.com", "example.net"}
+
+// zoneTransfer attempts a zone transfer of domain from the nameserver at ip,
+// returning the number of records within the first message which had any.
+// msg should be an AXFR or IXFR request. The transfer is stopped once records
+// are received, as the rest of the zone isn't needed.
+func zoneTransfer(group *ResolverGroup, budget *lookup.Budget, ip string, msg *dns.Msg) (int, error) {
+	timeout := lookup.DefaultTimeout
+	if group.Timeout > 0 {
+		timeout = time.Duration(group.Timeout)
+	}
+
+	t := &dns.Transfer{DialTimeout: timeout, ReadTimeout: timeout, WriteTimeout: timeout}
+
+	_, release := budget.Acquire([]string{ip})
+	defer release()
+
+	env, err := t.In(msg, net.JoinHostPort(ip, "53"))
+	if err != nil {
+		return 0, err
+	}
+
+	var records int
+	for e := range env {
+		if e.Error != nil {
+			if records == 0 {
+				err = e.Error
+			}
+			continue
+		}
+
+		if records == 0 && len(e.RR) > 0 {
+			records = len(e.RR)
+
+			// closing the connection ends the transfer. The channel must
+			// still be drained, so the reading goroutine can exit.
+			t.Close()
+		}
+	}
+
+	return records, err
+}
+
+// checkExposure checks if a nameserver allows anyone to transfer domain
+// (AXFR/IXFR), or will recurse for names it isn't authoritative for (an
+// open resolver). It's only used when exposure_checks is enabled, as the
+// probes may be seen as hostile by the operator of the nameserver.
+func checkExposure(group *ResolverGroup, budget *lookup.Budget, domain string, ns *NameserverResult) {
+	ip := ns.addr
+
+	axfr := new(dns.Msg)
+	axfr.SetAxfr(dns.Fqdn(domain))
+	if n, err := zoneTransfer(group, budget, ip, axfr); err == nil && n > 0 {
+		ns.AXFR = n
+	}
+
+	// an IXFR from serial 0 should fall back to a full transfer. A refusing
+	// server either errors, or only returns its current SOA.
+	ixfr := new(dns.Msg)
+	ixfr.SetIxfr(dns.Fqdn(domain), 0, "", "")
+	if n, err := zoneTransfer(group, budget, ip, ixfr); err == nil && n > 1 {
+		ns.IXFR = n
+	}
+
+	probe := recursionProbes[0]
+	if inBailiwick(domain, probe) {
+		probe = recursionProbes[1]
+	}
+
+	resp, err := directQuery(group, budget, ip, probe, dns.TypeA, true)
+	if err != nil {
+		return
+	}
+
+	ns.OpenResolver = resp.RecursionAvailable && resp.Rcode == dns.RcodeSuccess && !resp.Authoritative && len(resp.Answer) > 0
+}
@@ -53,7 +53,7 @@ func GeoIPDownload(fn string) {
 
 	logger.Println("downloading geoip data from Maxmind now...")
 	// http://lw.liam.sh/GeoLite2-City.mmdb.gz for testing, since it is ratelimited.
-	resp, err := http.Get("http://geolite.maxmind.com/download/geoip/database/GeoLite2-City.mmdb.gz")
+	resp, err := http.Get(conf().GeoURL)
 	if err != nil {
 		logger.Fatalf("unable to fetch geoip data: %s", err)
 	}
@@ -172,11 +172,13 @@ func IPLookup(addr string) (*IPResult, error) {
 	// TODO: This should probably have some form of daily IP cache (invalidates in 24h?)
 	ip := net.ParseIP(addr)
 	if ip == nil {
+		metricGeoIP.Inc("invalid")
 		return nil, fmt.Errorf("address provided is not a valid ip: %s", addr)
 	}
 
-	db, err := maxminddb.Open(conf.GeoDb)
+	db, err := maxminddb.Open(conf().GeoDb)
 	if err != nil {
+		metricGeoIP.Inc("error")
 		return nil, err
 	}
 	defer db.Close()
@@ -185,8 +187,10 @@ func IPLookup(addr string) (*IPResult, error) {
 
 	err = db.Lookup(ip, &results)
 	if err != nil {
+		metricGeoIP.Inc("error")
 		return nil, err
 	}
+	metricGeoIP.Inc("ok")
 	res := &IPResult{
 		City:          results.City.Names["en"],
 		Country:       results.Country.Names["en"],
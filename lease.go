@@ -0,0 +1,116 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// Leases keep several dnscheck instances sharing a store (e.g. postgres)
+// from doing the same work at once, e.g. running the same monitor. A lease
+// is held by one instance until it's released, or until it expires (if the
+// instance holding it exits without releasing it).
+
+var errLeaseHeld = errors.New("lease is held by another instance")
+
+// instanceID identifies this process as the holder of a lease.
+var instanceID = newInstanceID()
+
+func newInstanceID() string {
+	host, _ := os.Hostname()
+
+	buf := make([]byte, 4)
+	rand.Read(buf)
+
+	return fmt.Sprintf("%s/%d/%s", host, os.Getpid(), hex.EncodeToString(buf))
+}
+
+// lease is the holder of a lease, and when it expires.
+type lease struct {
+	Owner   string
+	Expires time.Time
+}
+
+// acquireLease takes the lease with the given name for ttl, failing with
+// errLeaseHeld if another instance holds it. Taking a lease this instance
+// already holds extends it.
+func acquireLease(name string, ttl time.Duration) error {
+	db, err := newDB()
+	if err != nil {
+		return err
+	}
+	defer db.Clean()
+
+	return db.store.Update("leases", name, func(value []byte) ([]byte, error) {
+		now := time.Now()
+
+		current := &lease{}
+		if value != nil {
+			if err := decodeRecord(value, current); err != nil {
+				return nil, err
+			}
+		}
+
+		if current.Owner != instanceID && current.Expires.After(now) {
+			return nil, errLeaseHeld
+		}
+
+		return encodeRecord(&lease{Owner: instanceID, Expires: now.Add(ttl)})
+	})
+}
+
+// releaseLease releases the lease with the given name, if this instance
+// holds it.
+func releaseLease(name string) error {
+	db, err := newDB()
+	if err != nil {
+		return err
+	}
+	defer db.Clean()
+
+	return db.store.Update("leases", name, func(value []byte) ([]byte, error) {
+		current := &lease{}
+		if value != nil {
+			if err := decodeRecord(value, current); err != nil {
+				return nil, err
+			}
+		}
+
+		if current.Owner != instanceID {
+			return value, nil
+		}
+
+		return encodeRecord(&lease{})
+	})
+}
+
+// holdLease extends the lease with the given name (which this instance must
+// hold) every third of ttl, until the returned func is called. This keeps a
+// lease for work which may take longer than ttl, while still letting it
+// expire soon after the instance holding it exits.
+func holdLease(name string, ttl time.Duration) (stop func()) {
+	done := make(chan struct{})
+	var once sync.Once
+
+	go func() {
+		ticker := time.NewTicker(ttl / 3)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				if err := acquireLease(name, ttl); err != nil {
+					logger.Printf("unable to extend the lease %s: %s", name, err)
+				}
+			}
+		}
+	}()
+
+	return func() { once.Do(func() { close(done) }) }
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLease(t *testing.T) {
+	defer useMemoryStore()()
+
+	if err := acquireLease("monitor/web", time.Minute); err != nil {
+		t.Fatalf("acquireLease: %s", err)
+	}
+
+	// extending a lease this instance holds.
+	if err := acquireLease("monitor/web", time.Minute); err != nil {
+		t.Fatalf("acquireLease (held by this instance): %s", err)
+	}
+
+	self := instanceID
+	defer func() { instanceID = self }()
+
+	instanceID = "other"
+	if err := acquireLease("monitor/web", time.Minute); err != errLeaseHeld {
+		t.Errorf("acquireLease (held by another instance) = %v, want %v", err, errLeaseHeld)
+	}
+
+	// only the holder can release it.
+	if err := releaseLease("monitor/web"); err != nil {
+		t.Fatal(err)
+	}
+	if err := acquireLease("monitor/web", time.Minute); err != errLeaseHeld {
+		t.Errorf("acquireLease after another instance released it = %v, want %v", err, errLeaseHeld)
+	}
+
+	instanceID = self
+	if err := releaseLease("monitor/web"); err != nil {
+		t.Fatal(err)
+	}
+
+	instanceID = "other"
+	if err := acquireLease("monitor/web", -time.Second); err != nil {
+		t.Errorf("acquireLease after release = %v", err)
+	}
+
+	// the lease above has already expired.
+	instanceID = self
+	if err := acquireLease("monitor/web", time.Minute); err != nil {
+		t.Errorf("acquireLease after expiry = %v", err)
+	}
+}
+
+func TestHoldLease(t *testing.T) {
+	defer useMemoryStore()()
+
+	ttl := 60 * time.Millisecond
+	if err := acquireLease("monitor/slow", ttl); err != nil {
+		t.Fatal(err)
+	}
+
+	stop := holdLease("monitor/slow", ttl)
+	time.Sleep(3 * ttl)
+	stop()
+
+	db, err := newDB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Clean()
+
+	value, err := db.store.Get("leases", "monitor/slow")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	current := &lease{}
+	if err = decodeRecord(value, current); err != nil {
+		t.Fatal(err)
+	}
+
+	if current.Owner != instanceID || !current.Expires.After(time.Now()) {
+		t.Errorf("lease = %+v, want one held by %s which hasn't expired", current, instanceID)
+	}
+}
@@ -0,0 +1,79 @@
+package lookup
+
+import "strings"
+
+// Finding severities, from least to most severe.
+const (
+	SeverityOK      = "ok"
+	SeverityInfo    = "info"
+	SeverityWarning = "warning"
+	SeverityError   = "error"
+)
+
+// SeverityRank orders the severities, from least (0) to most severe.
+var SeverityRank = map[string]int{
+	SeverityOK:      0,
+	SeverityInfo:    1,
+	SeverityWarning: 2,
+	SeverityError:   3,
+}
+
+// Finding is a single problem (or note) found while checking a record.
+type Finding struct {
+	Severity string
+	Message  string
+}
+
+// Answer is the result of looking up a single host, with a single resolver.
+type Answer struct {
+	Query        string
+	Want         string
+	Raw          []string
+	Answers      []string
+	ResponseTime string
+	Error        string
+	RType        string
+	Resolver     string
+	IsMatch      bool
+	// Warnings are problems found with the answers (currently only MX
+	// records are checked).
+	Warnings []*Finding
+}
+
+func (a *Answer) String() string {
+	return strings.Join(a.Answers, ", ")
+}
+
+// Answers sort errors first, then mismatches, then by query and resolver.
+type Answers []*Answer
+
+func (ans Answers) Len() int {
+	return len(ans)
+}
+
+func (ans Answers) Less(i, j int) bool {
+	// if one is erronous, and one is not
+	if ans[i].Error != "" && ans[j].Error == "" {
+		return true
+	} else if ans[i].Error == "" && ans[j].Error != "" {
+		return false
+	}
+
+	if ans[i].IsMatch == ans[j].IsMatch {
+		if ans[i].Query == ans[j].Query {
+			return ans[i].Resolver < ans[j].Resolver
+		}
+
+		return ans[i].Query < ans[j].Query
+	}
+
+	if ans[i].IsMatch {
+		return false
+	}
+
+	return true
+}
+
+func (ans Answers) Swap(i, j int) {
+	ans[i], ans[j] = ans[j], ans[i]
+}
@@ -0,0 +1,81 @@
+package lookup
+
+import (
+	"errors"
+	"regexp"
+	"strings"
+)
+
+// ^(?:(?P<ip>\d{1,3}\.\d{1,3}\.\d{1,3}\.\d{1,3})\s{1,})?(?P<domain>(?:(?:[A-Za-z0-9_.-]{2,350}\.[A-Za-z0-9]{2,63})\s+)+)$
+var reDomain = regexp.MustCompile(`^[A-Za-z0-9_.-]{2,350}\.[A-Za-z0-9]{2,63}$`)
+var reRawDomain = regexp.MustCompile(`^(?:(?P<ip>\d{1,3}\.\d{1,3}\.\d{1,3}\.\d{1,3})\s+)?(?P<domains>[A-Za-z0-9_.\s-]{6,})$`)
+var reSpaces = regexp.MustCompile(`^[\t\n\v\f\r ]+|[\t\n\v\f\r ]+$`)
+var reNewlines = regexp.MustCompile(`[\n\r]+`)
+
+// ErrInvalidInput is returned by ParseHosts when a line can't be parsed.
+var ErrInvalidInput = errors.New("erronous input")
+
+// Host represents an item to look up
+type Host struct {
+	Name string
+	// Want is the address the host is expected to resolve to, if any.
+	Want string
+}
+
+// ParseHosts parses a list of hosts, one or more per line, optionally
+// prefixed with the address they are expected to resolve to, e.g.
+// "93.184.216.34 example.com www.example.com". Wildcards are skipped, as are
+// duplicates.
+func ParseHosts(hosts string) (out []*Host, err error) {
+	input := strings.Split(reNewlines.ReplaceAllString(reSpaces.ReplaceAllString(hosts, ""), "\n"), "\n")
+
+	var knownHosts []string
+
+	for i := 0; i < len(input); i++ {
+		// check if the domain has wildcard records within it, as we are unable to check those
+		if strings.Contains(input[i], "*.") {
+			continue
+		}
+
+		line := reRawDomain.FindStringSubmatch(reSpaces.ReplaceAllString(input[i], ""))
+		if len(line) != 3 {
+			return nil, ErrInvalidInput
+		}
+
+		for _, domain := range strings.Split(line[2], " ") {
+			if domain == "" {
+				return nil, ErrInvalidInput
+			}
+
+			domain = strings.Trim(domain, " ")
+			if !reDomain.MatchString(domain) {
+				return nil, ErrInvalidInput
+			}
+
+			ip, host := line[1], domain
+
+			if host == "" {
+				return nil, ErrInvalidInput
+			}
+
+			// verify it's not already within the list
+			var alreadyExists bool
+			for k := 0; k < len(knownHosts); k++ {
+				if knownHosts[k] == host {
+					alreadyExists = true
+					break
+				}
+			}
+			if alreadyExists {
+				continue // skip it
+			}
+
+			// track this host to prevent duplicate checks
+			knownHosts = append(knownHosts, host)
+
+			out = append(out, &Host{Name: host, Want: ip})
+		}
+	}
+
+	return out, nil
+}
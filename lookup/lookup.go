@@ -0,0 +1,311 @@
+// Package lookup is the dnscheck lookup engine. It looks up a list of hosts
+// against a group of resolvers, and compares the answers to the addresses
+// the hosts are expected to resolve to.
+//
+//	hosts, err := lookup.ParseHosts("93.184.216.34 example.com")
+//	if err != nil {
+//		return err
+//	}
+//
+//	res, err := lookup.Run(ctx, hosts, lookup.Options{
+//		Resolvers: &lookup.ResolverGroup{Servers: []string{"1.1.1.1", "8.8.8.8"}},
+//		Type:      "A",
+//	})
+package lookup
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	sempool "github.com/lrstanley/go-sempool"
+	"github.com/miekg/dns"
+)
+
+// Errors returned by Run, before any queries are sent.
+var (
+	ErrNoResolvers    = errors.New("no resolvers configured")
+	ErrTooManyQueries = errors.New("too many queries to process")
+	ErrInvalidType    = errors.New("invalid lookup type")
+)
+
+// DefaultConcurrency is the number of concurrent lookups used when
+// Options.Concurrency isn't set.
+const DefaultConcurrency = 10
+
+// Types maps the supported lookup types to their query type. An empty type
+// is an A lookup.
+var Types = map[string]uint16{
+	"":      dns.TypeA,
+	"A":     dns.TypeA,
+	"AAAA":  dns.TypeAAAA,
+	"CNAME": dns.TypeCNAME,
+	"MX":    dns.TypeMX,
+	"NS":    dns.TypeNS,
+	"TXT":   dns.TypeTXT,
+}
+
+// Options configure a single call to Run.
+type Options struct {
+	// Resolvers are the resolvers to query. Required.
+	Resolvers *ResolverGroup
+	// Type is the record type to look up (one of Types).
+	Type string
+	// Fanout looks up every host using every one of the resolvers (rather
+	// than any one of them), so the answers each resolver receives can be
+	// compared.
+	Fanout bool
+	// Limit is the max number of queries (hosts, times resolvers if Fanout
+	// is set). 0 is no limit.
+	Limit int
+	// Concurrency is the max number of concurrent lookups. Defaults to
+	// DefaultConcurrency.
+	Concurrency int
+	// Scheduler, if set, shares query slots and per-resolver rate limits
+	// with every other lookup using it. Otherwise, lookups are only limited
+	// by Concurrency.
+	Scheduler *Scheduler
+}
+
+// Results are the answers of a single call to Run.
+type Results struct {
+	Hosts   []*Host
+	Answers Answers
+	Type    string
+	Fanout  bool
+	Time    time.Time
+}
+
+// FormatRTT formats a round trip time in milliseconds, e.g. "12.34ms".
+func FormatRTT(t time.Duration) string {
+	ms := float32(t.Nanoseconds()) / 1000000.0
+
+	return fmt.Sprintf("%.2fms", ms)
+}
+
+// RecordValue returns the value of rr, without the header (e.g. just the
+// address of an A record).
+func RecordValue(rr dns.RR) string {
+	switch r := rr.(type) {
+	case *dns.A:
+		return r.A.String()
+	case *dns.AAAA:
+		return r.AAAA.String()
+	case *dns.CNAME:
+		return strings.TrimSuffix(r.Target, ".")
+	case *dns.MX:
+		return fmt.Sprintf("%d %s", r.Preference, strings.TrimSuffix(r.Mx, "."))
+	case *dns.NS:
+		return strings.TrimSuffix(r.Ns, ".")
+	case *dns.TXT:
+		return strings.Join(r.Txt, "")
+	}
+
+	return strings.TrimPrefix(rr.String(), rr.Header().String())
+}
+
+// shouldRetry returns true if a query which failed with err (or returned
+// result) should be retried with another resolver, i.e. if the resolver
+// failed, rather than the lookup.
+func shouldRetry(result *dns.Msg, err error) bool {
+	if err != nil {
+		return true
+	}
+
+	return result.Rcode == dns.RcodeServerFailure || result.Rcode == dns.RcodeRefused
+}
+
+// without returns servers, without server.
+func without(servers []string, server string) (out []string) {
+	for _, srv := range servers {
+		if srv != server {
+			out = append(out, srv)
+		}
+	}
+
+	return out
+}
+
+// contextErr returns the error of ctx, or context.DeadlineExceeded if its
+// deadline has passed. A query times out at the deadline of ctx, which may be
+// just before ctx itself is done.
+func contextErr(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	if deadline, ok := ctx.Deadline(); ok && !time.Now().Before(deadline) {
+		return context.DeadlineExceeded
+	}
+
+	return nil
+}
+
+// Run looks up every host, as configured by opts. If ctx is done before
+// every lookup has completed, the error of ctx is returned.
+func Run(ctx context.Context, hosts []*Host, opts Options) (*Results, error) {
+	if opts.Resolvers == nil || len(opts.Resolvers.Servers) == 0 {
+		return nil, ErrNoResolvers
+	}
+
+	group := opts.Resolvers
+	servers := group.Servers
+
+	if opts.Limit > 0 && (len(hosts) > opts.Limit || (opts.Fanout && len(hosts)*len(servers) > opts.Limit)) {
+		return nil, ErrTooManyQueries
+	}
+
+	lookupType, ok := Types[opts.Type]
+	if !ok {
+		return nil, ErrInvalidType
+	}
+
+	rtype := opts.Type
+	if rtype == "" {
+		rtype = dns.TypeToString[lookupType]
+	}
+
+	concurrency := opts.Concurrency
+	if concurrency < 1 {
+		concurrency = DefaultConcurrency
+	}
+
+	sched := opts.Scheduler
+	if sched == nil {
+		sched = NewScheduler(concurrency, 0)
+	}
+
+	out := &Results{Hosts: hosts, Type: rtype, Fanout: opts.Fanout, Time: time.Now()}
+
+	budget := sched.NewScan()
+	defer budget.Done()
+
+	var lock sync.Mutex
+	var cancelled bool
+	pool := sempool.New(concurrency)
+
+	// query sends msg to any one of candidates.
+	query := func(msg *dns.Msg, candidates []string) (server string, result *dns.Msg, rtt time.Duration, err error) {
+		server, release, err := budget.AcquireContext(ctx, candidates)
+		if err != nil {
+			return "", nil, 0, err
+		}
+		defer release()
+
+		result, rtt, err = group.ExchangeContext(ctx, server, msg)
+
+		return server, result, rtt, err
+	}
+
+	// each lookup is sent to any one of candidates. If it fails, it's retried
+	// once with another of them.
+	lookup := func(host *Host, candidates []string) {
+		defer pool.Free()
+
+		msg := new(dns.Msg)
+		msg.SetQuestion(dns.Fqdn(host.Name), lookupType)
+
+		server, result, rtt, err := query(msg, candidates)
+		if server != "" && shouldRetry(result, err) && len(candidates) > 1 && contextErr(ctx) == nil {
+			if retry, rresult, rrtt, rerr := query(msg, without(candidates, server)); retry != "" {
+				server, result, rtt, err = retry, rresult, rrtt, rerr
+			}
+		}
+
+		// the query failed because ctx is done, rather than the resolver.
+		if server == "" || (err != nil && contextErr(ctx) != nil) {
+			lock.Lock()
+			cancelled = true
+			lock.Unlock()
+			return
+		}
+
+		if err == nil && result.Rcode != dns.RcodeSuccess {
+			err = fmt.Errorf("lookup failed: %s", dns.RcodeToString[result.Rcode])
+		}
+
+		if err != nil {
+			lock.Lock()
+			out.Answers = append(out.Answers, &Answer{
+				Query:    host.Name,
+				Want:     host.Want,
+				RType:    rtype,
+				Resolver: server,
+				Error:    err.Error(),
+			})
+			lock.Unlock()
+			return
+		}
+
+		ans := &Answer{
+			Query:        host.Name,
+			Want:         host.Want,
+			RType:        dns.TypeToString[lookupType],
+			Resolver:     server,
+			ResponseTime: FormatRTT(rtt),
+		}
+
+		var mxs []*dns.MX
+
+		for _, rr := range result.Answer {
+			// skip anything but the requested type, e.g. the CNAME chain leading
+			// to an A record.
+			if rr.Header().Rrtype != lookupType {
+				continue
+			}
+
+			if mx, ok := rr.(*dns.MX); ok {
+				mxs = append(mxs, mx)
+			}
+
+			value := RecordValue(rr)
+			ans.Answers = append(ans.Answers, value)
+
+			if !ans.IsMatch && (value == ans.Want || len(ans.Want) == 0 || lookupType != dns.TypeA) {
+				// TODO: currently, only A records are comparable. in the future, this should support anything,
+				// though it would require the user entering this to compare.
+				// TODO: this should be opt-out'able. meaning in the frontend, any returned record is successful.
+				ans.IsMatch = true
+			}
+		}
+
+		if len(mxs) > 0 {
+			ans.Warnings = checkMX(ctx, group, budget, mxs)
+		}
+
+		lock.Lock()
+		out.Answers = append(out.Answers, ans)
+		lock.Unlock()
+	}
+
+	for i := 0; i < len(hosts) && ctx.Err() == nil; i++ {
+		if !opts.Fanout {
+			pool.Slot()
+			go lookup(hosts[i], servers)
+			continue
+		}
+
+		for _, server := range servers {
+			pool.Slot()
+			go lookup(hosts[i], []string{server})
+		}
+	}
+
+	pool.Wait()
+
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	if cancelled {
+		return nil, contextErr(ctx)
+	}
+
+	sort.Sort(out.Answers)
+
+	return out, nil
+}
@@ -0,0 +1,269 @@
+package lookup
+
+import (
+	"context"
+	"net"
+	"reflect"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// testServer is a local DNS server, answering for example.com:
+//
+//   - missing.example.com doesn't exist.
+//   - slow.example.com is only answered after a second.
+//   - anything else resolves to 93.184.216.34.
+//
+// If rcode is set, it's returned for every query instead.
+type testServer struct {
+	Addr string
+
+	mu      sync.Mutex
+	queries int
+	rcode   int
+}
+
+func (s *testServer) ServeDNS(w dns.ResponseWriter, req *dns.Msg) {
+	s.mu.Lock()
+	s.queries++
+	rcode := s.rcode
+	s.mu.Unlock()
+
+	resp := new(dns.Msg)
+	resp.SetReply(req)
+
+	name := req.Question[0].Name
+
+	switch {
+	case rcode != dns.RcodeSuccess:
+		resp.Rcode = rcode
+	case name == "missing.example.com.":
+		resp.Rcode = dns.RcodeNameError
+	case req.Question[0].Qtype == dns.TypeA:
+		if name == "slow.example.com." {
+			time.Sleep(time.Second)
+		}
+
+		rr, _ := dns.NewRR(name + " 300 IN A 93.184.216.34")
+		resp.Answer = append(resp.Answer, rr)
+	}
+
+	w.WriteMsg(resp)
+}
+
+// Queries returns the number of queries the server has received.
+func (s *testServer) Queries() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.queries
+}
+
+// startServer starts a testServer on a random local port. The returned func
+// stops it.
+func startServer(t *testing.T, rcode int) (*testServer, func()) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ts := &testServer{Addr: pc.LocalAddr().String(), rcode: rcode}
+
+	started := make(chan struct{})
+	srv := &dns.Server{PacketConn: pc, Handler: ts, NotifyStartedFunc: func() { close(started) }}
+
+	go srv.ActivateAndServe()
+	<-started
+
+	return ts, func() { srv.Shutdown() }
+}
+
+func TestParseHosts(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    []*Host
+		wantErr bool
+	}{
+		{"example.com", []*Host{{Name: "example.com"}}, false},
+		{"  example.com\n\n www.example.com \r\n", []*Host{{Name: "example.com"}, {Name: "www.example.com"}}, false},
+		{"93.184.216.34 example.com www.example.com", []*Host{{Name: "example.com", Want: "93.184.216.34"}, {Name: "www.example.com", Want: "93.184.216.34"}}, false},
+		{"example.com\nexample.com", []*Host{{Name: "example.com"}}, false},
+		{"*.example.com\nexample.com", []*Host{{Name: "example.com"}}, false},
+		{"example", nil, true},
+		{"example.com  www.example.com", nil, true},
+		{"example.com/path", nil, true},
+	}
+
+	for _, tt := range tests {
+		got, err := ParseHosts(tt.in)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("ParseHosts(%q) error = %v, want error: %v", tt.in, err, tt.wantErr)
+			continue
+		}
+
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("ParseHosts(%q) = %v, want %v", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestRun(t *testing.T) {
+	ts, stop := startServer(t, dns.RcodeSuccess)
+	defer stop()
+
+	hosts, err := ParseHosts("93.184.216.34 example.com\n203.0.113.1 www.example.com\nmissing.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	res, err := Run(context.Background(), hosts, Options{
+		Resolvers: &ResolverGroup{Servers: []string{ts.Addr}},
+		Type:      "A",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(res.Answers) != 3 {
+		t.Fatalf("%d answers, want 3", len(res.Answers))
+	}
+
+	got := make(map[string]*Answer)
+	for _, ans := range res.Answers {
+		got[ans.Query] = ans
+	}
+
+	if ans := got["example.com"]; !ans.IsMatch || ans.Error != "" || !reflect.DeepEqual(ans.Answers, []string{"93.184.216.34"}) {
+		t.Errorf("example.com = %+v, want a match", ans)
+	}
+
+	if ans := got["www.example.com"]; ans.IsMatch || ans.Error != "" {
+		t.Errorf("www.example.com = %+v, want a mismatch", ans)
+	}
+
+	if ans := got["missing.example.com"]; ans.Error != "lookup failed: NXDOMAIN" {
+		t.Errorf("missing.example.com error = %q, want NXDOMAIN", ans.Error)
+	}
+
+	// errors sort first.
+	if res.Answers[0].Query != "missing.example.com" {
+		t.Errorf("first answer is %s, want the error", res.Answers[0].Query)
+	}
+}
+
+func TestRunFanout(t *testing.T) {
+	a, stopA := startServer(t, dns.RcodeSuccess)
+	defer stopA()
+	b, stopB := startServer(t, dns.RcodeSuccess)
+	defer stopB()
+
+	hosts := []*Host{{Name: "example.com"}, {Name: "www.example.com"}}
+
+	res, err := Run(context.Background(), hosts, Options{
+		Resolvers: &ResolverGroup{Servers: []string{a.Addr, b.Addr}},
+		Type:      "A",
+		Fanout:    true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got []string
+	for _, ans := range res.Answers {
+		got = append(got, ans.Query+"|"+ans.Resolver)
+	}
+	sort.Strings(got)
+
+	want := []string{"example.com|" + a.Addr, "example.com|" + b.Addr, "www.example.com|" + a.Addr, "www.example.com|" + b.Addr}
+	sort.Strings(want)
+
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("answers = %q, want %q", got, want)
+	}
+
+	if a.Queries() != 2 || b.Queries() != 2 {
+		t.Errorf("queries = %d and %d, want 2 each", a.Queries(), b.Queries())
+	}
+}
+
+func TestRunOptions(t *testing.T) {
+	group := &ResolverGroup{Servers: []string{"127.0.0.1:1", "127.0.0.1:2"}}
+	hosts := []*Host{{Name: "example.com"}, {Name: "www.example.com"}, {Name: "mail.example.com"}}
+
+	tests := []struct {
+		name string
+		opts Options
+		want error
+	}{
+		{"no resolvers", Options{}, ErrNoResolvers},
+		{"empty group", Options{Resolvers: &ResolverGroup{}}, ErrNoResolvers},
+		{"over limit", Options{Resolvers: group, Limit: 2}, ErrTooManyQueries},
+		{"fanout over limit", Options{Resolvers: group, Limit: 5, Fanout: true}, ErrTooManyQueries},
+		{"invalid type", Options{Resolvers: group, Type: "SOA"}, ErrInvalidType},
+	}
+
+	for _, tt := range tests {
+		if _, err := Run(context.Background(), hosts, tt.opts); err != tt.want {
+			t.Errorf("%s: error = %v, want %v", tt.name, err, tt.want)
+		}
+	}
+}
+
+func TestRunCancel(t *testing.T) {
+	ts, stop := startServer(t, dns.RcodeSuccess)
+	defer stop()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	_, err := Run(ctx, []*Host{{Name: "slow.example.com"}}, Options{
+		Resolvers: &ResolverGroup{Servers: []string{ts.Addr}},
+	})
+	if err != context.DeadlineExceeded {
+		t.Errorf("error = %v, want %v", err, context.DeadlineExceeded)
+	}
+
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("Run took %s after ctx was done", elapsed)
+	}
+}
+
+func TestRunFailover(t *testing.T) {
+	failing, stopFailing := startServer(t, dns.RcodeServerFailure)
+	defer stopFailing()
+	working, stopWorking := startServer(t, dns.RcodeSuccess)
+	defer stopWorking()
+
+	// neither resolver is rate limited, so the first is always tried first.
+	res, err := Run(context.Background(), []*Host{{Name: "example.com"}}, Options{
+		Resolvers: &ResolverGroup{Servers: []string{failing.Addr, working.Addr}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if ans := res.Answers[0]; ans.Error != "" || ans.Resolver != working.Addr {
+		t.Errorf("answer = %+v, want one from %s", ans, working.Addr)
+	}
+
+	if failing.Queries() != 1 || working.Queries() != 1 {
+		t.Errorf("queries = %d and %d, want 1 each", failing.Queries(), working.Queries())
+	}
+
+	// NXDOMAIN is an answer, not a failure of the resolver.
+	res, err = Run(context.Background(), []*Host{{Name: "missing.example.com"}}, Options{
+		Resolvers: &ResolverGroup{Servers: []string{working.Addr, failing.Addr}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if working.Queries() != 2 || failing.Queries() != 1 {
+		t.Errorf("NXDOMAIN was retried")
+	}
+}
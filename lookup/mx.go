@@ -0,0 +1,157 @@
+package lookup
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// privateNets are the private address ranges (RFC 1918 and RFC 4193).
+var privateNets = mustParseCIDRs("10.0.0.0/8", "172.16.0.0/12", "192.168.0.0/16", "fc00::/7")
+
+func mustParseCIDRs(cidrs ...string) (out []*net.IPNet) {
+	for _, cidr := range cidrs {
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+
+		out = append(out, n)
+	}
+
+	return out
+}
+
+// isPrivateIP returns true if ip isn't publicly routable.
+func isPrivateIP(ip net.IP) bool {
+	if ip.IsLoopback() || ip.IsLinkLocalUnicast() || ip.IsUnspecified() || ip.IsMulticast() {
+		return true
+	}
+
+	for _, n := range privateNets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// checkMXTarget resolves the A/AAAA records of a single mail exchange,
+// returning any problems found.
+func checkMXTarget(ctx context.Context, group *ResolverGroup, budget *Budget, target string) (out []*Finding) {
+	finding := func(severity, format string, args ...interface{}) {
+		out = append(out, &Finding{Severity: severity, Message: fmt.Sprintf(format, args...)})
+	}
+
+	if net.ParseIP(target) != nil {
+		finding(SeverityError, "%s is an ip address, MX records must point to a hostname (RFC 5321 5.1)", target)
+		return out
+	}
+
+	var addrs []net.IP
+
+	for _, qtype := range []uint16{dns.TypeA, dns.TypeAAAA} {
+		msg := new(dns.Msg)
+		msg.SetQuestion(dns.Fqdn(target), qtype)
+
+		server, release, err := budget.AcquireContext(ctx, group.Servers)
+		if err != nil {
+			return out
+		}
+		resp, _, err := group.ExchangeContext(ctx, server, msg)
+		release()
+
+		if err != nil {
+			finding(SeverityWarning, "unable to resolve %s: %s", target, err)
+			return out
+		}
+
+		if resp.Rcode == dns.RcodeNameError {
+			finding(SeverityError, "%s does not exist (NXDOMAIN)", target)
+			return out
+		}
+
+		if resp.Rcode != dns.RcodeSuccess {
+			finding(SeverityWarning, "unable to resolve %s: %s", target, dns.RcodeToString[resp.Rcode])
+			return out
+		}
+
+		for _, rr := range resp.Answer {
+			switch r := rr.(type) {
+			case *dns.CNAME:
+				if qtype == dns.TypeA && strings.EqualFold(r.Hdr.Name, dns.Fqdn(target)) {
+					finding(SeverityError, "%s is a CNAME (to %s), MX records must not point to an alias (RFC 2181 10.3)", target, strings.TrimSuffix(r.Target, "."))
+				}
+			case *dns.A:
+				addrs = append(addrs, r.A)
+			case *dns.AAAA:
+				addrs = append(addrs, r.AAAA)
+			}
+		}
+	}
+
+	if len(addrs) == 0 {
+		finding(SeverityError, "%s has no A or AAAA records", target)
+	}
+
+	for _, ip := range addrs {
+		if isPrivateIP(ip) {
+			finding(SeverityError, "%s resolves to a private address (%s)", target, ip)
+		}
+	}
+
+	return out
+}
+
+// checkMX checks the MX records of a domain for common problems: null MX
+// misuse (RFC 7505), duplicate preferences, and exchanges which are CNAMEs,
+// ip addresses, don't exist, or resolve to private addresses.
+func checkMX(ctx context.Context, group *ResolverGroup, budget *Budget, records []*dns.MX) (out []*Finding) {
+	finding := func(severity, format string, args ...interface{}) {
+		out = append(out, &Finding{Severity: severity, Message: fmt.Sprintf(format, args...)})
+	}
+
+	var targets []*dns.MX
+	prefs := make(map[uint16][]string)
+
+	for _, mx := range records {
+		if mx.Mx == "." {
+			if len(records) > 1 {
+				finding(SeverityError, "a null MX must be the only MX record for the domain (RFC 7505 3)")
+			} else {
+				finding(SeverityInfo, "null MX, the domain does not accept mail (RFC 7505)")
+			}
+
+			if mx.Preference != 0 {
+				finding(SeverityWarning, "a null MX should have a preference of 0 (got %d)", mx.Preference)
+			}
+			continue
+		}
+
+		targets = append(targets, mx)
+		prefs[mx.Preference] = append(prefs[mx.Preference], strings.TrimSuffix(mx.Mx, "."))
+	}
+
+	var dupes []int
+	for pref, hosts := range prefs {
+		if len(hosts) > 1 {
+			dupes = append(dupes, int(pref))
+		}
+	}
+	sort.Ints(dupes)
+
+	for _, pref := range dupes {
+		finding(SeverityInfo, "preference %d is shared by %s", pref, strings.Join(prefs[uint16(pref)], ", "))
+	}
+
+	for _, mx := range targets {
+		out = append(out, checkMXTarget(ctx, group, budget, strings.TrimSuffix(mx.Mx, "."))...)
+	}
+
+	return out
+}
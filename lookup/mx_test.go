@@ -0,0 +1,31 @@
+package lookup
+
+import (
+	"net"
+	"testing"
+)
+
+func TestIsPrivateIP(t *testing.T) {
+	tests := map[string]bool{
+		"10.1.2.3":       true,
+		"172.16.0.1":     true,
+		"172.31.255.255": true,
+		"172.32.0.1":     false,
+		"192.168.1.1":    true,
+		"127.0.0.1":      true,
+		"169.254.1.1":    true,
+		"0.0.0.0":        true,
+		"224.0.0.1":      true,
+		"93.184.216.34":  false,
+		"::1":            true,
+		"fd00::1":        true,
+		"fe80::1":        true,
+		"2606:2800::1":   false,
+	}
+
+	for ip, want := range tests {
+		if got := isPrivateIP(net.ParseIP(ip)); got != want {
+			t.Errorf("isPrivateIP(%s) = %v, want %v", ip, got, want)
+		}
+	}
+}
@@ -0,0 +1,67 @@
+package lookup
+
+import (
+	"context"
+	"net"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// DefaultTimeout is the query timeout used when a resolver group doesn't
+// specify one.
+const DefaultTimeout = 3 * time.Second
+
+// ResolverGroup is a group of resolvers, and the options used when querying
+// them.
+type ResolverGroup struct {
+	// Servers are ip or ip:port addresses.
+	Servers []string
+	// Transport is "udp" (default), "tcp" or "tcp-tls".
+	Transport string
+	// Timeout of each query. Defaults to DefaultTimeout.
+	Timeout time.Duration
+	// OnQuery, if set, is called once each query has completed (e.g. to
+	// record metrics). resp is nil if err isn't.
+	OnQuery func(server string, resp *dns.Msg, rtt time.Duration, err error)
+}
+
+// Client returns the DNS client used to query the groups resolvers.
+func (g *ResolverGroup) Client() *dns.Client {
+	client := &dns.Client{Net: g.Transport, Timeout: DefaultTimeout}
+
+	if g.Timeout > 0 {
+		client.Timeout = g.Timeout
+	}
+
+	return client
+}
+
+// Addr returns the host:port address for server, assuming the default port
+// of the groups transport if one isn't provided.
+func (g *ResolverGroup) Addr(server string) string {
+	if _, _, err := net.SplitHostPort(server); err == nil {
+		return server
+	}
+
+	if g.Transport == "tcp-tls" {
+		return net.JoinHostPort(server, "853")
+	}
+
+	return net.JoinHostPort(server, "53")
+}
+
+// Exchange sends msg to server, returning the response and round trip time.
+func (g *ResolverGroup) Exchange(server string, msg *dns.Msg) (*dns.Msg, time.Duration, error) {
+	return g.ExchangeContext(context.Background(), server, msg)
+}
+
+// ExchangeContext is like Exchange, but gives up once ctx is done.
+func (g *ResolverGroup) ExchangeContext(ctx context.Context, server string, msg *dns.Msg) (*dns.Msg, time.Duration, error) {
+	resp, rtt, err := g.Client().ExchangeContext(ctx, msg, g.Addr(server))
+	if g.OnQuery != nil {
+		g.OnQuery(server, resp, rtt, err)
+	}
+
+	return resp, rtt, err
+}
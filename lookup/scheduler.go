@@ -0,0 +1,255 @@
+package lookup
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// Scheduler hands out query slots to concurrently running scans. It
+// enforces a global limit on in-flight queries, shares those slots fairly
+// (round-robin) between scans, and rate limits the queries sent to each
+// individual resolver, so that many simultaneous users don't multiply the
+// load we put on public resolvers.
+type Scheduler struct {
+	mu       sync.Mutex
+	cond     *sync.Cond
+	max      int
+	inflight int
+	scans    []*Budget
+	last     int
+
+	qps      rate.Limit
+	burst    int
+	limiters map[string]*limiter
+	swept    time.Time
+}
+
+// limiterIdle is how long the rate limiter of a resolver is kept once it's
+// no longer used. An idle limiter has a full bucket, so one created in its
+// place behaves the same.
+const limiterIdle = 10 * time.Minute
+
+// limiter is the rate limiter of a single resolver.
+type limiter struct {
+	*rate.Limiter
+	used time.Time
+}
+
+// Budget is a single scans handle into the Scheduler.
+type Budget struct {
+	sched   *Scheduler
+	waiting int
+}
+
+// NewScheduler returns a new Scheduler which allows at most concurrency
+// in-flight queries, and qps queries per second to each resolver. A qps of 0
+// or less disables per-resolver rate limiting.
+func NewScheduler(concurrency int, qps float64) *Scheduler {
+	s := &Scheduler{limiters: make(map[string]*limiter)}
+	s.cond = sync.NewCond(&s.mu)
+	s.Update(concurrency, qps)
+
+	return s
+}
+
+// Update changes the limits of the scheduler. Queries which are already
+// in-flight are unaffected.
+func (s *Scheduler) Update(concurrency int, qps float64) {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.max = concurrency
+	s.qps, s.burst = rate.Inf, 1
+
+	if qps > 0 {
+		s.qps = rate.Limit(qps)
+
+		if qps > 1 {
+			s.burst = int(qps)
+		}
+	}
+
+	for _, lim := range s.limiters {
+		lim.SetLimit(s.qps)
+		lim.SetBurst(s.burst)
+	}
+
+	s.cond.Broadcast()
+}
+
+// NewScan registers a new scan with the scheduler. Budget.Done() should
+// ALWAYS be called once the scan has completed.
+func (s *Scheduler) NewScan() *Budget {
+	b := &Budget{sched: s}
+
+	s.mu.Lock()
+	s.scans = append(s.scans, b)
+	s.mu.Unlock()
+
+	return b
+}
+
+// nextScan returns the next scan (after the last one served) which is
+// waiting on a slot. s.mu must be held.
+func (s *Scheduler) nextScan() *Budget {
+	for i := 1; i <= len(s.scans); i++ {
+		b := s.scans[(s.last+i)%len(s.scans)]
+		if b.waiting > 0 {
+			return b
+		}
+	}
+
+	return nil
+}
+
+// limiter returns the rate limiter for server, creating it if needed, and
+// removes the limiters of resolvers which haven't been used in limiterIdle.
+// s.mu must be held.
+func (s *Scheduler) limiter(server string) *rate.Limiter {
+	now := time.Now()
+
+	if now.Sub(s.swept) > limiterIdle {
+		for srv, lim := range s.limiters {
+			if now.Sub(lim.used) > limiterIdle {
+				delete(s.limiters, srv)
+			}
+		}
+
+		s.swept = now
+	}
+
+	lim, ok := s.limiters[server]
+	if !ok {
+		lim = &limiter{Limiter: rate.NewLimiter(s.qps, s.burst)}
+		s.limiters[server] = lim
+	}
+	lim.used = now
+
+	return lim.Limiter
+}
+
+// Acquire blocks until the scan is given a query slot, and until one of
+// servers is allowed to be queried. It returns the server to query, and a
+// release function which must be called once the query has completed.
+func (b *Budget) Acquire(servers []string) (server string, release func()) {
+	server, release, _ = b.AcquireContext(context.Background(), servers)
+
+	return server, release
+}
+
+// AcquireContext is like Acquire, but gives up once ctx is done, in which
+// case the error of ctx is returned, and release should not be called.
+//
+// The server is picked (and its rate limit waited out) before a slot is
+// taken, so scans waiting on a rate limited resolver don't hold slots other
+// scans could use.
+func (b *Budget) AcquireContext(ctx context.Context, servers []string) (server string, release func(), err error) {
+	s := b.sched
+
+	// pick the resolver which can be queried the soonest.
+	var best *rate.Reservation
+
+	s.mu.Lock()
+	for _, srv := range servers {
+		r := s.limiter(srv).Reserve()
+
+		if best == nil || r.Delay() < best.Delay() {
+			if best != nil {
+				best.Cancel()
+			}
+
+			best, server = r, srv
+			continue
+		}
+
+		r.Cancel()
+	}
+	s.mu.Unlock()
+
+	if best != nil && best.Delay() > 0 {
+		timer := time.NewTimer(best.Delay())
+		defer timer.Stop()
+
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			best.Cancel()
+			return "", nil, ctx.Err()
+		}
+	}
+
+	// wake up the waiters below if ctx is done, so they can give up.
+	if done := ctx.Done(); done != nil {
+		stop := make(chan struct{})
+		defer close(stop)
+
+		go func() {
+			select {
+			case <-done:
+				s.mu.Lock()
+				s.cond.Broadcast()
+				s.mu.Unlock()
+			case <-stop:
+			}
+		}()
+	}
+
+	s.mu.Lock()
+	b.waiting++
+	for s.inflight >= s.max || s.nextScan() != b {
+		if err = ctx.Err(); err != nil {
+			b.waiting--
+			s.cond.Broadcast()
+			s.mu.Unlock()
+			return "", nil, err
+		}
+
+		s.cond.Wait()
+	}
+	b.waiting--
+	s.inflight++
+
+	for i := 0; i < len(s.scans); i++ {
+		if s.scans[i] == b {
+			s.last = i
+			break
+		}
+	}
+	s.cond.Broadcast()
+	s.mu.Unlock()
+
+	release = func() {
+		s.mu.Lock()
+		s.inflight--
+		s.cond.Broadcast()
+		s.mu.Unlock()
+	}
+
+	return server, release, nil
+}
+
+// Done unregisters the scan from the scheduler.
+func (b *Budget) Done() {
+	s := b.sched
+
+	s.mu.Lock()
+	for i := 0; i < len(s.scans); i++ {
+		if s.scans[i] == b {
+			s.scans = append(s.scans[:i], s.scans[i+1:]...)
+			break
+		}
+	}
+
+	if s.last >= len(s.scans) {
+		s.last = 0
+	}
+	s.cond.Broadcast()
+	s.mu.Unlock()
+}
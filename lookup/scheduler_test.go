@@ -0,0 +1,133 @@
+package lookup
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestSchedulerInflight(t *testing.T) {
+	s := NewScheduler(2, 0)
+
+	var mu sync.Mutex
+	var inflight, max int
+
+	var wg sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		b := s.NewScan()
+
+		for j := 0; j < 5; j++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+
+				_, release := b.Acquire([]string{"192.0.2.1"})
+
+				mu.Lock()
+				if inflight++; inflight > max {
+					max = inflight
+				}
+				mu.Unlock()
+
+				time.Sleep(10 * time.Millisecond)
+
+				mu.Lock()
+				inflight--
+				mu.Unlock()
+
+				release()
+			}()
+		}
+	}
+	wg.Wait()
+
+	if max != 2 {
+		t.Errorf("max in-flight = %d, want 2", max)
+	}
+}
+
+func TestSchedulerCancel(t *testing.T) {
+	s := NewScheduler(1, 0)
+	b := s.NewScan()
+	defer b.Done()
+
+	_, release := b.Acquire([]string{"192.0.2.1"})
+	defer release()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	if _, _, err := b.AcquireContext(ctx, []string{"192.0.2.1"}); err != context.DeadlineExceeded {
+		t.Errorf("error = %v, want %v", err, context.DeadlineExceeded)
+	}
+}
+
+func TestSchedulerRateLimit(t *testing.T) {
+	s := NewScheduler(1, 1)
+
+	limited := s.NewScan()
+	defer limited.Done()
+	other := s.NewScan()
+	defer other.Done()
+
+	// use up the only token of the first resolver.
+	_, release := limited.Acquire([]string{"192.0.2.1"})
+	release()
+
+	// the least limited resolver is picked.
+	server, release := limited.Acquire([]string{"192.0.2.1", "192.0.2.2"})
+	release()
+	if server != "192.0.2.2" {
+		t.Errorf("server = %s, want the resolver which isn't rate limited", server)
+	}
+
+	// waiting on the rate limit doesn't hold the only slot.
+	waiting := make(chan struct{})
+	go func() {
+		_, release := limited.Acquire([]string{"192.0.2.1"})
+		release()
+		close(waiting)
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	start := time.Now()
+	_, release = other.Acquire([]string{"192.0.2.3"})
+	release()
+
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("acquiring took %s while another scan was rate limited", elapsed)
+	}
+
+	<-waiting
+}
+
+func TestSchedulerIdleLimiters(t *testing.T) {
+	s := NewScheduler(1, 10)
+	b := s.NewScan()
+	defer b.Done()
+
+	for _, server := range []string{"192.0.2.1", "192.0.2.2"} {
+		_, release := b.Acquire([]string{server})
+		release()
+	}
+
+	s.mu.Lock()
+	s.limiters["192.0.2.1"].used = time.Now().Add(-2 * limiterIdle)
+	s.swept = time.Now().Add(-2 * limiterIdle)
+	s.mu.Unlock()
+
+	_, release := b.Acquire([]string{"192.0.2.3"})
+	release()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.limiters["192.0.2.1"]; ok {
+		t.Error("the idle limiter wasn't removed")
+	}
+
+	if len(s.limiters) != 2 {
+		t.Errorf("%d limiters, want 2", len(s.limiters))
+	}
+}
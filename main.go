@@ -1,55 +1,43 @@
 package main
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
 	"log"
 	"net"
 	"os"
+	"os/signal"
 	"strconv"
 	"strings"
+	"syscall"
+	"time"
 
-	ldns "github.com/lrstanley/go-ldns"
-	arg "github.com/alexflint/go-arg"
 	"github.com/kataras/go-template/html"
 	"github.com/kataras/iris"
+	"github.com/lrstanley/dnscheck/lookup"
 )
 
-// TODO: include items from public-dns.info?
 // TODO: http://stackoverflow.com/a/31627459/1830159
 // TODO: Other thoughts. Type selector,
 
-// Config represents the configuration for the app
-type Config struct {
-	Debug           bool                `arg:"-d,help:enable debugging mode"`
-	Host            string              `arg:"-h,help:host/ip for which to bind to"`
-	Port            int                 `arg:"-p,help:port which to bind to"`
-	Database        string              `arg:"help:file path to the database for dnscheck"`
-	GeoDb           string              `arg:"help:GeoIP database location"`
-	CustomResolvers []string            `arg:"-r,help:resolver to use to resolve query lookups"`
-	Resolvers       map[string][]string `arg:"-"` // underlying resolver map, created during startup
-	Concurrency     int                 `arg:"-c,help:number of records to use for resolving records"`
-	Limit           int                 `arg:"-l,help:max queries per request"`
-}
-
-// setup some defaults
-var conf = Config{
-	Debug:           false,
-	Host:            "localhost",
-	Port:            3000,
-	Database:        "dns.db",
-	GeoDb:           "geoip.db",
-	CustomResolvers: []string{},
-	Resolvers:       make(map[string][]string),
-	Concurrency:     10,
-	Limit:           500,
-}
-
 var logger *log.Logger
 
 func webLogRequest(ctx *iris.Context) {
 	logger.Printf("http: request %d from %s for: %s", ctx.ConnRequestNum(), ctx.RemoteIP(), ctx.PathString())
 
+	start := time.Now()
 	ctx.Next()
+
+	code := ctx.Response.StatusCode()
+	route := routeLabel(ctx.PathString())
+	if code == iris.StatusNotFound {
+		// don't create a new series for every path which doesn't exist.
+		route = "unmatched"
+	}
+
+	metricHTTP.Inc(ctx.MethodString(), route, strconv.Itoa(code))
+	metricHTTPDuration.ObserveSince(start, route)
 }
 
 func handleError(ctx *iris.Context) {
@@ -64,7 +52,7 @@ func handleNotFound(ctx *iris.Context) {
 func getWebContext(c *iris.Context) map[string]interface{} {
 	return iris.Map{
 		"Messages": c.GetFlashes(),
-		"Conf":     conf,
+		"Conf":     conf(),
 	}
 }
 
@@ -77,7 +65,20 @@ func saveLookup(results *DNSResults) (string, error) {
 
 	key := genWord(5, 6)
 
-	return key, db.SetStruct("records", key, results)
+	results.Created = time.Now()
+	results.Expires = retentionExpiry(results.Created)
+
+	if err = db.SetStruct("records", key, results); err != nil {
+		return "", err
+	}
+
+	// the scan is still saved if indexing fails, it just won't be found by
+	// searches.
+	if err = indexLookup(db, key, results); err != nil {
+		logger.Printf("unable to index %s: %s", key, err)
+	}
+
+	return key, nil
 }
 
 func getLookup(id string) (*DNSResults, error) {
@@ -88,28 +89,46 @@ func getLookup(id string) (*DNSResults, error) {
 	defer db.Clean()
 
 	results := &DNSResults{}
+	if err = db.GetStruct("records", id, results); err != nil {
+		return nil, err
+	}
+
+	// expired results may not have been swept yet.
+	if results.Expired(time.Now()) {
+		return nil, errors.New("results have expired")
+	}
 
-	return results, db.GetStruct("records", id, results)
+	return results, nil
 }
 
-func genResolvers() error {
-	if len(conf.CustomResolvers) == 0 {
-		// assume defaults. Google DNS, OpenDNS, and local resolvers.
-		localResolvers, err := ldns.ReadResolveConf()
-		if err != nil {
-			return err
-		}
+func saveBenchmark(results *BenchResults) (string, error) {
+	return saveReport("benchmarks", results)
+}
 
-		conf.Resolvers["Local Resolvers"] = localResolvers
-		conf.Resolvers["Google DNS"] = []string{"8.8.8.8", "8.8.4.4"}
-		conf.Resolvers["OpenDNS"] = []string{"208.67.222.222", "208.67.220.220"}
+func getBenchmark(id string) (*BenchResults, error) {
+	results := &BenchResults{}
 
-		return nil
-	}
+	return results, getReport("benchmarks", id, results)
+}
+
+func saveEmailAudit(results *EmailAudit) (string, error) {
+	return saveReport("email", results)
+}
 
-	conf.Resolvers["Custom"] = conf.CustomResolvers
+func getEmailAudit(id string) (*EmailAudit, error) {
+	results := &EmailAudit{}
 
-	return nil
+	return results, getReport("email", id, results)
+}
+
+func saveDelegation(results *DelegationReport) (string, error) {
+	return saveReport("delegation", results)
+}
+
+func getDelegation(id string) (*DelegationReport, error) {
+	results := &DelegationReport{}
+
+	return results, getReport("delegation", id, results)
 }
 
 func initWebserver() error {
@@ -129,12 +148,24 @@ func initWebserver() error {
 	funcmap["join"] = func(input []string) string {
 		return strings.Join(input, ", ")
 	}
+	funcmap["severity"] = func(severity string) string {
+		switch severity {
+		case SeverityError:
+			return "danger"
+		case SeverityWarning:
+			return "warning"
+		case SeverityInfo:
+			return "info"
+		default:
+			return "success"
+		}
+	}
 
 	iris.Config.Sessions.Cookie = "session"
 	iris.Config.LoggerOut = os.Stdout // ioutil.Discard
 	iris.Config.DisableBanner = true
 	iris.Config.Gzip = true
-	iris.Config.IsDevelopment = conf.Debug
+	iris.Config.IsDevelopment = conf().Debug
 	iris.StaticWeb("/static", "./static", 1)
 	iris.UseTemplate(html.New(html.Config{Layout: "base.html", Funcs: funcmap})).Directory("./static", ".html") //.Binary(Asset, AssetNames)
 	iris.UseFunc(webLogRequest)
@@ -153,8 +184,10 @@ func initWebserver() error {
 		input := ctx.FormValueString("hosts")
 		lookupType := ctx.FormValueString("recordtype")
 		resolvers := ctx.FormValueString("resolvers")
+		fanout := ctx.FormValueString("fanout") != "" || isGeoGroup(resolvers)
 
-		if _, ok := conf.Resolvers[resolvers]; !ok {
+		group, ok := conf().Resolvers[resolvers]
+		if !ok {
 			ctx.SetFlash("error", "Resolvers specified do not exist")
 			ctx.SetFlash("originalHosts", input)
 
@@ -162,7 +195,7 @@ func initWebserver() error {
 			return
 		}
 
-		hosts, err := parseHosts(input)
+		hosts, err := lookup.ParseHosts(input)
 		if err != nil {
 			ctx.SetFlash("originalHosts", input)
 			ctx.SetFlash("error", err.Error())
@@ -171,7 +204,7 @@ func initWebserver() error {
 			return
 		}
 
-		results, err := LookupAll(hosts, conf.Resolvers[resolvers], lookupType)
+		results, err := LookupAll(hosts, group, lookupType, fanout)
 		if err != nil {
 			ctx.SetFlash("originalHosts", input)
 			ctx.SetFlash("error", err.Error())
@@ -180,6 +213,8 @@ func initWebserver() error {
 			return
 		}
 
+		metricScans.Inc("lookup")
+
 		id, err := saveLookup(results)
 		if err != nil {
 			ctx.SetFlash("originalHosts", input)
@@ -189,9 +224,21 @@ func initWebserver() error {
 			return
 		}
 
+		notifyScan(id, results)
+
 		ctx.RedirectTo("results", id)
 	})
 
+	iris.Get("/metrics", func(ctx *iris.Context) {
+		buf := new(bytes.Buffer)
+		if err := writeMetrics(buf); err != nil {
+			ctx.Text(iris.StatusInternalServerError, err.Error())
+			return
+		}
+
+		ctx.Text(iris.StatusOK, buf.String())
+	})("metrics")
+
 	iris.Get("/r/:key", func(ctx *iris.Context) {
 		id := ctx.Param("key")
 
@@ -204,10 +251,30 @@ func initWebserver() error {
 		}
 
 		out := getWebContext(ctx)
+		out["Key"] = id
 		out["Results"] = result
 		ctx.MustRender("results.html", out)
 	})("results")
 
+	iris.Post("/r/:key/pin", func(ctx *iris.Context) {
+		if !authAdmin(ctx) {
+			return
+		}
+
+		id := ctx.Param("key")
+		pinned := ctx.FormValueString("pinned") != ""
+
+		if err := pinLookup(id, pinned); err != nil {
+			ctx.SetFlash("error", err.Error())
+		} else if pinned {
+			ctx.SetFlash("success", "The results have been pinned, and will be kept indefinitely")
+		} else {
+			ctx.SetFlash("success", "The results have been unpinned")
+		}
+
+		ctx.RedirectTo("results", id)
+	})
+
 	iris.Get("/api/:key", func(ctx *iris.Context) {
 		id := ctx.Param("key")
 
@@ -222,6 +289,165 @@ func initWebserver() error {
 		ctx.JSON(iris.StatusOK, result)
 	})("api-results")
 
+	iris.Post("/api/v1/scans", func(ctx *iris.Context) {
+		key, ok := authAPIKey(ctx, ScopeScan)
+		if !ok {
+			return
+		}
+
+		req, hosts, group, apiErr := parseScanRequest(ctx.PostBody(), key.Limit())
+		if apiErr != nil {
+			if apiErr.Problems == nil {
+				ctx.JSON(iris.StatusBadRequest, apiErr)
+				return
+			}
+
+			ctx.JSON(iris.StatusUnprocessableEntity, apiErr)
+			return
+		}
+
+		// each record type is saved as its own scan, and counts towards the
+		// daily quota of the key.
+		if err := useAPIKey(key.ID, len(req.Types)); err != nil {
+			if err == errQuotaExceeded {
+				ctx.JSON(iris.StatusTooManyRequests, &APIError{Error: err.Error()})
+				return
+			}
+
+			fmt.Println(err)
+			ctx.JSON(iris.StatusInternalServerError, &APIError{Error: "an unknown error occurred"})
+			return
+		}
+
+		job := StartScan(req, hosts, group, key)
+		ctx.SetHeader("Location", "/api/v1/scans/"+job.ID)
+		ctx.JSON(job.StatusCode(), job)
+	})("api-scans")
+
+	iris.Get("/api/v1/scans/:id", func(ctx *iris.Context) {
+		if _, ok := authAPIKey(ctx, ScopeRead); !ok {
+			return
+		}
+
+		id := ctx.Param("id")
+
+		if strings.HasPrefix(id, scanJobPrefix) {
+			job, ok := getScanJob(id)
+			if !ok {
+				ctx.JSON(iris.StatusNotFound, &APIError{Error: "a scan job with that id does not exist, or has expired"})
+				return
+			}
+
+			ctx.JSON(iris.StatusOK, job)
+			return
+		}
+
+		// jobs are only kept in memory, though the scans themselves can be
+		// fetched by their key.
+		result, err := getLookup(id)
+		if err != nil {
+			ctx.JSON(iris.StatusNotFound, &APIError{Error: "a scan with that id does not exist"})
+			return
+		}
+
+		ctx.JSON(iris.StatusOK, &ScanJob{ID: id, Status: ScanCompleted, Scans: []*SavedScan{newSavedScan(id, result)}})
+	})("api-scan")
+
+	iris.Get("/search", func(ctx *iris.Context) {
+		if !authAdmin(ctx) {
+			return
+		}
+
+		host, answer := strings.TrimSpace(ctx.URLParam("host")), strings.TrimSpace(ctx.URLParam("answer"))
+
+		out := getWebContext(ctx)
+		out["Host"], out["Answer"] = host, answer
+
+		if host != "" || answer != "" {
+			results, err := searchScans(host, answer)
+			if err != nil {
+				fmt.Println(err)
+
+				ctx.SetFlash("error", "Unable to search scans")
+				ctx.RedirectTo("search")
+				return
+			}
+
+			out["Searched"] = true
+			out["Results"] = results
+		}
+
+		ctx.MustRender("search.html", out)
+	})("search")
+
+	iris.Get("/api/v1/search", func(ctx *iris.Context) {
+		// as with the search page, this finds every scan, not just the scans
+		// of the key.
+		if _, ok := authAPIKey(ctx, ScopeSearch); !ok {
+			return
+		}
+
+		results, err := searchScans(ctx.URLParam("host"), ctx.URLParam("answer"))
+		if err == errEmptySearch {
+			ctx.JSON(iris.StatusUnprocessableEntity, &APIError{Error: "either host or answer is required"})
+			return
+		}
+
+		if err != nil {
+			fmt.Println(err)
+
+			ctx.JSON(iris.StatusInternalServerError, &APIError{Error: "an unknown error occurred"})
+			return
+		}
+
+		if results == nil {
+			results = []*SearchResult{}
+		}
+
+		ctx.JSON(iris.StatusOK, results)
+	})("api-search")
+
+	iris.Get("/export/:file", func(ctx *iris.Context) {
+		file := ctx.Param("file")
+
+		dot := strings.LastIndex(file, ".")
+		if dot < 1 {
+			ctx.JSON(iris.StatusNotFound, map[string]string{"error": "an export format must be specified, e.g. /export/<key>.csv"})
+			return
+		}
+		id, format := file[:dot], file[dot+1:]
+
+		contentType, ok := exportTypes[format]
+		if !ok {
+			ctx.JSON(iris.StatusNotFound, map[string]string{"error": "unsupported export format, must be one of csv, ndjson, md or txt"})
+			return
+		}
+
+		result, err := getLookup(id)
+		if err != nil {
+			fmt.Println(err)
+
+			ctx.JSON(iris.StatusNotFound, map[string]string{"error": "an entry with that key does not exist"})
+			return
+		}
+
+		out, err := ExportResults(result, format)
+		if err != nil {
+			fmt.Println(err)
+
+			ctx.JSON(iris.StatusInternalServerError, map[string]string{"error": "an unknown error occurred"})
+			return
+		}
+
+		if format == "csv" {
+			ctx.SetHeader("Content-Disposition", "attachment; filename=\""+file+"\"")
+		}
+
+		ctx.SetStatusCode(iris.StatusOK)
+		ctx.SetContentType(contentType)
+		ctx.Write("%s", out)
+	})("export")
+
 	iris.Get("/stats/:key", func(ctx *iris.Context) {
 		id := ctx.Param("key")
 
@@ -244,7 +470,595 @@ func initWebserver() error {
 		ctx.JSON(iris.StatusOK, stats)
 	})
 
-	listener, err := net.Listen("tcp", conf.Host+":"+strconv.Itoa(conf.Port))
+	iris.Get("/diff", func(ctx *iris.Context) {
+		a, b := strings.TrimSpace(ctx.URLParam("a")), strings.TrimSpace(ctx.URLParam("b"))
+		if a == "" || b == "" {
+			ctx.MustRender("404.html", "")
+			return
+		}
+
+		ctx.RedirectTo("diff", a, b)
+	})
+
+	iris.Get("/diff/:a/:b", func(ctx *iris.Context) {
+		a, b := ctx.Param("a"), ctx.Param("b")
+
+		before, err := getLookup(a)
+		if err != nil {
+			fmt.Println(err)
+
+			ctx.MustRender("404.html", "")
+			return
+		}
+
+		after, err := getLookup(b)
+		if err != nil {
+			fmt.Println(err)
+
+			ctx.MustRender("404.html", "")
+			return
+		}
+
+		out := getWebContext(ctx)
+		out["Diff"] = DiffResults(a, b, before, after)
+		ctx.MustRender("diff.html", out)
+	})("diff")
+
+	iris.Get("/api/diff/:a/:b", func(ctx *iris.Context) {
+		a, b := ctx.Param("a"), ctx.Param("b")
+
+		before, err := getLookup(a)
+		if err != nil {
+			fmt.Println(err)
+
+			ctx.JSON(iris.StatusNotFound, map[string]string{"error": "an entry with key " + a + " does not exist"})
+			return
+		}
+
+		after, err := getLookup(b)
+		if err != nil {
+			fmt.Println(err)
+
+			ctx.JSON(iris.StatusNotFound, map[string]string{"error": "an entry with key " + b + " does not exist"})
+			return
+		}
+
+		ctx.JSON(iris.StatusOK, DiffResults(a, b, before, after))
+	})("api-diff")
+
+	iris.Get("/bench", func(ctx *iris.Context) {
+		ctx.MustRender("bench.html", getWebContext(ctx))
+	})("bench")
+
+	iris.Post("/bench", func(ctx *iris.Context) {
+		// a benchmark sends dozens of queries to every resolver.
+		if !authAdmin(ctx) {
+			return
+		}
+
+		results, err := BenchmarkResolvers(conf().Resolvers)
+		if err != nil {
+			ctx.SetFlash("error", err.Error())
+
+			ctx.MustRender("bench.html", getWebContext(ctx))
+			return
+		}
+
+		id, err := saveBenchmark(results)
+		if err != nil {
+			ctx.SetFlash("error", err.Error())
+
+			ctx.MustRender("bench.html", getWebContext(ctx))
+			return
+		}
+
+		ctx.RedirectTo("bench-results", id)
+	})
+
+	iris.Get("/b/:key", func(ctx *iris.Context) {
+		id := ctx.Param("key")
+
+		result, err := getBenchmark(id)
+		if err != nil {
+			fmt.Println(err)
+
+			ctx.MustRender("404.html", "")
+			return
+		}
+
+		out := getWebContext(ctx)
+		out["Bench"] = result
+		ctx.MustRender("bench.html", out)
+	})("bench-results")
+
+	iris.Get("/api/bench/:key", func(ctx *iris.Context) {
+		id := ctx.Param("key")
+
+		result, err := getBenchmark(id)
+		if err != nil {
+			fmt.Println(err)
+
+			ctx.JSON(iris.StatusNotFound, map[string]string{"error": "an entry with that key does not exist"})
+			return
+		}
+
+		ctx.JSON(iris.StatusOK, result)
+	})("api-bench")
+
+	iris.Get("/email", func(ctx *iris.Context) {
+		ctx.MustRender("email.html", getWebContext(ctx))
+	})("email")
+
+	iris.Post("/email", func(ctx *iris.Context) {
+		input := ctx.FormValueString("domains")
+		selectorInput := ctx.FormValueString("selectors")
+		resolvers := ctx.FormValueString("resolvers")
+
+		fail := func(err string) {
+			ctx.SetFlash("originalHosts", input)
+			ctx.SetFlash("originalSelectors", selectorInput)
+			ctx.SetFlash("error", err)
+
+			ctx.MustRender("email.html", getWebContext(ctx))
+		}
+
+		group, ok := conf().Resolvers[resolvers]
+		if !ok {
+			fail("Resolvers specified do not exist")
+			return
+		}
+
+		domains, err := lookup.ParseHosts(input)
+		if err != nil {
+			fail(err.Error())
+			return
+		}
+
+		selectors, err := parseSelectors(selectorInput)
+		if err != nil {
+			fail(err.Error())
+			return
+		}
+
+		results, err := AuditEmail(domains, selectors, group)
+		if err != nil {
+			fail(err.Error())
+			return
+		}
+
+		id, err := saveEmailAudit(results)
+		if err != nil {
+			fail(err.Error())
+			return
+		}
+
+		ctx.RedirectTo("email-results", id)
+	})
+
+	iris.Get("/e/:key", func(ctx *iris.Context) {
+		id := ctx.Param("key")
+
+		result, err := getEmailAudit(id)
+		if err != nil {
+			fmt.Println(err)
+
+			ctx.MustRender("404.html", "")
+			return
+		}
+
+		out := getWebContext(ctx)
+		out["Audit"] = result
+		ctx.MustRender("email.html", out)
+	})("email-results")
+
+	iris.Get("/api/email/:key", func(ctx *iris.Context) {
+		id := ctx.Param("key")
+
+		result, err := getEmailAudit(id)
+		if err != nil {
+			fmt.Println(err)
+
+			ctx.JSON(iris.StatusNotFound, map[string]string{"error": "an entry with that key does not exist"})
+			return
+		}
+
+		ctx.JSON(iris.StatusOK, result)
+	})("api-email")
+
+	iris.Get("/delegation", func(ctx *iris.Context) {
+		ctx.MustRender("delegation.html", getWebContext(ctx))
+	})("delegation")
+
+	iris.Post("/delegation", func(ctx *iris.Context) {
+		input := ctx.FormValueString("domains")
+		resolvers := ctx.FormValueString("resolvers")
+
+		fail := func(err string) {
+			ctx.SetFlash("originalHosts", input)
+			ctx.SetFlash("error", err)
+
+			ctx.MustRender("delegation.html", getWebContext(ctx))
+		}
+
+		group, ok := conf().Resolvers[resolvers]
+		if !ok {
+			fail("Resolvers specified do not exist")
+			return
+		}
+
+		domains, err := lookup.ParseHosts(input)
+		if err != nil {
+			fail(err.Error())
+			return
+		}
+
+		results, err := CheckDelegations(domains, group)
+		if err != nil {
+			fail(err.Error())
+			return
+		}
+
+		id, err := saveDelegation(results)
+		if err != nil {
+			fail(err.Error())
+			return
+		}
+
+		ctx.RedirectTo("delegation-results", id)
+	})
+
+	iris.Get("/d/:key", func(ctx *iris.Context) {
+		id := ctx.Param("key")
+
+		result, err := getDelegation(id)
+		if err != nil {
+			fmt.Println(err)
+
+			ctx.MustRender("404.html", "")
+			return
+		}
+
+		out := getWebContext(ctx)
+		out["Report"] = result
+		ctx.MustRender("delegation.html", out)
+	})("delegation-results")
+
+	iris.Get("/api/delegation/:key", func(ctx *iris.Context) {
+		id := ctx.Param("key")
+
+		result, err := getDelegation(id)
+		if err != nil {
+			fmt.Println(err)
+
+			ctx.JSON(iris.StatusNotFound, map[string]string{"error": "an entry with that key does not exist"})
+			return
+		}
+
+		ctx.JSON(iris.StatusOK, result)
+	})("api-delegation")
+
+	iris.Get("/monitors", func(ctx *iris.Context) {
+		out := getWebContext(ctx)
+		out["RecordTypes"] = recordTypes
+
+		monitors, err := listMonitors()
+		if err != nil {
+			fmt.Println(err)
+		}
+		out["Monitors"] = monitors
+
+		ctx.MustRender("monitors.html", out)
+	})("monitors")
+
+	iris.Post("/monitors", func(ctx *iris.Context) {
+		if !authAdmin(ctx) {
+			return
+		}
+
+		name := strings.TrimSpace(ctx.FormValueString("name"))
+		input := ctx.FormValueString("hosts")
+		schedule := strings.TrimSpace(ctx.FormValueString("schedule"))
+
+		var types []string
+		for _, rtype := range recordTypes {
+			if ctx.FormValueString("type-"+rtype) != "" {
+				types = append(types, rtype)
+			}
+		}
+
+		fail := func(err string) {
+			ctx.SetFlash("originalHosts", input)
+			ctx.SetFlash("error", err)
+
+			ctx.RedirectTo("monitors")
+		}
+
+		if _, err := getMonitor(name); err == nil {
+			fail("A monitor with that name already exists")
+			return
+		}
+
+		m, err := newMonitor(name, input, types, ctx.FormValueString("resolvers"), ctx.FormValueString("fanout") != "", schedule)
+		if err != nil {
+			fail(err.Error())
+			return
+		}
+
+		if err = saveMonitor(m); err != nil {
+			fail(err.Error())
+			return
+		}
+
+		ctx.RedirectTo("monitor", m.Name)
+	})
+
+	iris.Get("/m/:name", func(ctx *iris.Context) {
+		name := ctx.Param("name")
+
+		m, err := getMonitor(name)
+		if err != nil {
+			fmt.Println(err)
+
+			ctx.MustRender("404.html", "")
+			return
+		}
+
+		runs, err := getMonitorRuns(name)
+		if err != nil {
+			fmt.Println(err)
+		}
+
+		out := getWebContext(ctx)
+		out["Monitor"] = m
+		out["Runs"] = runs
+		ctx.MustRender("monitor.html", out)
+	})("monitor")
+
+	iris.Post("/m/:name/run", func(ctx *iris.Context) {
+		if !authAdmin(ctx) {
+			return
+		}
+
+		name := ctx.Param("name")
+
+		m, err := getMonitor(name)
+		if err != nil {
+			ctx.MustRender("404.html", "")
+			return
+		}
+
+		if m.APIKey != "" {
+			ctx.SetFlash("error", errMonitorAPIKey.Error())
+			ctx.RedirectTo("monitor", name)
+			return
+		}
+
+		go runMonitor(name, false)
+
+		ctx.SetFlash("success", "The monitor is running, refresh in a moment to see the results")
+		ctx.RedirectTo("monitor", name)
+	})
+
+	iris.Post("/m/:name/delete", func(ctx *iris.Context) {
+		if !authAdmin(ctx) {
+			return
+		}
+
+		name := ctx.Param("name")
+
+		m, err := getMonitor(name)
+		if err != nil {
+			ctx.MustRender("404.html", "")
+			return
+		}
+
+		if m.APIKey != "" {
+			ctx.SetFlash("error", errMonitorAPIKey.Error())
+			ctx.RedirectTo("monitor", name)
+			return
+		}
+
+		if err = deleteMonitor(name); err != nil {
+			ctx.SetFlash("error", err.Error())
+		}
+
+		ctx.RedirectTo("monitors")
+	})
+
+	iris.Get("/api/v1/monitors", func(ctx *iris.Context) {
+		if _, ok := authAPIKey(ctx, ScopeRead); !ok {
+			return
+		}
+
+		monitors, err := listMonitors()
+		if err != nil {
+			fmt.Println(err)
+
+			ctx.JSON(iris.StatusInternalServerError, &APIError{Error: "an unknown error occurred"})
+			return
+		}
+
+		ctx.JSON(iris.StatusOK, monitors)
+	})("api-v1-monitors")
+
+	iris.Post("/api/v1/monitors", func(ctx *iris.Context) {
+		key, ok := authAPIKey(ctx, ScopeMonitors)
+		if !ok {
+			return
+		}
+
+		m, apiErr := parseMonitorRequest(ctx.PostBody(), key)
+		if apiErr != nil {
+			if apiErr.Problems == nil {
+				ctx.JSON(iris.StatusBadRequest, apiErr)
+				return
+			}
+
+			ctx.JSON(iris.StatusUnprocessableEntity, apiErr)
+			return
+		}
+
+		if _, err := getMonitor(m.Name); err == nil {
+			ctx.JSON(iris.StatusConflict, &APIError{Error: "a monitor with that name already exists"})
+			return
+		}
+
+		if err := saveMonitor(m); err != nil {
+			fmt.Println(err)
+
+			ctx.JSON(iris.StatusInternalServerError, &APIError{Error: "an unknown error occurred"})
+			return
+		}
+
+		ctx.SetHeader("Location", "/api/v1/monitors/"+m.Name)
+		ctx.JSON(iris.StatusCreated, m)
+	})
+
+	iris.Get("/api/v1/monitors/:name", func(ctx *iris.Context) {
+		if _, ok := authAPIKey(ctx, ScopeRead); !ok {
+			return
+		}
+
+		name := ctx.Param("name")
+
+		m, err := getMonitor(name)
+		if err != nil {
+			ctx.JSON(iris.StatusNotFound, &APIError{Error: "a monitor with that name does not exist"})
+			return
+		}
+
+		runs, err := getMonitorRuns(name)
+		if err != nil {
+			fmt.Println(err)
+
+			ctx.JSON(iris.StatusInternalServerError, &APIError{Error: "an unknown error occurred"})
+			return
+		}
+
+		ctx.JSON(iris.StatusOK, map[string]interface{}{"monitor": m, "runs": runs})
+	})("api-v1-monitor")
+
+	iris.Delete("/api/v1/monitors/:name", func(ctx *iris.Context) {
+		if _, ok := authAPIKey(ctx, ScopeMonitors); !ok {
+			return
+		}
+
+		name := ctx.Param("name")
+
+		if _, err := getMonitor(name); err != nil {
+			ctx.JSON(iris.StatusNotFound, &APIError{Error: "a monitor with that name does not exist"})
+			return
+		}
+
+		if err := deleteMonitor(name); err != nil {
+			fmt.Println(err)
+
+			ctx.JSON(iris.StatusInternalServerError, &APIError{Error: "an unknown error occurred"})
+			return
+		}
+
+		ctx.SetStatusCode(iris.StatusNoContent)
+	})
+
+	iris.Get("/admin/keys", func(ctx *iris.Context) {
+		if !authAdmin(ctx) {
+			return
+		}
+
+		keys, err := listAPIKeys()
+		if err != nil {
+			fmt.Println(err)
+		}
+
+		out := getWebContext(ctx)
+		out["Keys"] = keys
+		out["Scopes"] = apiScopes
+		ctx.MustRender("admin_keys.html", out)
+	})("admin-keys")
+
+	iris.Post("/admin/keys", func(ctx *iris.Context) {
+		if !authAdmin(ctx) {
+			return
+		}
+
+		var scopes []string
+		for _, scope := range apiScopes {
+			if ctx.FormValueString("scope-"+scope) != "" {
+				scopes = append(scopes, scope)
+			}
+		}
+
+		maxHosts, _ := strconv.Atoi(strings.TrimSpace(ctx.FormValueString("max_hosts")))
+		dailyScans, _ := strconv.Atoi(strings.TrimSpace(ctx.FormValueString("daily_scans")))
+
+		key, token, err := createAPIKey(ctx.FormValueString("name"), scopes, maxHosts, dailyScans)
+		if err != nil {
+			ctx.SetFlash("error", err.Error())
+			ctx.RedirectTo("admin-keys")
+			return
+		}
+
+		keys, err := listAPIKeys()
+		if err != nil {
+			fmt.Println(err)
+		}
+
+		// the token is rendered directly rather than through a flash, as it
+		// is never shown again.
+		out := getWebContext(ctx)
+		out["Keys"] = keys
+		out["Scopes"] = apiScopes
+		out["Created"] = key
+		out["Token"] = token
+		ctx.MustRender("admin_keys.html", out)
+	})
+
+	iris.Post("/admin/keys/:id/revoke", func(ctx *iris.Context) {
+		if !authAdmin(ctx) {
+			return
+		}
+
+		if err := revokeAPIKey(ctx.Param("id")); err != nil {
+			ctx.SetFlash("error", err.Error())
+		} else {
+			ctx.SetFlash("success", "The api key has been revoked")
+		}
+
+		ctx.RedirectTo("admin-keys")
+	})
+
+	iris.Get("/webhooks", func(ctx *iris.Context) {
+		if !authAdmin(ctx) {
+			return
+		}
+
+		deliveries, err := getWebhookDeliveries()
+		if err != nil {
+			fmt.Println(err)
+		}
+
+		out := getWebContext(ctx)
+		out["Deliveries"] = deliveries
+		ctx.MustRender("webhooks.html", out)
+	})("webhooks")
+
+	iris.Get("/api/webhooks", func(ctx *iris.Context) {
+		if _, ok := authAPIKey(ctx, ScopeRead); !ok {
+			return
+		}
+
+		deliveries, err := getWebhookDeliveries()
+		if err != nil {
+			fmt.Println(err)
+
+			ctx.JSON(iris.StatusInternalServerError, map[string]string{"error": "an unknown error occurred"})
+			return
+		}
+
+		ctx.JSON(iris.StatusOK, deliveries)
+	})("api-webhooks")
+
+	listener, err := net.Listen("tcp", conf().Host+":"+strconv.Itoa(conf().Port))
 	if err != nil {
 		return err
 	}
@@ -252,24 +1066,83 @@ func initWebserver() error {
 	return iris.Serve(listener)
 }
 
+// shutdownOnSignal stops the webserver and closes the database (once any
+// in-flight queries have finished) when SIGINT or SIGTERM is received, then
+// exits. It should be ran within a goroutine.
+func shutdownOnSignal() {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+
+	logger.Printf("received %s, shutting down", <-sig)
+
+	if err := iris.Close(); err != nil {
+		logger.Println("unable to stop the webserver:", err)
+	}
+
+	if err := closeDatabase(); err != nil {
+		logger.Println("unable to close the database:", err)
+		os.Exit(1)
+	}
+
+	os.Exit(0)
+}
+
 func main() {
-	// initialize app flags
-	arg.MustParse(&conf)
+	// subcommands run without the webserver, e.g. "dnscheck apikey list".
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "lookup":
+			os.Exit(lookupCommand(os.Args[2:]))
+		case "apikey":
+			if err := apikeyCommand(os.Args[2:]); err != nil {
+				fmt.Fprintln(os.Stderr, "error:", err)
+				os.Exit(1)
+			}
+
+			return
+		}
+	}
 
 	// initialize logger
 	logger = log.New(os.Stdout, "", log.Lshortfile|log.LstdFlags)
 	logger.Println("initializing logger")
 
-	// initialize the database
+	// initialize app configuration (file, environment, and flags)
+	c, err := loadConfig()
+	if err != nil {
+		logger.Fatal(err)
+	}
+	setConf(c)
+
+	// initialize the database, and close it cleanly on shutdown
 	initDatabase()
+	go shutdownOnSignal()
+
+	// initialize the query scheduler, shared between all scans (including the
+	// probes of the resolvers)
+	scheduler = lookup.NewScheduler(c.MaxInflight, c.ResolverQPS)
 
 	// initialize the resolvers
-	if err := genResolvers(); err != nil {
+	if err := genResolvers(c); err != nil {
 		logger.Fatal(err)
 	}
 
 	// check for geoip updates (once a week is good 'nuff)
-	GeoIPUpdateCheck(conf.GeoDb)
+	if !c.NoGeoUpdate {
+		GeoIPUpdateCheck(c.GeoDb)
+	}
+
+	// geolocate the resolvers, and group them by region
+	genGeoResolvers(c)
+
+	// reload the configuration on SIGHUP, or when it changes
+	go watchConfig()
+
+	// re-run the saved monitors on their schedules
+	go runMonitors()
+
+	// remove expired results, and compact the database
+	go runSweeper()
 
 	// initialize webserver
 	if err := initWebserver(); err != nil {
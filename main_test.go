@@ -0,0 +1,30 @@
+package main
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+	"testing"
+)
+
+func TestMain(m *testing.M) {
+	logger = log.New(ioutil.Discard, "", 0)
+
+	os.Exit(m.Run())
+}
+
+// useMemoryStore replaces the shared database handle with an empty memory
+// store, returning a func which restores it, e.g.
+// "defer useMemoryStore()()".
+func useMemoryStore() (restore func()) {
+	dbLock.Lock()
+	prev := sharedDB
+	sharedDB = &DB{store: newMemoryStore()}
+	dbLock.Unlock()
+
+	return func() {
+		dbLock.Lock()
+		sharedDB = prev
+		dbLock.Unlock()
+	}
+}
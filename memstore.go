@@ -0,0 +1,161 @@
+package main
+
+import (
+	"sort"
+	"strings"
+	"sync"
+)
+
+// memoryStore keeps everything in memory, so nothing is kept once dnscheck
+// exits. It's useful for tests, and ephemeral deployments.
+type memoryStore struct {
+	mu      sync.RWMutex
+	buckets map[string]map[string][]byte
+}
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{buckets: make(map[string]map[string][]byte)}
+}
+
+func (s *memoryStore) Get(bucket, key string) ([]byte, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if value, ok := s.buckets[bucket][key]; ok {
+		return append([]byte{}, value...), nil
+	}
+
+	return nil, nil
+}
+
+// put sets the value of key. s.mu must be held.
+func (s *memoryStore) put(bucket, key string, value []byte) {
+	if s.buckets[bucket] == nil {
+		s.buckets[bucket] = make(map[string][]byte)
+	}
+
+	s.buckets[bucket][key] = append([]byte{}, value...)
+}
+
+func (s *memoryStore) Put(bucket, key string, value []byte) error {
+	s.mu.Lock()
+	s.put(bucket, key, value)
+	s.mu.Unlock()
+
+	return nil
+}
+
+func (s *memoryStore) PutMany(bucket string, values map[string][]byte) error {
+	s.mu.Lock()
+	for key, value := range values {
+		s.put(bucket, key, value)
+	}
+	s.mu.Unlock()
+
+	return nil
+}
+
+func (s *memoryStore) Update(bucket, key string, fn func(value []byte) ([]byte, error)) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var current []byte
+	if value, ok := s.buckets[bucket][key]; ok {
+		current = append([]byte{}, value...)
+	}
+
+	value, err := fn(current)
+	if err != nil {
+		return err
+	}
+
+	s.put(bucket, key, value)
+
+	return nil
+}
+
+func (s *memoryStore) Delete(bucket, key string) error {
+	s.mu.Lock()
+	delete(s.buckets[bucket], key)
+	s.mu.Unlock()
+
+	return nil
+}
+
+func (s *memoryStore) DeleteMany(bucket string, keys []string) error {
+	s.mu.Lock()
+	for _, key := range keys {
+		delete(s.buckets[bucket], key)
+	}
+	s.mu.Unlock()
+
+	return nil
+}
+
+func (s *memoryStore) DeletePrefix(bucket, prefix string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for key := range s.buckets[bucket] {
+		if strings.HasPrefix(key, prefix) {
+			delete(s.buckets[bucket], key)
+		}
+	}
+
+	return nil
+}
+
+// keys returns the keys on bucket starting with prefix, in key order.
+func (s *memoryStore) keys(bucket, prefix string) (out []string) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for key := range s.buckets[bucket] {
+		if strings.HasPrefix(key, prefix) {
+			out = append(out, key)
+		}
+	}
+	sort.Strings(out)
+
+	return out
+}
+
+// ForEach doesn't hold the lock while calling fn, so keys added or removed
+// during the iteration may or may not be seen.
+func (s *memoryStore) ForEach(bucket, prefix string, fn func(key string, value []byte) error) error {
+	for _, key := range s.keys(bucket, prefix) {
+		value, _ := s.Get(bucket, key)
+		if value == nil {
+			continue // removed during the iteration.
+		}
+
+		if err := fn(key, value); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (s *memoryStore) ForEachReverse(bucket, prefix string, n int, fn func(key string, value []byte) error) error {
+	keys := s.keys(bucket, prefix)
+
+	for i, sent := len(keys)-1, 0; i >= 0 && (n <= 0 || sent < n); i-- {
+		value, _ := s.Get(bucket, keys[i])
+		if value == nil {
+			continue // removed during the iteration.
+		}
+
+		if err := fn(keys[i], value); err != nil {
+			return err
+		}
+		sent++
+	}
+
+	return nil
+}
+
+// Close does nothing, as there's nothing to close.
+func (s *memoryStore) Close() error {
+	return nil
+}
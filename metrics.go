@@ -0,0 +1,278 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// latencyBuckets are the histogram buckets (in seconds) used for query,
+// database and http latencies.
+var latencyBuckets = []float64{0.001, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+var (
+	metricScans = newCounterVec("dnscheck_scans_total",
+		"Scans ran, by kind.", "kind")
+	metricQueries = newCounterVec("dnscheck_queries_total",
+		"DNS queries sent, by resolver (or authoritative, for queries sent to nameservers directly) and rcode (or error, if no response was received).", "resolver", "rcode")
+	metricQueryDuration = newHistogramVec("dnscheck_query_duration_seconds",
+		"Round trip time of DNS queries which received a response, by resolver (or authoritative).", latencyBuckets, "resolver")
+	metricGeoIP = newCounterVec("dnscheck_geoip_lookups_total",
+		"GeoIP lookups, by result.", "result")
+	metricDB = newCounterVec("dnscheck_db_operations_total",
+		"Database operations, by operation, bucket and result.", "op", "bucket", "result")
+	metricDBDuration = newHistogramVec("dnscheck_db_operation_duration_seconds",
+		"Duration of database operations, by operation.", latencyBuckets, "op")
+	metricHTTP = newCounterVec("dnscheck_http_requests_total",
+		"HTTP requests, by method, route and status code.", "method", "route", "code")
+	metricHTTPDuration = newHistogramVec("dnscheck_http_request_duration_seconds",
+		"Duration of HTTP requests, by route.", latencyBuckets, "route")
+)
+
+// metricWriter is anything which can be written in the prometheus text
+// exposition format.
+type metricWriter interface {
+	writeMetric(w io.Writer)
+}
+
+// registry is every metric written to /metrics, in order.
+var registry = []metricWriter{
+	metricScans, metricQueries, metricQueryDuration, metricGeoIP,
+	metricDB, metricDBDuration, metricHTTP, metricHTTPDuration,
+	monitorMetrics{},
+}
+
+// labelKey joins label values into a single map key.
+func labelKey(values []string) string {
+	return strings.Join(values, "\xff")
+}
+
+// escapeLabel escapes a label value.
+func escapeLabel(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value)
+}
+
+// formatLabels returns the labels of a series, e.g. {a="b",c="d"}. extra is
+// appended as-is (e.g. the le label of a histogram bucket).
+func formatLabels(names []string, key string, extra string) string {
+	var pairs []string
+
+	if len(names) > 0 {
+		values := strings.Split(key, "\xff")
+		for i, name := range names {
+			pairs = append(pairs, name+`="`+escapeLabel(values[i])+`"`)
+		}
+	}
+
+	if extra != "" {
+		pairs = append(pairs, extra)
+	}
+
+	if len(pairs) == 0 {
+		return ""
+	}
+
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatFloat(v float64) string {
+	if math.IsInf(v, 1) {
+		return "+Inf"
+	}
+
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// counterVec is a counter, partitioned by labels.
+type counterVec struct {
+	name   string
+	help   string
+	labels []string
+
+	mu     sync.Mutex
+	series map[string]float64
+}
+
+func newCounterVec(name, help string, labels ...string) *counterVec {
+	return &counterVec{name: name, help: help, labels: labels, series: make(map[string]float64)}
+}
+
+// Inc increments the counter with the given label values by 1.
+func (c *counterVec) Inc(values ...string) {
+	c.mu.Lock()
+	c.series[labelKey(values)]++
+	c.mu.Unlock()
+}
+
+func (c *counterVec) writeMetric(w io.Writer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", c.name, c.help, c.name)
+
+	keys := make([]string, 0, len(c.series))
+	for key := range c.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		fmt.Fprintf(w, "%s%s %s\n", c.name, formatLabels(c.labels, key, ""), formatFloat(c.series[key]))
+	}
+}
+
+// histogram is a single series of a histogramVec.
+type histogram struct {
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+// histogramVec is a histogram, partitioned by labels.
+type histogramVec struct {
+	name    string
+	help    string
+	labels  []string
+	buckets []float64
+
+	mu     sync.Mutex
+	series map[string]*histogram
+}
+
+func newHistogramVec(name, help string, buckets []float64, labels ...string) *histogramVec {
+	return &histogramVec{name: name, help: help, labels: labels, buckets: buckets, series: make(map[string]*histogram)}
+}
+
+// Observe adds a single observation to the histogram with the given label
+// values.
+func (h *histogramVec) Observe(v float64, values ...string) {
+	key := labelKey(values)
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	s, ok := h.series[key]
+	if !ok {
+		s = &histogram{counts: make([]uint64, len(h.buckets))}
+		h.series[key] = s
+	}
+
+	for i, upper := range h.buckets {
+		if v <= upper {
+			s.counts[i]++
+		}
+	}
+	s.count++
+	s.sum += v
+}
+
+// ObserveSince observes the time elapsed since start, in seconds.
+func (h *histogramVec) ObserveSince(start time.Time, values ...string) {
+	h.Observe(time.Since(start).Seconds(), values...)
+}
+
+func (h *histogramVec) writeMetric(w io.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", h.name, h.help, h.name)
+
+	keys := make([]string, 0, len(h.series))
+	for key := range h.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		s := h.series[key]
+
+		for i, upper := range h.buckets {
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, formatLabels(h.labels, key, `le="`+formatFloat(upper)+`"`), s.counts[i])
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, formatLabels(h.labels, key, `le="+Inf"`), s.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, formatLabels(h.labels, key, ""), formatFloat(s.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, formatLabels(h.labels, key, ""), s.count)
+	}
+}
+
+// monitorMetrics exports the result of the most recent run of each monitor.
+// They are read from the database when scraped.
+type monitorMetrics struct{}
+
+func (monitorMetrics) writeMetric(w io.Writer) {
+	monitors, err := listMonitors()
+	if err != nil {
+		logger.Printf("metrics: unable to list monitors: %s", err)
+		return
+	}
+
+	ratio := "# HELP dnscheck_monitor_match_ratio Ratio (0-1) of answers which matched in the most recent run of each monitor.\n# TYPE dnscheck_monitor_match_ratio gauge\n"
+	errRatio := "# HELP dnscheck_monitor_error_ratio Ratio (0-1) of lookups which failed in the most recent run of each monitor.\n# TYPE dnscheck_monitor_error_ratio gauge\n"
+	last := "# HELP dnscheck_monitor_last_run_timestamp_seconds Time of the most recent run of each monitor.\n# TYPE dnscheck_monitor_last_run_timestamp_seconds gauge\n"
+
+	for _, m := range monitors {
+		run, err := getLastMonitorRun(m.Name)
+		if err != nil || run == nil {
+			continue
+		}
+
+		labels := formatLabels([]string{"monitor"}, m.Name, "")
+		ratio += fmt.Sprintf("dnscheck_monitor_match_ratio%s %s\n", labels, formatFloat(run.MatchRate()/100))
+		last += fmt.Sprintf("dnscheck_monitor_last_run_timestamp_seconds%s %d\n", labels, run.Time.Unix())
+
+		if run.Total > 0 {
+			errRatio += fmt.Sprintf("dnscheck_monitor_error_ratio%s %s\n", labels, formatFloat(float64(run.Errors)/float64(run.Total)))
+		}
+	}
+
+	io.WriteString(w, ratio+errRatio+last)
+}
+
+// writeMetrics writes every metric in the prometheus text exposition format.
+func writeMetrics(w io.Writer) error {
+	buf := bufio.NewWriter(w)
+
+	for _, m := range registry {
+		m.writeMetric(buf)
+	}
+
+	return buf.Flush()
+}
+
+// observeQuery records a query sent to server.
+func observeQuery(server string, resp *dns.Msg, rtt time.Duration, err error) {
+	if err != nil || resp == nil {
+		metricQueries.Inc(server, "error")
+		return
+	}
+
+	metricQueries.Inc(server, dns.RcodeToString[resp.Rcode])
+	metricQueryDuration.Observe(rtt.Seconds(), server)
+}
+
+// observeDB records a database operation which started at start.
+func observeDB(op, bucket string, start time.Time, err error) {
+	result := "ok"
+	if err != nil {
+		result = "error"
+	}
+
+	metricDB.Inc(op, bucket, result)
+	metricDBDuration.ObserveSince(start, op)
+}
+
+// routeLabel returns the first segment of path, so the route label doesn't
+// contain scan keys.
+func routeLabel(path string) string {
+	segments := strings.SplitN(strings.TrimPrefix(path, "/"), "/", 2)
+
+	return "/" + segments[0]
+}
@@ -0,0 +1,278 @@
+package main
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+
+	"github.com/boltdb/bolt"
+)
+
+// schemaVersion is the version of the storage format written by this build.
+// Every record is stored with the version it was written with, and
+// migrations bring older records up to date when the database is opened.
+const schemaVersion = 1
+
+// metaBucket holds information about the database itself, e.g. the version
+// of the storage format (under metaSchemaKey).
+const (
+	metaBucket    = "meta"
+	metaSchemaKey = "schema"
+)
+
+// quarantineBucket holds the records a migration was unable to convert, as
+// they were before the migration, under "<bucket>/<key>". It's only created
+// if needed.
+const quarantineBucket = "quarantine"
+
+var errRecordNotFound = errors.New("record does not exist")
+
+// record is how every struct is stored: the struct encoded as json, and the
+// version of the storage format it was written with.
+type record struct {
+	Version int             `json:"v"`
+	Data    json.RawMessage `json:"data"`
+}
+
+// encodeRecord encodes data as a record of the current version.
+func encodeRecord(data interface{}) ([]byte, error) {
+	raw, err := json.Marshal(data)
+	if err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(&record{Version: schemaVersion, Data: raw})
+}
+
+// decodeRecord decodes a record (see encodeRecord) into input.
+func decodeRecord(data []byte, input interface{}) error {
+	if len(data) == 0 {
+		return errRecordNotFound
+	}
+
+	rec := &record{}
+	if err := json.Unmarshal(data, rec); err != nil || rec.Version == 0 {
+		return errors.New("unable to decode record, it's of an unknown format")
+	}
+
+	if rec.Version != schemaVersion {
+		return fmt.Errorf("unable to decode record of version %d, expected version %d", rec.Version, schemaVersion)
+	}
+
+	return json.Unmarshal(rec.Data, input)
+}
+
+// migration upgrades the database from the previous version to Version.
+// Each migration is ran within a single transaction, along with recording
+// the new version, so it either completes or leaves the database as it was.
+type migration struct {
+	Version int
+	Name    string
+	Migrate func(tx *bolt.Tx) error
+}
+
+// migrations must be in order, with one for each version up to
+// schemaVersion.
+var migrations = []migration{
+	{Version: 1, Name: "convert gob records to json", Migrate: migrateGobToJSON},
+}
+
+// bucketTypes returns a new value of the struct stored within each bucket.
+var bucketTypes = map[string]func() interface{}{
+	"records":      func() interface{} { return &DNSResults{} },
+	"benchmarks":   func() interface{} { return &BenchResults{} },
+	"email":        func() interface{} { return &EmailAudit{} },
+	"delegation":   func() interface{} { return &DelegationReport{} },
+	"monitors":     func() interface{} { return &Monitor{} },
+	"monitor-runs": func() interface{} { return &MonitorRun{} },
+	"webhooks":     func() interface{} { return &WebhookDelivery{} },
+	"apikeys":      func() interface{} { return &APIKey{} },
+}
+
+// migrateRecords calls fn with every record on bucket name, replacing the
+// record with what fn returns. If fn returns nil, the record is kept as-is.
+// If fn returns an error, the record is moved to quarantineBucket, so it
+// isn't left in a format nothing can read.
+func migrateRecords(tx *bolt.Tx, name string, fn func(key string, data []byte) ([]byte, error)) error {
+	b, err := bucket(tx, name)
+	if err != nil {
+		return err
+	}
+
+	// records can't be replaced while iterating, so collect them first.
+	updated := make(map[string][]byte)
+	failed := make(map[string][]byte)
+	err = b.ForEach(func(k, v []byte) error {
+		out, err := fn(string(k), v)
+		if err != nil {
+			logger.Printf("migrate: unable to convert %s/%s, moving it to the %s bucket: %s", name, k, quarantineBucket, err)
+			failed[string(k)] = append([]byte{}, v...)
+			return nil
+		}
+
+		if out != nil {
+			updated[string(k)] = out
+		}
+
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for key, data := range updated {
+		if err = b.Put([]byte(key), data); err != nil {
+			return err
+		}
+	}
+
+	if len(failed) == 0 {
+		return nil
+	}
+
+	quarantine, err := tx.CreateBucketIfNotExists([]byte(quarantineBucket))
+	if err != nil {
+		return err
+	}
+
+	for key, data := range failed {
+		if err = quarantine.Put([]byte(name+"/"+key), data); err != nil {
+			return err
+		}
+
+		if err = b.Delete([]byte(key)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// migrateGobToJSON converts every record from gob (which records were
+// stored as before versioning was added) into json.
+func migrateGobToJSON(tx *bolt.Tx) error {
+	for name, newType := range bucketTypes {
+		err := migrateRecords(tx, name, func(key string, data []byte) ([]byte, error) {
+			input := newType()
+			if err := gob.NewDecoder(bytes.NewReader(data)).Decode(input); err != nil {
+				return nil, err
+			}
+
+			return encodeRecord(input)
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// schemaOf returns the version of the storage format of the database, which
+// is 0 for databases created before versioning was added.
+func schemaOf(tx *bolt.Tx) (int, error) {
+	b, err := bucket(tx, metaBucket)
+	if err != nil {
+		return 0, err
+	}
+
+	raw := b.Get([]byte(metaSchemaKey))
+	if raw == nil {
+		return 0, nil
+	}
+
+	return strconv.Atoi(string(raw))
+}
+
+// isEmpty returns true if there are no records in the database.
+func isEmpty(db *bolt.DB) bool {
+	empty := true
+
+	db.View(func(tx *bolt.Tx) error {
+		for name := range bucketTypes {
+			if b := tx.Bucket([]byte(name)); b != nil {
+				if k, _ := b.Cursor().First(); k != nil {
+					empty = false
+				}
+			}
+		}
+
+		return nil
+	})
+
+	return empty
+}
+
+// migrateDatabase runs each migration the bolt database hasn't had yet (the
+// other stores were added after versioning, so only bolt databases have to
+// be migrated). Before anything is changed, a copy of the database is saved
+// next to it, e.g. "dns.db.v0.bak".
+func migrateDatabase(db *bolt.DB) error {
+	var version int
+	err := db.View(func(tx *bolt.Tx) (err error) {
+		version, err = schemaOf(tx)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	if version > schemaVersion {
+		return fmt.Errorf("database is of version %d, which is newer than this version of dnscheck supports (%d)", version, schemaVersion)
+	}
+
+	if version == schemaVersion {
+		return nil
+	}
+
+	// a new database has nothing to migrate (or back up).
+	if version == 0 && isEmpty(db) {
+		return db.Update(func(tx *bolt.Tx) error {
+			b, err := bucket(tx, metaBucket)
+			if err != nil {
+				return err
+			}
+
+			return b.Put([]byte(metaSchemaKey), []byte(strconv.Itoa(schemaVersion)))
+		})
+	}
+
+	backup := fmt.Sprintf("%s.v%d.bak", db.Path(), version)
+	err = db.View(func(tx *bolt.Tx) error {
+		return tx.CopyFile(backup, 0600)
+	})
+	if err != nil {
+		return fmt.Errorf("unable to back up the database before migrating: %s", err)
+	}
+
+	for _, m := range migrations {
+		if m.Version <= version {
+			continue
+		}
+
+		logger.Printf("migrate: migrating database to version %d (%s)", m.Version, m.Name)
+
+		err = db.Update(func(tx *bolt.Tx) error {
+			if err := m.Migrate(tx); err != nil {
+				return err
+			}
+
+			b, err := bucket(tx, metaBucket)
+			if err != nil {
+				return err
+			}
+
+			return b.Put([]byte(metaSchemaKey), []byte(strconv.Itoa(m.Version)))
+		})
+		if err != nil {
+			return fmt.Errorf("migration to version %d failed: %s", m.Version, err)
+		}
+	}
+
+	logger.Printf("migrate: database migrated from version %d to %d, a backup was saved to %s", version, schemaVersion, backup)
+
+	return nil
+}
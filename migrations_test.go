@@ -0,0 +1,159 @@
+package main
+
+import (
+	"bytes"
+	"encoding/gob"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/boltdb/bolt"
+)
+
+// writeGobFixtures creates a bolt database at fn as it was before versioning
+// was added, with each of fixtures gob encoded (keyed by bucket, then key).
+func writeGobFixtures(t *testing.T, fn string, fixtures map[string]map[string]interface{}, raw map[string]map[string][]byte) {
+	db, err := bolt.Open(fn, 0600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		put := func(name, key string, value []byte) error {
+			b, err := tx.CreateBucketIfNotExists([]byte(name))
+			if err != nil {
+				return err
+			}
+
+			return b.Put([]byte(key), value)
+		}
+
+		for name, records := range fixtures {
+			for key, data := range records {
+				var buf bytes.Buffer
+				if err := gob.NewEncoder(&buf).Encode(data); err != nil {
+					return err
+				}
+
+				if err := put(name, key, buf.Bytes()); err != nil {
+					return err
+				}
+			}
+		}
+
+		for name, records := range raw {
+			for key, value := range records {
+				if err := put(name, key, value); err != nil {
+					return err
+				}
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMigrateGobToJSON(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dnscheck")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	fn := filepath.Join(dir, "dns.db")
+
+	writeGobFixtures(t, fn, map[string]map[string]interface{}{
+		"records": {
+			"abcde": &DNSResults{RType: "A", ScanTime: "2017-01-02T03:04:05Z", Records: Answer{{Query: "example.com", Answers: []string{"93.184.216.34"}}}},
+		},
+		"monitors": {
+			"web": &Monitor{Name: "web", Input: "example.com", Types: []string{"A", "AAAA"}, Schedule: "@hourly"},
+		},
+	}, map[string]map[string][]byte{
+		"records": {"broken": []byte("not gob")},
+	})
+
+	store, err := openBoltStore(fn)
+	if err != nil {
+		t.Fatalf("openBoltStore: %s", err)
+	}
+	defer store.Close()
+
+	res := &DNSResults{}
+	data, _ := store.Get("records", "abcde")
+	if err = decodeRecord(data, res); err != nil {
+		t.Fatalf("records/abcde: %s", err)
+	}
+	if res.RType != "A" || len(res.Records) != 1 || res.Records[0].Answers[0] != "93.184.216.34" {
+		t.Errorf("records/abcde = %+v, not migrated as it was", res)
+	}
+
+	m := &Monitor{}
+	data, _ = store.Get("monitors", "web")
+	if err = decodeRecord(data, m); err != nil {
+		t.Fatalf("monitors/web: %s", err)
+	}
+	if m.Name != "web" || len(m.Types) != 2 || m.Schedule != "@hourly" {
+		t.Errorf("monitors/web = %+v, not migrated as it was", m)
+	}
+
+	if data, _ = store.Get("records", "broken"); data != nil {
+		t.Errorf("records/broken = %q, should have been quarantined", data)
+	}
+
+	err = store.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(quarantineBucket))
+		if b == nil {
+			t.Fatal("no quarantine bucket")
+		}
+
+		if got := string(b.Get([]byte("records/broken"))); got != "not gob" {
+			t.Errorf("quarantine records/broken = %q, want %q", got, "not gob")
+		}
+
+		version, err := schemaOf(tx)
+		if version != schemaVersion {
+			t.Errorf("schema = %d, want %d", version, schemaVersion)
+		}
+
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = os.Stat(fn + ".v0.bak"); err != nil {
+		t.Errorf("no backup: %s", err)
+	}
+}
+
+func TestMigrateNewDatabase(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dnscheck")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	fn := filepath.Join(dir, "dns.db")
+
+	store, err := openBoltStore(fn)
+	if err != nil {
+		t.Fatalf("openBoltStore: %s", err)
+	}
+	defer store.Close()
+
+	if _, err = os.Stat(fn + ".v0.bak"); !os.IsNotExist(err) {
+		t.Errorf("a new database shouldn't be backed up")
+	}
+
+	version, _ := store.Get(metaBucket, metaSchemaKey)
+	if string(version) != strconv.Itoa(schemaVersion) {
+		t.Errorf("schema = %q, want %d", version, schemaVersion)
+	}
+}
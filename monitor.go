@@ -0,0 +1,475 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lrstanley/dnscheck/lookup"
+	"github.com/robfig/cron"
+)
+
+// monitorTick is how often monitors are checked to see if they are due.
+const monitorTick = 30 * time.Second
+
+// monitorHistory is the number of runs kept for each monitor. Older runs are
+// removed as new ones are saved.
+const monitorHistory = 500
+
+// monitorLease is how long the lease on a monitor lasts (see acquireLease).
+// It's extended while the monitor is running, so it only expires if the
+// instance running it exits.
+const monitorLease = 2 * time.Minute
+
+var reMonitorName = regexp.MustCompile(`^[A-Za-z0-9_.-]{1,64}$`)
+
+// Monitor is a saved scan, which is re-ran on a cron-style schedule.
+type Monitor struct {
+	Name string
+	// Input is the host list as entered, including the expected answers.
+	Input     string
+	Types     []string
+	Resolvers string
+	Fanout    bool
+	Schedule  string
+	Created   time.Time
+	LastRun   time.Time
+	NextRun   time.Time
+	// APIKey is the id of the api key the monitor was created with, if any.
+	// Its scans are attributed to the key, and use its limits.
+	APIKey string
+}
+
+// MonitorLookup is the lookup of a single record type, within a monitor run.
+type MonitorLookup struct {
+	Type    string
+	Key     string
+	Total   int
+	Matched int
+	Errors  int
+	Error   string
+
+	// States is the state of each host (see hostState), used to find hosts
+	// which changed state between runs.
+	States map[string]string
+
+	// results are only kept in memory, they are saved as a regular scan.
+	results *DNSResults
+}
+
+// MonitorRun is a single run of a monitor.
+type MonitorRun struct {
+	Monitor string
+	Time    time.Time
+	Lookups []*MonitorLookup
+	Total   int
+	Matched int
+	Errors  int
+}
+
+// MatchRate returns the percentage of answers which matched, across every
+// lookup within the run.
+func (r *MonitorRun) MatchRate() float64 {
+	if r.Total == 0 {
+		return 0
+	}
+
+	return float64(r.Matched) / float64(r.Total) * 100
+}
+
+// MonitorRuns is the history of a monitor, oldest first.
+type MonitorRuns []*MonitorRun
+
+// ChartPoints returns the match rate of each run as the points of an svg
+// polyline, width by height in size.
+func (runs MonitorRuns) ChartPoints(width, height int) string {
+	if len(runs) == 0 {
+		return ""
+	}
+
+	step := float64(width)
+	if len(runs) > 1 {
+		step = float64(width) / float64(len(runs)-1)
+	}
+
+	points := make([]string, len(runs))
+	for i, run := range runs {
+		y := float64(height) - run.MatchRate()/100*float64(height)
+		points[i] = fmt.Sprintf("%.1f,%.1f", float64(i)*step, y)
+	}
+
+	return strings.Join(points, " ")
+}
+
+// Reverse returns the runs, newest first.
+func (runs MonitorRuns) Reverse() MonitorRuns {
+	out := make(MonitorRuns, len(runs))
+	for i, run := range runs {
+		out[len(runs)-1-i] = run
+	}
+
+	return out
+}
+
+// newMonitor validates the input of a new monitor, and returns it.
+func newMonitor(name, input string, types []string, resolvers string, fanout bool, schedule string) (*Monitor, error) {
+	if !reMonitorName.MatchString(name) {
+		return nil, errors.New("monitor names may only contain letters, numbers, '_', '.' and '-'")
+	}
+
+	if _, err := lookup.ParseHosts(input); err != nil {
+		return nil, err
+	}
+
+	if len(types) == 0 {
+		types = []string{"A"}
+	}
+
+	for _, rtype := range types {
+		if _, ok := lookup.Types[rtype]; !ok || rtype == "" {
+			return nil, fmt.Errorf("invalid lookup type %q", rtype)
+		}
+	}
+
+	if _, ok := conf().Resolvers[resolvers]; !ok {
+		return nil, errors.New("resolvers specified do not exist")
+	}
+
+	sched, err := cron.ParseStandard(schedule)
+	if err != nil {
+		return nil, fmt.Errorf("invalid schedule: %s", err)
+	}
+
+	now := time.Now()
+
+	return &Monitor{
+		Name:      name,
+		Input:     input,
+		Types:     types,
+		Resolvers: resolvers,
+		Fanout:    fanout,
+		Schedule:  schedule,
+		Created:   now,
+		NextRun:   sched.Next(now),
+	}, nil
+}
+
+// Run runs every lookup of the monitor, saving each of them as a regular
+// scan. If the monitor was created with an api key, the run fails once the
+// key is over its daily quota, and lookups which fail are refunded.
+func (m *Monitor) Run() *MonitorRun {
+	run := &MonitorRun{Monitor: m.Name, Time: time.Now()}
+
+	fail := func(rtype string, err error) {
+		run.Lookups = append(run.Lookups, &MonitorLookup{Type: rtype, Error: err.Error()})
+	}
+
+	group, ok := conf().Resolvers[m.Resolvers]
+	if !ok {
+		fail("", fmt.Errorf("resolver group %q no longer exists", m.Resolvers))
+		return run
+	}
+
+	hosts, err := lookup.ParseHosts(m.Input)
+	if err != nil {
+		fail("", err)
+		return run
+	}
+
+	// refund returns a failed scan to the quota of the api key, if any.
+	refund := func() {
+		if m.APIKey == "" {
+			return
+		}
+
+		if err := refundAPIKey(m.APIKey, 1); err != nil {
+			logger.Printf("monitor %s: unable to refund the quota of api key %s: %s", m.Name, m.APIKey, err)
+		}
+	}
+
+	limit := conf().Limit
+	if m.APIKey != "" {
+		key, err := getAPIKey(m.APIKey)
+		if err != nil {
+			fail("", errors.New("the api key the monitor was created with has been revoked"))
+			return run
+		}
+
+		limit = key.Limit()
+
+		// each record type is a scan, charged against the quota of the key.
+		if err = useAPIKey(m.APIKey, len(m.Types)); err != nil {
+			fail("", err)
+			return run
+		}
+	}
+
+	for _, rtype := range m.Types {
+		results, err := LookupAllLimit(hosts, group, rtype, m.Fanout || isGeoGroup(m.Resolvers), limit)
+		if err != nil {
+			fail(rtype, err)
+			refund()
+			continue
+		}
+		results.APIKey = m.APIKey
+
+		ml := &MonitorLookup{Type: rtype, Total: len(results.Records), States: make(map[string]string), results: results}
+		for _, rec := range results.Records {
+			ml.States[diffKey(rec, results.Fanout)] = hostState(rec)
+
+			if rec.IsMatch {
+				ml.Matched++
+			}
+
+			if rec.Error != "" {
+				ml.Errors++
+			}
+		}
+
+		if ml.Key, err = saveLookup(results); err != nil {
+			ml.Error = err.Error()
+			refund()
+		}
+
+		run.Lookups = append(run.Lookups, ml)
+		run.Total += ml.Total
+		run.Matched += ml.Matched
+		run.Errors += ml.Errors
+	}
+
+	return run
+}
+
+func saveMonitor(m *Monitor) error {
+	db, err := newDB()
+	if err != nil {
+		return err
+	}
+	defer db.Clean()
+
+	return db.SetStruct("monitors", m.Name, m)
+}
+
+func getMonitor(name string) (*Monitor, error) {
+	db, err := newDB()
+	if err != nil {
+		return nil, err
+	}
+	defer db.Clean()
+
+	m := &Monitor{}
+
+	return m, db.GetStruct("monitors", name, m)
+}
+
+func listMonitors() (out []*Monitor, err error) {
+	db, err := newDB()
+	if err != nil {
+		return nil, err
+	}
+	defer db.Clean()
+
+	err = db.ForEach("monitors", "", func(key string, data []byte) error {
+		m := &Monitor{}
+		if err := db.GetReceivedStruct(data, m); err != nil {
+			return err
+		}
+
+		out = append(out, m)
+		return nil
+	})
+
+	return out, err
+}
+
+// errMonitorAPIKey is returned when changing a monitor created with an api
+// key from the web interface, which has no way of checking the key.
+var errMonitorAPIKey = errors.New("this monitor was created with an api key, and can only be changed with the api")
+
+// deleteMonitor removes a monitor, and its run history.
+func deleteMonitor(name string) error {
+	db, err := newDB()
+	if err != nil {
+		return err
+	}
+	defer db.Clean()
+
+	if err = db.Delete("monitors", name); err != nil {
+		return err
+	}
+
+	return db.DeletePrefix("monitor-runs", name+"/")
+}
+
+// monitorRunKey returns the key of a run. Keys sort in the order the runs
+// were made.
+func monitorRunKey(run *MonitorRun) string {
+	return fmt.Sprintf("%s/%020d", run.Monitor, run.Time.UnixNano())
+}
+
+// saveMonitorRun saves a run, removing the oldest runs of the monitor past
+// monitorHistory.
+func saveMonitorRun(run *MonitorRun) error {
+	db, err := newDB()
+	if err != nil {
+		return err
+	}
+	defer db.Clean()
+
+	if err = db.SetStruct("monitor-runs", monitorRunKey(run), run); err != nil {
+		return err
+	}
+
+	var expired []string
+	var kept int
+
+	err = db.ForEachReverse("monitor-runs", run.Monitor+"/", 0, func(key string, data []byte) error {
+		if kept++; kept > monitorHistory {
+			expired = append(expired, key)
+		}
+
+		return nil
+	})
+	if err != nil || len(expired) == 0 {
+		return err
+	}
+
+	return db.DeleteKeys("monitor-runs", expired)
+}
+
+// getLastMonitorRun returns the most recent run of a monitor, or nil if it
+// hasn't ran yet.
+func getLastMonitorRun(name string) (out *MonitorRun, err error) {
+	db, err := newDB()
+	if err != nil {
+		return nil, err
+	}
+	defer db.Clean()
+
+	err = db.ForEachReverse("monitor-runs", name+"/", 1, func(key string, data []byte) error {
+		out = &MonitorRun{}
+		return db.GetReceivedStruct(data, out)
+	})
+
+	return out, err
+}
+
+func getMonitorRuns(name string) (out MonitorRuns, err error) {
+	db, err := newDB()
+	if err != nil {
+		return nil, err
+	}
+	defer db.Clean()
+
+	err = db.ForEach("monitor-runs", name+"/", func(key string, data []byte) error {
+		run := &MonitorRun{}
+		if err := db.GetReceivedStruct(data, run); err != nil {
+			return err
+		}
+
+		out = append(out, run)
+		return nil
+	})
+
+	return out, err
+}
+
+// runningMonitors tracks which monitors are currently running, so a slow run
+// isn't started a second time.
+var runningMonitors = struct {
+	sync.Mutex
+	names map[string]bool
+}{names: make(map[string]bool)}
+
+// runMonitor runs the monitor with the given name (if it isn't already
+// running), stores the run, and schedules the next one. If scheduled is
+// true, the monitor is only ran if it's still due, as another instance
+// sharing the store may have just ran it.
+func runMonitor(name string, scheduled bool) {
+	runningMonitors.Lock()
+	if runningMonitors.names[name] {
+		runningMonitors.Unlock()
+		return
+	}
+	runningMonitors.names[name] = true
+	runningMonitors.Unlock()
+
+	defer func() {
+		runningMonitors.Lock()
+		delete(runningMonitors.names, name)
+		runningMonitors.Unlock()
+	}()
+
+	if err := acquireLease("monitor/"+name, monitorLease); err != nil {
+		if err != errLeaseHeld {
+			logger.Printf("monitor %s: unable to take the lease: %s", name, err)
+		}
+		return
+	}
+
+	defer func() {
+		if err := releaseLease("monitor/" + name); err != nil {
+			logger.Printf("monitor %s: unable to release the lease: %s", name, err)
+		}
+	}()
+	defer holdLease("monitor/"+name, monitorLease)()
+
+	m, err := getMonitor(name)
+	if err != nil {
+		logger.Printf("monitor %s: %s", name, err)
+		return
+	}
+
+	if scheduled && m.NextRun.After(time.Now()) {
+		return
+	}
+
+	metricScans.Inc("monitor")
+
+	prev, err := getLastMonitorRun(name)
+	if err != nil {
+		logger.Printf("monitor %s: unable to get the previous run: %s", name, err)
+	}
+
+	run := m.Run()
+	if err := saveMonitorRun(run); err != nil {
+		logger.Printf("monitor %s: unable to save run: %s", name, err)
+	}
+
+	notifyMonitorRun(m, run, prev)
+
+	// the monitor may have been removed (or changed) during the run.
+	if m, err = getMonitor(name); err != nil {
+		return
+	}
+
+	m.LastRun = run.Time
+	if sched, err := cron.ParseStandard(m.Schedule); err == nil {
+		m.NextRun = sched.Next(time.Now())
+	}
+
+	if err := saveMonitor(m); err != nil {
+		logger.Printf("monitor %s: %s", name, err)
+	}
+}
+
+// runMonitors runs each monitor when it is due. It never returns.
+func runMonitors() {
+	for range time.Tick(monitorTick) {
+		monitors, err := listMonitors()
+		if err != nil {
+			logger.Printf("unable to list monitors: %s", err)
+			continue
+		}
+
+		now := time.Now()
+		for _, m := range monitors {
+			if !m.NextRun.After(now) {
+				go runMonitor(m.Name, true)
+			}
+		}
+	}
+}
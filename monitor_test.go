@@ -0,0 +1,44 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMonitorRunHistory(t *testing.T) {
+	defer useMemoryStore()()
+
+	start := time.Now()
+	for i := 0; i < monitorHistory+10; i++ {
+		for _, name := range []string{"web", "mail"} {
+			if err := saveMonitorRun(&MonitorRun{Monitor: name, Time: start.Add(time.Duration(i) * time.Second)}); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	runs, err := getMonitorRuns("web")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(runs) != monitorHistory {
+		t.Fatalf("%d runs kept, want %d", len(runs), monitorHistory)
+	}
+
+	if want := start.Add(10 * time.Second); !runs[0].Time.Equal(want) {
+		t.Errorf("oldest run kept is from %s, want %s", runs[0].Time, want)
+	}
+
+	if err = deleteMonitor("web"); err != nil {
+		t.Fatal(err)
+	}
+
+	if runs, _ = getMonitorRuns("web"); len(runs) != 0 {
+		t.Errorf("%d runs left after removing the monitor", len(runs))
+	}
+
+	if runs, _ = getMonitorRuns("mail"); len(runs) != monitorHistory {
+		t.Errorf("%d runs of another monitor left, want %d", len(runs), monitorHistory)
+	}
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"os"
+	"os/signal"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// resolvConfPath is where the local resolvers are read from.
+const resolvConfPath = "/etc/resolv.conf"
+
+// confValue holds the current *Config. It is swapped as a whole on reload,
+// so anything holding a previous *Config (e.g. an in-flight scan, or a page
+// being rendered) continues to see a consistent view.
+var confValue atomic.Value
+
+// reloadLock prevents concurrent reloads.
+var reloadLock sync.Mutex
+
+// conf returns the current configuration. The returned *Config must not be
+// modified.
+func conf() *Config {
+	return confValue.Load().(*Config)
+}
+
+// setConf swaps the current configuration with c.
+func setConf(c *Config) {
+	confValue.Store(c)
+}
+
+func init() {
+	c := defaultConfig()
+	setConf(&c)
+}
+
+// genGeoResolvers geolocates the resolvers within c, and adds the geographic
+// resolver groups.
+func genGeoResolvers(c *Config) {
+	c.ResolverInfo = tagResolvers(c.Resolvers)
+
+	for name, group := range genGeoGroups(c.Resolvers, c.ResolverInfo) {
+		c.Resolvers[name] = group
+	}
+}
+
+// reloadConfig re-reads the configuration file, environment and resolvers
+// (including the local resolvers), and swaps the current configuration with
+// the result. If anything fails, the current configuration is kept.
+func reloadConfig() error {
+	reloadLock.Lock()
+	defer reloadLock.Unlock()
+
+	old := conf()
+
+	c, err := loadConfig()
+	if err != nil {
+		return err
+	}
+
+	// these are only used during startup, so changing them requires a restart.
+	if c.Host != old.Host || c.Port != old.Port || c.Database != old.Database || c.Storage != old.Storage || c.DatabaseURL != old.DatabaseURL || c.GeoDb != old.GeoDb {
+		logger.Println("reload: changes to host, port, database, storage, database_url or geo_db require a restart, ignoring")
+		c.Host, c.Port, c.Database, c.Storage, c.DatabaseURL, c.GeoDb = old.Host, old.Port, old.Database, old.Storage, old.DatabaseURL, old.GeoDb
+	}
+
+	if err = genResolvers(c); err != nil {
+		return err
+	}
+
+	genGeoResolvers(c)
+
+	scheduler.Update(c.MaxInflight, c.ResolverQPS)
+	setConf(c)
+
+	logger.Printf("reload: configuration reloaded with %d resolver groups", len(c.Resolvers))
+
+	return nil
+}
+
+// watchedFiles returns the modification times of the files the current
+// configuration was built from.
+func watchedFiles() map[string]time.Time {
+	out := make(map[string]time.Time)
+
+	for _, fn := range []string{conf().ConfigFile, conf().ResolverFile, resolvConfPath} {
+		if fn == "" {
+			continue
+		}
+
+		if stat, err := os.Stat(fn); err == nil {
+			out[fn] = stat.ModTime()
+			continue
+		}
+
+		out[fn] = time.Time{}
+	}
+
+	return out
+}
+
+// filesChanged returns true if any of the files have been modified since
+// their modification times were recorded.
+func filesChanged(files map[string]time.Time) bool {
+	for fn, mtime := range files {
+		var current time.Time
+		if stat, err := os.Stat(fn); err == nil {
+			current = stat.ModTime()
+		}
+
+		if !current.Equal(mtime) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// watchConfig reloads the configuration when SIGHUP is received, or when any
+// of the files it was built from change. It should be ran within a goroutine.
+func watchConfig() {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
+	var tick <-chan time.Time
+	if interval := conf().WatchInterval; interval > 0 {
+		tick = time.NewTicker(time.Duration(interval) * time.Second).C
+	}
+
+	files := watchedFiles()
+
+	for {
+		select {
+		case <-hup:
+			logger.Println("reload: received SIGHUP")
+		case <-tick:
+			if !filesChanged(files) {
+				continue
+			}
+
+			logger.Println("reload: configuration files changed")
+		}
+
+		if err := reloadConfig(); err != nil {
+			logger.Printf("reload: unable to reload configuration, keeping current: %s", err)
+		}
+
+		// always update, so a broken file isn't retried until it changes again.
+		files = watchedFiles()
+	}
+}
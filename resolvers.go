@@ -0,0 +1,540 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lrstanley/dnscheck/lookup"
+	ldns "github.com/lrstanley/go-ldns"
+	sempool "github.com/lrstanley/go-sempool"
+	"github.com/miekg/dns"
+)
+
+// ResolverGroup is a named group of resolvers, and the options used when
+// querying them.
+type ResolverGroup struct {
+	Servers   []string `json:"servers"`
+	Transport string   `json:"transport"` // "udp" (default), "tcp" or "tcp-tls"
+	Timeout   Duration `json:"timeout"`
+	Default   bool     `json:"default"` // selected by default on the index page
+}
+
+// lookupGroup returns the group as used by the lookup package, recording
+// metrics for every query.
+func (g *ResolverGroup) lookupGroup() *lookup.ResolverGroup {
+	return &lookup.ResolverGroup{
+		Servers:   g.Servers,
+		Transport: g.Transport,
+		Timeout:   time.Duration(g.Timeout),
+		OnQuery:   observeQuery,
+	}
+}
+
+// Client returns the DNS client used to query the groups resolvers.
+func (g *ResolverGroup) Client() *dns.Client {
+	return g.lookupGroup().Client()
+}
+
+// Addr returns the host:port address for server, assuming the default port
+// of the groups transport if one isn't provided.
+func (g *ResolverGroup) Addr(server string) string {
+	return g.lookupGroup().Addr(server)
+}
+
+// Exchange sends msg to server, returning the response and round trip time.
+func (g *ResolverGroup) Exchange(server string, msg *dns.Msg) (*dns.Msg, time.Duration, error) {
+	return g.lookupGroup().Exchange(server, msg)
+}
+
+// PublicResolver represents a single resolver from a public-dns.info style
+// resolver list.
+type PublicResolver struct {
+	IP          string
+	Name        string
+	Country     string
+	Reliability float64
+	DNSSEC      bool
+	Error       string
+}
+
+// ResolverFilter is used to build resolver groups from a list of public
+// resolvers.
+type ResolverFilter struct {
+	// Countries are the ISO country codes to build groups for. If empty, a
+	// single group is built from all countries.
+	Countries []string
+	// MinReliability is the minimum reliability (0-1) a resolver must have.
+	MinReliability float64
+	// DNSSEC only includes resolvers which validate DNSSEC.
+	DNSSEC bool
+	// Max is the maximum number of resolvers within each group. 0 is no limit.
+	Max int
+}
+
+// publicResolverFields maps the known column/key names used by resolver
+// lists to the field they represent.
+var publicResolverFields = map[string]string{
+	"ip":           "ip",
+	"ip_address":   "ip",
+	"name":         "name",
+	"country":      "country",
+	"country_id":   "country",
+	"country_code": "country",
+	"reliability":  "reliability",
+	"dnssec":       "dnssec",
+	"error":        "error",
+}
+
+// newPublicResolver builds a PublicResolver from a field->value map.
+func newPublicResolver(fields map[string]string) (*PublicResolver, error) {
+	res := &PublicResolver{
+		IP:      strings.TrimSpace(fields["ip"]),
+		Name:    strings.TrimSpace(fields["name"]),
+		Country: strings.ToUpper(strings.TrimSpace(fields["country"])),
+		Error:   strings.TrimSpace(fields["error"]),
+	}
+
+	if net.ParseIP(res.IP) == nil {
+		return nil, fmt.Errorf("invalid resolver ip: %q", res.IP)
+	}
+
+	if rel := strings.TrimSpace(fields["reliability"]); rel != "" {
+		var err error
+		if res.Reliability, err = strconv.ParseFloat(rel, 64); err != nil {
+			return nil, fmt.Errorf("invalid reliability for %s: %q", res.IP, rel)
+		}
+	}
+
+	if sec := strings.TrimSpace(fields["dnssec"]); sec != "" {
+		var err error
+		if res.DNSSEC, err = strconv.ParseBool(sec); err != nil {
+			return nil, fmt.Errorf("invalid dnssec flag for %s: %q", res.IP, sec)
+		}
+	}
+
+	return res, nil
+}
+
+// loadResolverFile reads a public-dns.info style resolver list, in either CSV
+// (with a header row) or JSON (an array of objects) format.
+func loadResolverFile(fn string) ([]*PublicResolver, error) {
+	f, err := os.Open(fn)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	if strings.ToLower(filepath.Ext(fn)) == ".json" {
+		return readResolverJSON(f)
+	}
+
+	return readResolverCSV(f)
+}
+
+func readResolverCSV(r io.Reader) (out []*PublicResolver, err error) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+
+	header, err := reader.Read()
+	if err != nil {
+		return nil, fmt.Errorf("unable to read resolver list header: %s", err)
+	}
+
+	columns := make(map[int]string)
+	for i, name := range header {
+		if field, ok := publicResolverFields[strings.ToLower(strings.TrimSpace(name))]; ok {
+			columns[i] = field
+		}
+	}
+
+	for {
+		row, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		fields := make(map[string]string)
+		for i, value := range row {
+			if field, ok := columns[i]; ok {
+				fields[field] = value
+			}
+		}
+
+		res, err := newPublicResolver(fields)
+		if err != nil {
+			return nil, err
+		}
+
+		out = append(out, res)
+	}
+
+	return out, nil
+}
+
+func readResolverJSON(r io.Reader) (out []*PublicResolver, err error) {
+	var raw []map[string]interface{}
+
+	if err = json.NewDecoder(r).Decode(&raw); err != nil {
+		return nil, fmt.Errorf("unable to decode resolver list: %s", err)
+	}
+
+	for _, entry := range raw {
+		fields := make(map[string]string)
+		for key, value := range entry {
+			field, ok := publicResolverFields[strings.ToLower(key)]
+			if !ok || value == nil {
+				continue
+			}
+
+			fields[field] = fmt.Sprint(value)
+		}
+
+		res, err := newPublicResolver(fields)
+		if err != nil {
+			return nil, err
+		}
+
+		out = append(out, res)
+	}
+
+	return out, nil
+}
+
+// Match returns true if the resolver passes the filter (ignoring country).
+func (f *ResolverFilter) Match(res *PublicResolver) bool {
+	if res.Error != "" {
+		return false
+	}
+
+	if res.Reliability < f.MinReliability {
+		return false
+	}
+
+	if f.DNSSEC && !res.DNSSEC {
+		return false
+	}
+
+	return true
+}
+
+// buildResolverGroups builds named resolver groups from list, using filter.
+// Each group is ordered by reliability, most reliable first.
+func buildResolverGroups(list []*PublicResolver, filter *ResolverFilter) (map[string][]string, error) {
+	var matched []*PublicResolver
+	for _, res := range list {
+		if filter.Match(res) {
+			matched = append(matched, res)
+		}
+	}
+
+	sort.SliceStable(matched, func(i, j int) bool {
+		return matched[i].Reliability > matched[j].Reliability
+	})
+
+	groups := make(map[string][]string)
+
+	add := func(group string, res *PublicResolver) {
+		if filter.Max > 0 && len(groups[group]) >= filter.Max {
+			return
+		}
+
+		groups[group] = append(groups[group], res.IP)
+	}
+
+	if len(filter.Countries) == 0 {
+		for _, res := range matched {
+			add("Public DNS", res)
+		}
+	} else {
+		for _, country := range filter.Countries {
+			country = strings.ToUpper(strings.TrimSpace(country))
+
+			for _, res := range matched {
+				if res.Country == country {
+					add(fmt.Sprintf("Public DNS (%s)", country), res)
+				}
+			}
+		}
+	}
+
+	if len(groups) == 0 {
+		return nil, errors.New("no resolvers within the resolver list matched the filters")
+	}
+
+	return groups, nil
+}
+
+// ResolverInfo contains the geolocation of a resolver.
+type ResolverInfo struct {
+	Server        string
+	Country       string
+	CountryCode   string
+	Continent     string
+	ContinentCode string
+	Lat           float64
+	Long          float64
+}
+
+// tagResolvers geolocates every resolver within groups. Resolvers which are
+// unable to be located (e.g. local resolvers) are omitted.
+func tagResolvers(groups map[string]*ResolverGroup) map[string]*ResolverInfo {
+	out := make(map[string]*ResolverInfo)
+
+	for _, group := range groups {
+		for _, server := range group.Servers {
+			if _, ok := out[server]; ok {
+				continue
+			}
+
+			host := server
+			if h, _, err := net.SplitHostPort(server); err == nil {
+				host = h
+			}
+
+			info, err := IPLookup(host)
+			if err != nil || info.ContinentCode == "" {
+				continue
+			}
+
+			out[server] = &ResolverInfo{
+				Server:        server,
+				Country:       info.Country,
+				CountryCode:   info.CountryCode,
+				Continent:     info.Continent,
+				ContinentCode: info.ContinentCode,
+				Lat:           info.Lat,
+				Long:          info.Long,
+			}
+		}
+	}
+
+	return out
+}
+
+// geoGroupPrefix is the prefix used for all geographic resolver groups.
+const geoGroupPrefix = "Region: "
+
+// isGeoGroup returns true if group is a geographic resolver group.
+func isGeoGroup(group string) bool {
+	return strings.HasPrefix(group, geoGroupPrefix)
+}
+
+// genGeoGroups builds geographic resolver groups from tagged resolvers: one
+// group for each continent, and one group with a resolver per continent.
+func genGeoGroups(groups map[string]*ResolverGroup, info map[string]*ResolverInfo) map[string]*ResolverGroup {
+	// geographic groups inherit the query options of the group the resolver
+	// was originally configured within.
+	origin := make(map[string]*ResolverGroup)
+	for _, group := range groups {
+		for _, server := range group.Servers {
+			if _, ok := origin[server]; !ok {
+				origin[server] = group
+			}
+		}
+	}
+
+	var servers []string
+	for server := range info {
+		servers = append(servers, server)
+	}
+	sort.Strings(servers)
+
+	out := make(map[string]*ResolverGroup)
+	perContinent := make(map[string]string)
+
+	add := func(name, server string) {
+		if _, ok := out[name]; !ok {
+			out[name] = &ResolverGroup{}
+
+			if g := origin[server]; g != nil {
+				out[name].Transport, out[name].Timeout = g.Transport, g.Timeout
+			}
+		}
+
+		out[name].Servers = append(out[name].Servers, server)
+	}
+
+	for _, server := range servers {
+		continent := info[server].Continent
+
+		add(geoGroupPrefix+"All "+continent, server)
+
+		if _, ok := perContinent[continent]; !ok {
+			perContinent[continent] = server
+		}
+	}
+
+	if len(perContinent) > 1 {
+		var picked []string
+		for _, server := range perContinent {
+			picked = append(picked, server)
+		}
+		sort.Strings(picked)
+
+		for _, server := range picked {
+			add(geoGroupPrefix+"One per continent", server)
+		}
+	}
+
+	return out
+}
+
+// probeConcurrency is the max number of resolvers probed at once.
+const probeConcurrency = 20
+
+// probeGroups probes every resolver within groups concurrently, returning
+// the resolvers of each group which didn't respond, and why.
+func probeGroups(groups map[string]*ResolverGroup) map[string]map[string]error {
+	out := make(map[string]map[string]error)
+
+	budget := scheduler.NewScan()
+	defer budget.Done()
+
+	var lock sync.Mutex
+	pool := sempool.New(probeConcurrency)
+
+	for name, group := range groups {
+		for _, server := range group.Servers {
+			pool.Slot()
+
+			go func(name string, group *ResolverGroup, server string) {
+				defer pool.Free()
+
+				_, release := budget.Acquire([]string{server})
+				err := probeResolver(group, server)
+				release()
+
+				if err == nil {
+					return
+				}
+
+				lock.Lock()
+				if out[name] == nil {
+					out[name] = make(map[string]error)
+				}
+				out[name][server] = err
+				lock.Unlock()
+			}(name, group, server)
+		}
+	}
+
+	pool.Wait()
+
+	return out
+}
+
+// genFileResolvers builds resolver groups from the resolver list file, if
+// one was supplied.
+func genFileResolvers(c *Config) error {
+	if c.ResolverFile == "" {
+		return nil
+	}
+
+	list, err := loadResolverFile(c.ResolverFile)
+	if err != nil {
+		return fmt.Errorf("unable to load resolver list %q: %s", c.ResolverFile, err)
+	}
+
+	groups, err := buildResolverGroups(list, &ResolverFilter{
+		Countries:      c.ResolverCountry,
+		MinReliability: c.MinReliability,
+		DNSSEC:         c.DNSSECOnly,
+		Max:            c.MaxGroupSize,
+	})
+	if err != nil {
+		return err
+	}
+
+	for name, servers := range groups {
+		logger.Printf("loaded %d resolvers into group %q from %s", len(servers), name, c.ResolverFile)
+		c.Resolvers[name] = &ResolverGroup{Servers: servers}
+	}
+
+	return nil
+}
+
+// genResolvers generates the resolver groups for c. Every resolver is probed,
+// and genResolvers fails if none of them are responding. Resolvers from the
+// defaults which aren't responding are skipped, though explicitly configured
+// resolvers are kept, with a warning.
+func genResolvers(c *Config) error {
+	if err := genFileResolvers(c); err != nil {
+		return err
+	}
+
+	// defaults are the groups which weren't explicitly requested.
+	defaults := make(map[string]bool)
+
+	if len(c.Groups) == 0 && len(c.CustomResolvers) == 0 {
+		// assume defaults. Google DNS, OpenDNS, and local resolvers.
+		localResolvers, err := ldns.ReadResolveConf()
+		if err != nil {
+			return err
+		}
+
+		c.Resolvers["Local Resolvers"] = &ResolverGroup{Servers: localResolvers, Default: true}
+		c.Resolvers["Google DNS"] = &ResolverGroup{Servers: []string{"8.8.8.8", "8.8.4.4"}}
+		c.Resolvers["OpenDNS"] = &ResolverGroup{Servers: []string{"208.67.222.222", "208.67.220.220"}}
+
+		defaults["Local Resolvers"], defaults["Google DNS"], defaults["OpenDNS"] = true, true, true
+	}
+
+	if len(c.CustomResolvers) > 0 {
+		c.Resolvers["Custom"] = &ResolverGroup{Servers: c.CustomResolvers}
+	}
+
+	for name, group := range c.Groups {
+		c.Resolvers[name] = group
+	}
+
+	failed := probeGroups(c.Resolvers)
+
+	var working int
+	for name, group := range c.Resolvers {
+		if len(failed[name]) < len(group.Servers) {
+			working++
+		}
+
+		if !defaults[name] {
+			// resolvers were explicitly requested, so only warn about them.
+			for server, err := range failed[name] {
+				logger.Printf("warning: resolver %s (%s) is not responding: %s", server, name, err)
+			}
+			continue
+		}
+
+		var servers []string
+		for _, server := range group.Servers {
+			if err, ok := failed[name][server]; ok {
+				logger.Printf("resolver %s (%s) is not responding, skipping: %s", server, name, err)
+				continue
+			}
+
+			servers = append(servers, server)
+		}
+
+		if group.Servers = servers; len(servers) == 0 {
+			delete(c.Resolvers, name)
+		}
+	}
+
+	if working == 0 {
+		return errors.New("none of the resolvers are responding")
+	}
+
+	return nil
+}
@@ -0,0 +1,363 @@
+package main
+
+import (
+	"errors"
+	"time"
+)
+
+// sweepTick is how often the sweeper checks if it's due, so changes to the
+// sweep interval are picked up on reload.
+const sweepTick = time.Minute
+
+// retentionExpiry returns when results created at created expire, using the
+// configured retention, or the zero time if they never do.
+func retentionExpiry(created time.Time) time.Time {
+	days := conf().RetentionDays
+	if days <= 0 {
+		return time.Time{}
+	}
+
+	return created.AddDate(0, 0, days)
+}
+
+// Expiry is embedded in the reports saved alongside scan results
+// (benchmarks, email audits and delegation reports), which expire the same
+// way.
+type Expiry struct {
+	Created time.Time
+	Expires time.Time
+}
+
+func (e *Expiry) expiry() *Expiry {
+	return e
+}
+
+// Expired returns true if the report has expired as of now.
+func (e *Expiry) Expired(now time.Time) bool {
+	return !e.Expires.IsZero() && !e.Expires.After(now)
+}
+
+// isLegacy returns true if the report was saved before expiry was tracked.
+func (e *Expiry) isLegacy() bool {
+	return e.Created.IsZero() && e.Expires.IsZero()
+}
+
+// expiringReport is a report which embeds Expiry.
+type expiringReport interface {
+	expiry() *Expiry
+}
+
+// reportBuckets are the buckets of the reports which expire, and a func
+// returning an empty report of the type stored within each.
+var reportBuckets = map[string]func() expiringReport{
+	"benchmarks": func() expiringReport { return &BenchResults{} },
+	"email":      func() expiringReport { return &EmailAudit{} },
+	"delegation": func() expiringReport { return &DelegationReport{} },
+}
+
+// saveReport saves a report within bucket, setting when it expires, and
+// returns its key.
+func saveReport(bucket string, report expiringReport) (string, error) {
+	db, err := newDB()
+	if err != nil {
+		return "", err
+	}
+	defer db.Clean()
+
+	key := genWord(5, 6)
+
+	e := report.expiry()
+	e.Created = time.Now()
+	e.Expires = retentionExpiry(e.Created)
+
+	return key, db.SetStruct(bucket, key, report)
+}
+
+// getReport decodes the report with the given key from bucket into report,
+// failing if it has expired.
+func getReport(bucket, key string, report expiringReport) error {
+	db, err := newDB()
+	if err != nil {
+		return err
+	}
+	defer db.Clean()
+
+	if err = db.GetStruct(bucket, key, report); err != nil {
+		return err
+	}
+
+	// expired reports may not have been swept yet.
+	if report.expiry().Expired(time.Now()) {
+		return errors.New("report has expired")
+	}
+
+	return nil
+}
+
+// ExpiresAt returns when the results expire, or the zero time if they never
+// do (or haven't been given an expiry yet, see sweepExpired).
+func (res *DNSResults) ExpiresAt() time.Time {
+	if res.Pinned {
+		return time.Time{}
+	}
+
+	return res.Expires
+}
+
+// isLegacy returns true if the results were saved before expiry was
+// tracked.
+func (res *DNSResults) isLegacy() bool {
+	return res.Created.IsZero() && res.Expires.IsZero() && !res.Pinned
+}
+
+// Expired returns true if the results have expired as of now.
+func (res *DNSResults) Expired(now time.Time) bool {
+	expires := res.ExpiresAt()
+
+	return !expires.IsZero() && !expires.After(now)
+}
+
+// pinLookup pins (or unpins) the results with the given key. Pinned results
+// are kept indefinitely, and unpinned results expire as if they were just
+// saved.
+func pinLookup(key string, pinned bool) error {
+	db, err := newDB()
+	if err != nil {
+		return err
+	}
+	defer db.Clean()
+
+	results := &DNSResults{}
+
+	err = db.UpdateStruct("records", key, results, func() error {
+		results.Pinned = pinned
+
+		if !pinned {
+			results.Expires = retentionExpiry(time.Now())
+		}
+
+		return nil
+	})
+	if err != nil {
+		return errors.New("an entry with that key does not exist")
+	}
+
+	return nil
+}
+
+// sweepExpired removes every expired result and report, and the monitor
+// runs linking to removed results, returning how many were removed. Results saved before expiry was tracked are given one, as if they
+// were saved now, rather than expiring all at once based on when they were
+// scanned.
+func sweepExpired() (removed int, err error) {
+	db, err := newDB()
+	if err != nil {
+		return 0, err
+	}
+	defer db.Clean()
+
+	now := time.Now()
+
+	var legacy []string
+	expired := make(map[string]*DNSResults)
+	err = db.ForEach("records", "", func(key string, data []byte) error {
+		results := &DNSResults{}
+		if err := db.GetReceivedStruct(data, results); err != nil {
+			logger.Printf("sweep: unable to decode %s, skipping: %s", key, err)
+			return nil
+		}
+
+		if results.isLegacy() {
+			legacy = append(legacy, key)
+		} else if results.Expired(now) {
+			expired[key] = results
+		}
+
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	// only the expiry is set, as Created is part of the search index keys of
+	// the results (see searchEntries).
+	if expires := retentionExpiry(now); !expires.IsZero() {
+		for _, key := range legacy {
+			results := &DNSResults{}
+
+			err = db.UpdateStruct("records", key, results, func() error {
+				if results.isLegacy() {
+					results.Expires = expires
+				}
+
+				return nil
+			})
+			if err != nil {
+				return removed, err
+			}
+		}
+	}
+
+	for key, results := range expired {
+		if err = unindexLookup(db, key, results); err != nil {
+			return removed, err
+		}
+
+		if err = db.Delete("records", key); err != nil {
+			return removed, err
+		}
+		removed++
+	}
+
+	for bucket, newReport := range reportBuckets {
+		n, err := sweepReports(db, bucket, newReport, now)
+		removed += n
+		if err != nil {
+			return removed, err
+		}
+	}
+
+	n, err := pruneMonitorRuns(db)
+	removed += n
+
+	return removed, err
+}
+
+// sweepReports removes the expired reports within bucket, returning how many
+// were removed. As with scan results, reports saved before expiry was
+// tracked are given one, as if they were saved now.
+func sweepReports(db *DB, bucket string, newReport func() expiringReport, now time.Time) (removed int, err error) {
+	var legacy, expired []string
+
+	err = db.ForEach(bucket, "", func(key string, data []byte) error {
+		report := newReport()
+		if err := db.GetReceivedStruct(data, report); err != nil {
+			logger.Printf("sweep: unable to decode %s/%s, skipping: %s", bucket, key, err)
+			return nil
+		}
+
+		if e := report.expiry(); e.isLegacy() {
+			legacy = append(legacy, key)
+		} else if e.Expired(now) {
+			expired = append(expired, key)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	if expires := retentionExpiry(now); !expires.IsZero() {
+		for _, key := range legacy {
+			report := newReport()
+
+			err = db.UpdateStruct(bucket, key, report, func() error {
+				if e := report.expiry(); e.isLegacy() {
+					e.Expires = expires
+				}
+
+				return nil
+			})
+			if err != nil {
+				return 0, err
+			}
+		}
+	}
+
+	if len(expired) == 0 {
+		return 0, nil
+	}
+
+	return len(expired), db.DeleteKeys(bucket, expired)
+}
+
+// pruneMonitorRuns removes the monitor runs which link to scans which no
+// longer exist (as they've expired), returning how many were removed.
+func pruneMonitorRuns(db *DB) (removed int, err error) {
+	// the scans of each run, checked once iterating over the runs is done.
+	scans := make(map[string][]string)
+
+	err = db.ForEach("monitor-runs", "", func(key string, data []byte) error {
+		run := &MonitorRun{}
+		if err := db.GetReceivedStruct(data, run); err != nil {
+			logger.Printf("sweep: unable to decode monitor run %s, skipping: %s", key, err)
+			return nil
+		}
+
+		for _, ml := range run.Lookups {
+			if ml.Key != "" {
+				scans[key] = append(scans[key], ml.Key)
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	var pruned []string
+	for key, keys := range scans {
+		for _, scan := range keys {
+			value, err := db.store.Get("records", scan)
+			if err != nil {
+				return 0, err
+			}
+
+			if value == nil {
+				pruned = append(pruned, key)
+				break
+			}
+		}
+	}
+
+	if len(pruned) == 0 {
+		return 0, nil
+	}
+
+	return len(pruned), db.DeleteKeys("monitor-runs", pruned)
+}
+
+// sweep removes expired results, and compacts the database if any were
+// removed (and the storage supports it).
+func sweep() {
+	removed, err := sweepExpired()
+	if err != nil {
+		logger.Printf("sweep: unable to remove expired results: %s", err)
+		return
+	}
+
+	if removed == 0 {
+		return
+	}
+
+	before, after, err := compactDatabase()
+	if err == errNotCompactable {
+		logger.Printf("sweep: removed %d expired results", removed)
+		return
+	}
+
+	if err != nil {
+		logger.Printf("sweep: removed %d expired results, but unable to compact the database: %s", removed, err)
+		return
+	}
+
+	logger.Printf("sweep: removed %d expired results, compacted the database from %d to %d bytes", removed, before, after)
+}
+
+// runSweeper periodically removes expired results, as often as the
+// configured sweep interval.
+func runSweeper() {
+	var last time.Time
+
+	for now := range time.Tick(sweepTick) {
+		interval := time.Duration(conf().SweepInterval) * time.Minute
+		if interval <= 0 || now.Sub(last) < interval {
+			continue
+		}
+
+		last = now
+		sweep()
+	}
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSweepExpired(t *testing.T) {
+	defer useMemoryStore()()
+
+	db, err := newDB()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	records := map[string]interface{}{
+		"expired": &DNSResults{Created: now.AddDate(0, 0, -40), Expires: now.AddDate(0, 0, -10)},
+		"current": &DNSResults{Created: now, Expires: now.AddDate(0, 0, 30)},
+		"pinned":  &DNSResults{Created: now.AddDate(0, 0, -40), Expires: now.AddDate(0, 0, -10), Pinned: true},
+		// saved before expiry was tracked, and scanned long ago.
+		"legacy": &DNSResults{ScanTime: now.AddDate(-1, 0, 0).Format(time.RFC3339)},
+	}
+	err = db.SetStructs("records", records)
+	db.Clean()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	removed, err := sweepExpired()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if removed != 1 {
+		t.Errorf("removed %d results, want 1", removed)
+	}
+
+	if _, err = getLookup("expired"); err == nil {
+		t.Error("expired results weren't removed")
+	}
+
+	for _, key := range []string{"current", "pinned"} {
+		if _, err = getLookup(key); err != nil {
+			t.Errorf("%s: %s", key, err)
+		}
+	}
+
+	res, err := getLookup("legacy")
+	if err != nil {
+		t.Fatalf("legacy results were removed: %s", err)
+	}
+
+	if want := retentionExpiry(now); res.Expires.Sub(want) > time.Minute || want.Sub(res.Expires) > time.Minute {
+		t.Errorf("legacy results expire at %s, want about %s", res.Expires, want)
+	}
+}
+
+func TestSweepReports(t *testing.T) {
+	defer useMemoryStore()()
+
+	db, err := newDB()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	expired := Expiry{Created: now.AddDate(0, 0, -40), Expires: now.AddDate(0, 0, -10)}
+	current := Expiry{Created: now, Expires: now.AddDate(0, 0, 30)}
+
+	err = db.SetStructs("benchmarks", map[string]interface{}{
+		"expired": &BenchResults{Expiry: expired},
+		"current": &BenchResults{Expiry: current},
+		"legacy":  &BenchResults{ScanTime: now.AddDate(-1, 0, 0).Format(time.RFC3339)},
+	})
+	if err == nil {
+		err = db.SetStructs("email", map[string]interface{}{"expired": &EmailAudit{Expiry: expired}})
+	}
+	if err == nil {
+		err = db.SetStructs("delegation", map[string]interface{}{"expired": &DelegationReport{Expiry: expired}})
+	}
+	if err == nil {
+		err = db.SetStructs("records", map[string]interface{}{
+			"expired": &DNSResults{Created: expired.Created, Expires: expired.Expires},
+			"current": &DNSResults{Created: current.Created, Expires: current.Expires},
+		})
+	}
+	if err == nil {
+		// a run linking to a scan which expires, and one linking to a scan
+		// which doesn't.
+		err = db.SetStructs("monitor-runs", map[string]interface{}{
+			"web/1": &MonitorRun{Monitor: "web", Lookups: []*MonitorLookup{{Type: "A", Key: "expired"}}},
+			"web/2": &MonitorRun{Monitor: "web", Lookups: []*MonitorLookup{{Type: "A", Key: "current"}, {Type: "AAAA", Error: "failed"}}},
+		})
+	}
+	db.Clean()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	removed, err := sweepExpired()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the expired scan, three expired reports and the run linking to the scan.
+	if removed != 5 {
+		t.Errorf("removed %d, want 5", removed)
+	}
+
+	if _, err = getBenchmark("expired"); err == nil {
+		t.Error("expired benchmark wasn't removed")
+	}
+	if _, err = getEmailAudit("expired"); err == nil {
+		t.Error("expired email audit wasn't removed")
+	}
+	if _, err = getDelegation("expired"); err == nil {
+		t.Error("expired delegation report wasn't removed")
+	}
+	if _, err = getBenchmark("current"); err != nil {
+		t.Errorf("current benchmark: %s", err)
+	}
+
+	bench, err := getBenchmark("legacy")
+	if err != nil {
+		t.Fatalf("legacy benchmark was removed: %s", err)
+	}
+	if want := retentionExpiry(now); bench.Expires.Sub(want) > time.Minute || want.Sub(bench.Expires) > time.Minute {
+		t.Errorf("legacy benchmark expires at %s, want about %s", bench.Expires, want)
+	}
+
+	runs, err := getMonitorRuns("web")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(runs) != 1 || runs[0].Lookups[0].Key != "current" {
+		t.Errorf("monitor runs = %+v, want only the run linking to the current scan", runs)
+	}
+}
@@ -0,0 +1,305 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The search indexes map each queried host (and each answer) to the scans
+// which included it. Keys are "<value>/<created>/<scan key>", so the scans of
+// a value are ordered by when they were created.
+const (
+	hostIndex   = "index-hosts"
+	answerIndex = "index-answers"
+)
+
+// searchIndexVersion is the version of the search indexes. If the indexes of
+// the database are older (or missing), they're rebuilt when it's opened.
+const (
+	searchIndexVersion = 3
+	metaIndexKey       = "search-index"
+)
+
+// searchLimit is the max number of scans returned by a search.
+const searchLimit = 100
+
+// indexBatch is the number of scans indexed at once, when rebuilding the
+// indexes.
+const indexBatch = 500
+
+var errEmptySearch = errors.New("enter a hostname or an answer to search for")
+
+// SearchResult is a scan found by a search.
+type SearchResult struct {
+	Key     string    `json:"key"`
+	Type    string    `json:"type"`
+	Created time.Time `json:"created"`
+	// Hosts are the hosts within the scan which matched: the host searched
+	// for, or the hosts which resolved to the answer searched for.
+	Hosts []string `json:"hosts"`
+}
+
+// normalizeHost returns host as it's indexed, e.g. "API.example.com." is
+// indexed as "api.example.com".
+func normalizeHost(host string) string {
+	return strings.TrimSuffix(strings.ToLower(strings.TrimSpace(host)), ".")
+}
+
+// normalizeAnswer returns answer (of the record type rtype) as it's indexed.
+// Addresses are in their canonical form, so an ipv6 address matches however
+// it's written, and only the target of an MX record is indexed (e.g. "10
+// mx.example.com" is indexed as "mx.example.com").
+func normalizeAnswer(rtype, answer string) string {
+	answer = strings.TrimSpace(answer)
+	if rtype == "MX" {
+		answer = stripPreference(answer)
+	}
+
+	if ip := net.ParseIP(answer); ip != nil {
+		return ip.String()
+	}
+
+	return normalizeHost(answer)
+}
+
+// stripPreference returns the target of an MX record, without its
+// preference.
+func stripPreference(answer string) string {
+	fields := strings.Fields(answer)
+	if len(fields) != 2 {
+		return answer
+	}
+
+	if _, err := strconv.ParseUint(fields[0], 10, 16); err != nil {
+		return answer
+	}
+
+	return fields[1]
+}
+
+// indexPrefix returns the prefix of the index keys of value. value is
+// escaped, so it never contains the separator.
+func indexPrefix(value string) string {
+	return url.QueryEscape(value) + "/"
+}
+
+// indexKey returns the index key of a scan, for value.
+func indexKey(value string, created time.Time, key string) string {
+	return fmt.Sprintf("%s%020d/%s", indexPrefix(value), created.UnixNano(), key)
+}
+
+// CreatedAt returns when the results were saved. Results saved before this
+// was tracked use their scan time.
+func (res *DNSResults) CreatedAt() time.Time {
+	if !res.Created.IsZero() {
+		return res.Created
+	}
+
+	created, _ := time.Parse(time.RFC3339, res.ScanTime)
+
+	return created
+}
+
+// searchEntries returns the index entries of a scan, by index and then by
+// index key.
+func searchEntries(key string, res *DNSResults) map[string]map[string]interface{} {
+	created := res.CreatedAt()
+
+	hosts := make(map[string]bool)
+	for _, host := range res.Request {
+		hosts[normalizeHost(host.Name)] = true
+	}
+
+	// the hosts which resolved to each answer.
+	answers := make(map[string]map[string]bool)
+	for _, rec := range res.Records {
+		hosts[normalizeHost(rec.Query)] = true
+
+		for _, answer := range rec.Answers {
+			answer = normalizeAnswer(rec.RType, answer)
+			if answers[answer] == nil {
+				answers[answer] = make(map[string]bool)
+			}
+
+			answers[answer][normalizeHost(rec.Query)] = true
+		}
+	}
+
+	out := map[string]map[string]interface{}{
+		hostIndex:   make(map[string]interface{}),
+		answerIndex: make(map[string]interface{}),
+	}
+
+	for host := range hosts {
+		if host == "" {
+			continue
+		}
+
+		out[hostIndex][indexKey(host, created, key)] = &SearchResult{Key: key, Type: res.RType, Created: created, Hosts: []string{host}}
+	}
+
+	for answer, matched := range answers {
+		if answer == "" {
+			continue
+		}
+
+		result := &SearchResult{Key: key, Type: res.RType, Created: created}
+		for host := range matched {
+			result.Hosts = append(result.Hosts, host)
+		}
+		sort.Strings(result.Hosts)
+
+		out[answerIndex][indexKey(answer, created, key)] = result
+	}
+
+	return out
+}
+
+// indexLookup adds a scan to the search indexes.
+func indexLookup(db *DB, key string, res *DNSResults) error {
+	for index, entries := range searchEntries(key, res) {
+		if err := db.SetStructs(index, entries); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// unindexLookup removes a scan from the search indexes.
+func unindexLookup(db *DB, key string, res *DNSResults) error {
+	for index, entries := range searchEntries(key, res) {
+		keys := make([]string, 0, len(entries))
+		for k := range entries {
+			keys = append(keys, k)
+		}
+
+		if err := db.DeleteKeys(index, keys); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// buildSearchIndex rebuilds the search indexes from every saved scan, if
+// they're older than searchIndexVersion (or were never built).
+func buildSearchIndex() error {
+	db, err := newDB()
+	if err != nil {
+		return err
+	}
+	defer db.Clean()
+
+	version, err := db.store.Get(metaBucket, metaIndexKey)
+	if err != nil {
+		return err
+	}
+
+	if string(version) == strconv.Itoa(searchIndexVersion) {
+		return nil
+	}
+
+	for _, index := range []string{hostIndex, answerIndex} {
+		if err = db.DeletePrefix(index, ""); err != nil {
+			return err
+		}
+	}
+
+	// scans are read outside of the iteration, as the store may not allow
+	// writes during it.
+	var keys []string
+	err = db.ForEach("records", "", func(key string, data []byte) error {
+		keys = append(keys, key)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	var indexed, pending int
+	entries := map[string]map[string]interface{}{hostIndex: {}, answerIndex: {}}
+
+	flush := func() error {
+		for index, batch := range entries {
+			if err := db.SetStructs(index, batch); err != nil {
+				return err
+			}
+
+			entries[index] = make(map[string]interface{})
+		}
+
+		indexed += pending
+		pending = 0
+
+		return nil
+	}
+
+	for _, key := range keys {
+		res := &DNSResults{}
+		if err = db.GetStruct("records", key, res); err != nil {
+			logger.Printf("search: unable to decode %s, skipping: %s", key, err)
+			continue
+		}
+
+		for index, batch := range searchEntries(key, res) {
+			for k, v := range batch {
+				entries[index][k] = v
+			}
+		}
+
+		if pending++; pending >= indexBatch {
+			if err = flush(); err != nil {
+				return err
+			}
+		}
+	}
+
+	if err = flush(); err != nil {
+		return err
+	}
+
+	if indexed > 0 {
+		logger.Printf("search: indexed %d scans", indexed)
+	}
+
+	return db.store.Put(metaBucket, metaIndexKey, []byte(strconv.Itoa(searchIndexVersion)))
+}
+
+// searchScans returns the most recent scans which included host, or where
+// anything resolved to answer (only one of which should be provided).
+func searchScans(host, answer string) (out []*SearchResult, err error) {
+	index, value := hostIndex, normalizeHost(host)
+	if value == "" {
+		// the type isn't known, so the answer is searched for as it's given.
+		index, value = answerIndex, normalizeAnswer("", answer)
+	}
+
+	if value == "" {
+		return nil, errEmptySearch
+	}
+
+	db, err := newDB()
+	if err != nil {
+		return nil, err
+	}
+	defer db.Clean()
+
+	err = db.ForEachReverse(index, indexPrefix(value), searchLimit, func(key string, data []byte) error {
+		result := &SearchResult{}
+		if err := db.GetReceivedStruct(data, result); err != nil {
+			return err
+		}
+
+		out = append(out, result)
+		return nil
+	})
+
+	return out, err
+}
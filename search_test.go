@@ -0,0 +1,25 @@
+package main
+
+import "testing"
+
+func TestNormalizeAnswer(t *testing.T) {
+	tests := []struct {
+		rtype  string
+		answer string
+		want   string
+	}{
+		{"A", "93.184.216.34", "93.184.216.34"},
+		{"AAAA", "2606:2800:0220:0001:0248:1893:25c8:1946", "2606:2800:220:1:248:1893:25c8:1946"},
+		{"CNAME", "Target.Example.com.", "target.example.com"},
+		{"MX", "10 mx.example.com", "mx.example.com"},
+		{"MX", "mx.example.com", "mx.example.com"},
+		{"TXT", "1 foo", "1 foo"},
+		{"", "10 mx.example.com", "10 mx.example.com"},
+	}
+
+	for _, tt := range tests {
+		if got := normalizeAnswer(tt.rtype, tt.answer); got != tt.want {
+			t.Errorf("normalizeAnswer(%q, %q) = %q, want %q", tt.rtype, tt.answer, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,501 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+
+	"github.com/lrstanley/dnscheck/lookup"
+	"github.com/miekg/dns"
+)
+
+const (
+	// spfLookupLimit is the maximum number of DNS querying terms allowed
+	// while evaluating SPF (RFC 7208 4.6.4).
+	spfLookupLimit = 10
+	// spfVoidLimit is the maximum number of void lookups allowed (RFC 7208
+	// 4.6.4).
+	spfVoidLimit = 2
+	// spfMXLimit is the maximum number of MX records evaluated for a single mx
+	// mechanism (RFC 7208 4.6.4).
+	spfMXLimit = 10
+	// spfMaxDepth and spfMaxLookups stop runaway evaluation of broken records.
+	spfMaxDepth   = 15
+	spfMaxLookups = 50
+)
+
+// spfNoRecord is the error used when a domain has no SPF record.
+const spfNoRecord = "no SPF record found"
+
+// SPFTerm is a single term within an SPF record.
+type SPFTerm struct {
+	Term    string
+	Lookups int
+	Void    bool
+	IPs     []string
+	Note    string
+	Error   string
+	Include *SPFNode
+}
+
+// SPFNode is a single SPF record, and the terms within it.
+type SPFNode struct {
+	Domain string
+	Record string
+	Terms  []*SPFTerm
+	Error  string
+
+	// void is true if the domain doesn't exist, or has no TXT records.
+	void bool
+}
+
+// SPFLine is a single line of the flattened SPF tree.
+type SPFLine struct {
+	Depth  int
+	Domain string
+	Record string
+	Term   *SPFTerm
+	Error  string
+}
+
+// SPFResult is the result of recursively evaluating the SPF record of a
+// domain.
+type SPFResult struct {
+	Domain      string
+	Root        *SPFNode
+	Lookups     int
+	VoidLookups int
+	Authorized  []string
+	Findings    []*Finding
+}
+
+// Lines returns the flattened SPF tree, depth first.
+func (r *SPFResult) Lines() (out []*SPFLine) {
+	var walk func(node *SPFNode, depth int)
+	walk = func(node *SPFNode, depth int) {
+		out = append(out, &SPFLine{Depth: depth, Domain: node.Domain, Record: node.Record, Error: node.Error})
+
+		for _, term := range node.Terms {
+			out = append(out, &SPFLine{Depth: depth + 1, Domain: node.Domain, Term: term})
+
+			if term.Include != nil {
+				walk(term.Include, depth+2)
+			}
+		}
+	}
+
+	if r.Root != nil {
+		walk(r.Root, 0)
+	}
+
+	return out
+}
+
+// Indent returns the indentation (in pixels) of the line, for templates.
+func (l *SPFLine) Indent() int {
+	return l.Depth * 20
+}
+
+// spfEvaluator holds the state of a single SPF evaluation.
+type spfEvaluator struct {
+	group  *ResolverGroup
+	budget *lookup.Budget
+	result *SPFResult
+	stack  []string
+}
+
+func (e *spfEvaluator) finding(severity, format string, args ...interface{}) {
+	e.result.Findings = append(e.result.Findings, &Finding{Severity: severity, Message: fmt.Sprintf(format, args...)})
+}
+
+// query looks up name, returning the matching records. void is true if the
+// name doesn't exist, or has no records of qtype.
+func (e *spfEvaluator) query(name string, qtype uint16) (records []dns.RR, void bool, err error) {
+	msg := new(dns.Msg)
+	msg.SetQuestion(dns.Fqdn(name), qtype)
+
+	server, release := e.budget.Acquire(e.group.Servers)
+	resp, _, err := e.group.Exchange(server, msg)
+	release()
+
+	if err != nil {
+		return nil, false, err
+	}
+
+	switch resp.Rcode {
+	case dns.RcodeSuccess:
+	case dns.RcodeNameError:
+		return nil, true, nil
+	default:
+		return nil, false, fmt.Errorf("lookup of %s failed: %s", name, dns.RcodeToString[resp.Rcode])
+	}
+
+	for _, rr := range resp.Answer {
+		if rr.Header().Rrtype == qtype {
+			records = append(records, rr)
+		}
+	}
+
+	return records, len(records) == 0, nil
+}
+
+// countLookup counts a DNS querying term against the limits, returning false
+// if evaluation should stop.
+func (e *spfEvaluator) countLookup(term *SPFTerm) bool {
+	term.Lookups++
+	e.result.Lookups++
+
+	if e.result.Lookups == spfLookupLimit+1 {
+		term.Error = fmt.Sprintf("exceeds the limit of %d DNS lookups", spfLookupLimit)
+	}
+
+	return e.result.Lookups <= spfMaxLookups
+}
+
+// countVoid counts a void lookup.
+func (e *spfEvaluator) countVoid(term *SPFTerm) {
+	term.Void = true
+	e.result.VoidLookups++
+
+	if e.result.VoidLookups == spfVoidLimit+1 {
+		term.Error = fmt.Sprintf("exceeds the limit of %d void lookups", spfVoidLimit)
+	}
+}
+
+// splitCIDR splits the optional dual cidr length from a domain spec, e.g.
+// "example.com/24//64".
+func splitCIDR(spec string) (domain string, v4, v6 string) {
+	v4, v6 = "32", "128"
+
+	if i := strings.Index(spec, "//"); i >= 0 {
+		spec, v6 = spec[:i], spec[i+2:]
+	}
+
+	if i := strings.Index(spec, "/"); i >= 0 {
+		spec, v4 = spec[:i], spec[i+1:]
+	}
+
+	return spec, v4, v6
+}
+
+// addrRanges resolves the A/AAAA records of name, returning them as ranges.
+func (e *spfEvaluator) addrRanges(name, v4, v6 string) (ranges []string, void bool, err error) {
+	void = true
+
+	for _, qtype := range []uint16{dns.TypeA, dns.TypeAAAA} {
+		records, isVoid, err := e.query(name, qtype)
+		if err != nil {
+			return nil, false, err
+		}
+
+		void = void && isVoid
+
+		for _, rr := range records {
+			switch r := rr.(type) {
+			case *dns.A:
+				ranges = append(ranges, r.A.String()+"/"+v4)
+			case *dns.AAAA:
+				ranges = append(ranges, r.AAAA.String()+"/"+v6)
+			}
+		}
+	}
+
+	return ranges, void, nil
+}
+
+// hasMacro returns true if the domain spec contains SPF macros, which can't
+// be expanded without the details of a specific message.
+func hasMacro(spec string) bool {
+	return strings.Contains(spec, "%{")
+}
+
+// evaluate fetches and evaluates the SPF record of domain.
+func (e *spfEvaluator) evaluate(domain string) *SPFNode {
+	node := &SPFNode{Domain: domain}
+
+	for _, d := range e.stack {
+		if strings.EqualFold(d, domain) {
+			node.Error = "loop detected: " + strings.Join(append(e.stack, domain), " -> ")
+			e.finding(SeverityError, "SPF include loop: %s", strings.Join(append(e.stack, domain), " -> "))
+			return node
+		}
+	}
+
+	if len(e.stack) >= spfMaxDepth {
+		node.Error = "include depth exceeded"
+		return node
+	}
+
+	e.stack = append(e.stack, domain)
+	defer func() { e.stack = e.stack[:len(e.stack)-1] }()
+
+	records, void, err := e.query(domain, dns.TypeTXT)
+	if err != nil {
+		node.Error = err.Error()
+		return node
+	}
+	node.void = void
+
+	var txt []string
+	for _, rr := range records {
+		txt = append(txt, lookup.RecordValue(rr))
+	}
+
+	spf := versioned(txt, "v=spf1")
+	switch {
+	case len(spf) == 0:
+		node.Error = spfNoRecord
+		return node
+	case len(spf) > 1:
+		node.Error = "multiple SPF records found"
+		return node
+	}
+
+	node.Record = spf[0]
+
+	var redirect string
+	var hasAll bool
+
+	for _, raw := range strings.Fields(spf[0])[1:] {
+		term := &SPFTerm{Term: raw}
+		node.Terms = append(node.Terms, term)
+
+		if kv := strings.SplitN(raw, "=", 2); len(kv) == 2 && !strings.ContainsAny(kv[0], ":/") {
+			if strings.EqualFold(kv[0], "redirect") {
+				redirect = kv[1]
+				term.Note = "evaluated after all other terms"
+			}
+			continue
+		}
+
+		mech := strings.TrimLeft(raw, "+-~?")
+
+		name, value := strings.ToLower(mech), ""
+		if i := strings.IndexAny(mech, ":/"); i >= 0 {
+			name, value = strings.ToLower(mech[:i]), mech[i:]
+		}
+
+		spec, v4, v6 := splitCIDR(strings.TrimPrefix(value, ":"))
+		if spec == "" {
+			spec = domain
+		}
+
+		switch name {
+		case "all":
+			hasAll = true
+		case "ip4", "ip6":
+			addr := strings.TrimPrefix(value, ":")
+			if !strings.Contains(addr, "/") {
+				if name == "ip4" {
+					addr += "/32"
+				} else {
+					addr += "/128"
+				}
+			}
+
+			term.IPs = append(term.IPs, addr)
+		case "include":
+			if !e.countLookup(term) {
+				return node
+			}
+
+			if hasMacro(spec) {
+				term.Note = "contains macros, which depend on the message being checked"
+				continue
+			}
+
+			e.include(term, spec)
+		case "a":
+			if !e.countLookup(term) {
+				return node
+			}
+
+			if hasMacro(spec) {
+				term.Note = "contains macros, which depend on the message being checked"
+				continue
+			}
+
+			ranges, void, err := e.addrRanges(spec, v4, v6)
+			if err != nil {
+				term.Error = err.Error()
+				continue
+			}
+
+			if void {
+				e.countVoid(term)
+			}
+
+			term.IPs = append(term.IPs, ranges...)
+		case "mx":
+			if !e.countLookup(term) {
+				return node
+			}
+
+			if hasMacro(spec) {
+				term.Note = "contains macros, which depend on the message being checked"
+				continue
+			}
+
+			records, void, err := e.query(spec, dns.TypeMX)
+			if err != nil {
+				term.Error = err.Error()
+				continue
+			}
+
+			if void {
+				e.countVoid(term)
+			}
+
+			if len(records) > spfMXLimit {
+				term.Error = fmt.Sprintf("has %d MX records, more than the limit of %d", len(records), spfMXLimit)
+				records = records[:spfMXLimit]
+			}
+
+			for _, rr := range records {
+				ranges, _, err := e.addrRanges(rr.(*dns.MX).Mx, v4, v6)
+				if err != nil {
+					term.Error = err.Error()
+					continue
+				}
+
+				term.IPs = append(term.IPs, ranges...)
+			}
+		case "ptr":
+			if !e.countLookup(term) {
+				return node
+			}
+
+			term.Note = "depends on the reverse dns of the connecting ip (deprecated)"
+		case "exists":
+			if !e.countLookup(term) {
+				return node
+			}
+
+			term.Note = "depends on the message being checked"
+		}
+	}
+
+	if redirect != "" && !hasAll {
+		term := node.Terms[len(node.Terms)-1]
+		for _, t := range node.Terms {
+			if strings.HasPrefix(strings.ToLower(t.Term), "redirect=") {
+				term = t
+			}
+		}
+
+		if !e.countLookup(term) {
+			return node
+		}
+
+		if hasMacro(redirect) {
+			term.Note = "contains macros, which depend on the message being checked"
+			return node
+		}
+
+		e.include(term, redirect)
+	}
+
+	return node
+}
+
+// include evaluates the SPF record of domain, as included by term (either an
+// include mechanism, or a redirect modifier).
+func (e *spfEvaluator) include(term *SPFTerm, domain string) {
+	term.Include = e.evaluate(domain)
+
+	if term.Include.Error == "" {
+		return
+	}
+
+	// a missing record is a permerror, and a void lookup if the name has no
+	// records at all (rather than only records which aren't SPF).
+	e.finding(SeverityError, "%s: %s", term.Term, term.Include.Error)
+
+	if term.Include.void {
+		e.countVoid(term)
+	}
+}
+
+// passRanges returns the ranges authorized (with a pass qualifier) within
+// node, and any records it includes.
+func passRanges(node *SPFNode) (out []string) {
+	for _, term := range node.Terms {
+		if term.Term[0] == '-' || term.Term[0] == '~' || term.Term[0] == '?' {
+			continue
+		}
+
+		if term.Include != nil {
+			out = append(out, passRanges(term.Include)...)
+			continue
+		}
+
+		out = append(out, term.IPs...)
+	}
+
+	return out
+}
+
+// EvaluateSPF recursively evaluates the SPF record of domain using the
+// resolvers in group, counting DNS querying terms against the RFC 7208
+// limits, and collecting the ip ranges which are authorized to send mail.
+func EvaluateSPF(domain string, group *ResolverGroup) *SPFResult {
+	e := &spfEvaluator{
+		group:  group,
+		budget: scheduler.NewScan(),
+		result: &SPFResult{Domain: domain},
+	}
+	defer e.budget.Done()
+
+	e.result.Root = e.evaluate(domain)
+
+	known := make(map[string]bool)
+	for _, r := range passRanges(e.result.Root) {
+		if !known[r] {
+			known[r] = true
+			e.result.Authorized = append(e.result.Authorized, r)
+		}
+	}
+	sort.Sort(ipRanges(e.result.Authorized))
+
+	if e.result.Lookups > spfLookupLimit {
+		e.finding(SeverityError, "%d DNS lookups are required, more than the limit of %d, which results in a permerror (RFC 7208 4.6.4)", e.result.Lookups, spfLookupLimit)
+	} else if e.result.Lookups >= spfLookupLimit-2 {
+		e.finding(SeverityWarning, "%d of %d DNS lookups are used", e.result.Lookups, spfLookupLimit)
+	} else {
+		e.finding(SeverityOK, "%d of %d DNS lookups are used", e.result.Lookups, spfLookupLimit)
+	}
+
+	if e.result.VoidLookups > spfVoidLimit {
+		e.finding(SeverityError, "%d void lookups, more than the limit of %d, which results in a permerror (RFC 7208 4.6.4)", e.result.VoidLookups, spfVoidLimit)
+	} else if e.result.VoidLookups > 0 {
+		e.finding(SeverityWarning, "%d void lookups (names with no records)", e.result.VoidLookups)
+	}
+
+	return e.result
+}
+
+// ipRanges sorts ip ranges, ipv4 first.
+type ipRanges []string
+
+func (r ipRanges) Len() int {
+	return len(r)
+}
+
+func (r ipRanges) Less(i, j int) bool {
+	a, _, errA := net.ParseCIDR(r[i])
+	b, _, errB := net.ParseCIDR(r[j])
+	if errA != nil || errB != nil {
+		return r[i] < r[j]
+	}
+
+	if (a.To4() == nil) != (b.To4() == nil) {
+		return a.To4() != nil
+	}
+
+	return strings.Compare(string(a.To16()), string(b.To16())) < 0
+}
+
+func (r ipRanges) Swap(i, j int) {
+	r[i], r[j] = r[j], r[i]
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/lrstanley/dnscheck/lookup"
+	"github.com/miekg/dns"
+)
+
+func TestSplitCIDR(t *testing.T) {
+	tests := []struct {
+		spec           string
+		domain, v4, v6 string
+	}{
+		{"", "", "32", "128"},
+		{"example.com", "example.com", "32", "128"},
+		{"example.com/24", "example.com", "24", "128"},
+		{"example.com//64", "example.com", "32", "64"},
+		{"example.com/24//64", "example.com", "24", "64"},
+		{"/24", "", "24", "128"},
+		{"//64", "", "32", "64"},
+	}
+
+	for _, tt := range tests {
+		domain, v4, v6 := splitCIDR(tt.spec)
+		if domain != tt.domain || v4 != tt.v4 || v6 != tt.v6 {
+			t.Errorf("splitCIDR(%q) = %q, %q, %q, want %q, %q, %q", tt.spec, domain, v4, v6, tt.domain, tt.v4, tt.v6)
+		}
+	}
+}
+
+// spfZone is a local DNS server, answering from a map of names to the records
+// they have. Names which aren't in the map don't exist.
+type spfZone map[string][]string
+
+func (z spfZone) ServeDNS(w dns.ResponseWriter, req *dns.Msg) {
+	resp := new(dns.Msg)
+	resp.SetReply(req)
+
+	q := req.Question[0]
+
+	records, ok := z[strings.TrimSuffix(q.Name, ".")]
+	if !ok {
+		resp.Rcode = dns.RcodeNameError
+	}
+
+	for _, record := range records {
+		rr, err := dns.NewRR(q.Name + " 300 IN " + record)
+		if err != nil {
+			panic(err)
+		}
+
+		if rr.Header().Rrtype == q.Qtype {
+			resp.Answer = append(resp.Answer, rr)
+		}
+	}
+
+	w.WriteMsg(resp)
+}
+
+// startZone serves zone on a random local port, returning a resolver group
+// which queries it. The returned func stops it.
+func startZone(t *testing.T, zone spfZone) (*ResolverGroup, func()) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	started := make(chan struct{})
+	srv := &dns.Server{PacketConn: pc, Handler: zone, NotifyStartedFunc: func() { close(started) }}
+
+	go srv.ActivateAndServe()
+	<-started
+
+	if scheduler == nil {
+		scheduler = lookup.NewScheduler(10, 0)
+	}
+
+	return &ResolverGroup{Servers: []string{pc.LocalAddr().String()}}, func() { srv.Shutdown() }
+}
+
+func TestEvaluateSPF(t *testing.T) {
+	zone := spfZone{
+		"example.com": {
+			`TXT "v=spf1 ip4:192.0.2.0/24 include:_spf.example.net a mx/24//64 -all"`,
+			"A 192.0.2.10",
+			"MX 10 mail.example.com",
+		},
+		"mail.example.com": {"A 198.51.100.5", "AAAA 2001:db8::5"},
+		"_spf.example.net": {`TXT "v=spf1 ip6:2001:db8:1::/48 ~all"`},
+		"redirect.example": {`TXT "v=spf1 redirect=_spf.example.net"`},
+		"macro.example":    {`TXT "v=spf1 include:%{d}.spf.example.net -all"`},
+		"loop-a.example":   {`TXT "v=spf1 include:loop-b.example -all"`},
+		"loop-b.example":   {`TXT "v=spf1 include:loop-a.example -all"`},
+		"missing.example":  {`TXT "v=spf1 include:nx.example -all"`},
+		"void.example":     {`TXT "v=spf1 a:nx1.void.example a:nx2.void.example a:nx3.void.example -all"`},
+		"norecord.example": {`TXT "google-site-verification=abc"`},
+		"txtonly.example":  {`TXT "v=spf1 include:norecord.example -all"`},
+		"excluded.example": {`TXT "v=spf1 -ip4:192.0.2.1 ip4:192.0.2.0/24 -all"`},
+		"cidr.example":     {`TXT "v=spf1 a:mail.example.com/28 -all"`},
+	}
+
+	var includes []string
+	for i := 0; i < spfLookupLimit+1; i++ {
+		name := fmt.Sprintf("inc%d.toomany.example", i)
+		zone[name] = []string{`TXT "v=spf1 -all"`}
+		includes = append(includes, "include:"+name)
+	}
+	zone["toomany.example"] = []string{`TXT "v=spf1 ` + strings.Join(includes, " ") + ` -all"`}
+
+	group, stop := startZone(t, zone)
+	defer stop()
+
+	tests := []struct {
+		domain     string
+		authorized []string
+		lookups    int
+		void       int
+		rootError  string
+		finding    string
+	}{
+		{
+			domain:     "example.com",
+			authorized: []string{"192.0.2.0/24", "192.0.2.10/32", "198.51.100.5/24", "2001:db8::5/64", "2001:db8:1::/48"},
+			lookups:    3,
+			finding:    "3 of 10 DNS lookups are used",
+		},
+		{
+			domain:     "redirect.example",
+			authorized: []string{"2001:db8:1::/48"},
+			lookups:    1,
+		},
+		{
+			domain:  "macro.example",
+			lookups: 1,
+		},
+		{
+			domain:  "loop-a.example",
+			lookups: 2,
+			finding: "SPF include loop: loop-a.example -> loop-b.example -> loop-a.example",
+		},
+		{
+			domain:  "missing.example",
+			lookups: 1,
+			void:    1,
+			finding: "include:nx.example: " + spfNoRecord,
+		},
+		{
+			domain:  "txtonly.example",
+			lookups: 1,
+			finding: "include:norecord.example: " + spfNoRecord,
+		},
+		{
+			domain:  "void.example",
+			lookups: 3,
+			void:    3,
+			finding: "3 void lookups, more than the limit of 2",
+		},
+		{
+			domain:    "norecord.example",
+			rootError: spfNoRecord,
+		},
+		{
+			domain:     "excluded.example",
+			authorized: []string{"192.0.2.0/24"},
+		},
+		{
+			domain:     "cidr.example",
+			authorized: []string{"198.51.100.5/28", "2001:db8::5/128"},
+			lookups:    1,
+		},
+		{
+			domain:  "toomany.example",
+			lookups: spfLookupLimit + 1,
+			finding: "11 DNS lookups are required, more than the limit of 10",
+		},
+	}
+
+	for _, tt := range tests {
+		res := EvaluateSPF(tt.domain, group)
+
+		if !reflect.DeepEqual(res.Authorized, tt.authorized) {
+			t.Errorf("EvaluateSPF(%q) authorized %v, want %v", tt.domain, res.Authorized, tt.authorized)
+		}
+
+		if res.Lookups != tt.lookups || res.VoidLookups != tt.void {
+			t.Errorf("EvaluateSPF(%q) used %d lookups (%d void), want %d (%d void)", tt.domain, res.Lookups, res.VoidLookups, tt.lookups, tt.void)
+		}
+
+		if res.Root.Error != tt.rootError {
+			t.Errorf("EvaluateSPF(%q) root error %q, want %q", tt.domain, res.Root.Error, tt.rootError)
+		}
+
+		if tt.finding == "" {
+			continue
+		}
+
+		var messages []string
+		for _, f := range res.Findings {
+			messages = append(messages, f.Message)
+		}
+
+		if !strings.Contains(strings.Join(messages, "\n"), tt.finding) {
+			t.Errorf("EvaluateSPF(%q) findings %q, want one containing %q", tt.domain, messages, tt.finding)
+		}
+	}
+
+	// terms with macros can't be evaluated, so are only noted.
+	res := EvaluateSPF("macro.example", group)
+	if term := res.Root.Terms[0]; term.Include != nil || !strings.Contains(term.Note, "macros") {
+		t.Errorf("macro include evaluated as %+v, want a note about macros", term)
+	}
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"database/sql"
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+// sqlSchema creates the table everything is stored within. Keys use the "C"
+// collation, so they're ordered byte-wise (as with bolt), and prefix matches
+// can use the primary key.
+const sqlSchema = `CREATE TABLE IF NOT EXISTS dnscheck_store (
+	bucket TEXT NOT NULL,
+	key    TEXT COLLATE "C" NOT NULL,
+	value  BYTEA NOT NULL,
+	PRIMARY KEY (bucket, key)
+)`
+
+const sqlUpsert = `INSERT INTO dnscheck_store (bucket, key, value) VALUES ($1, $2, $3)
+	ON CONFLICT (bucket, key) DO UPDATE SET value = EXCLUDED.value`
+
+// sqlStore stores everything within a postgres database, so several
+// dnscheck instances can share it.
+type sqlStore struct {
+	db *sql.DB
+}
+
+// openSQLStore connects to the postgres database at url, and creates the
+// table if needed.
+func openSQLStore(url string) (*sqlStore, error) {
+	db, err := sql.Open("postgres", url)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err = db.Exec(sqlSchema); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return &sqlStore{db: db}, nil
+}
+
+// likePrefix returns a LIKE pattern matching anything starting with prefix.
+func likePrefix(prefix string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(prefix) + "%"
+}
+
+func (s *sqlStore) Get(bucket, key string) (value []byte, err error) {
+	err = s.db.QueryRow(`SELECT value FROM dnscheck_store WHERE bucket = $1 AND key = $2`, bucket, key).Scan(&value)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+
+	return value, err
+}
+
+func (s *sqlStore) Put(bucket, key string, value []byte) error {
+	_, err := s.db.Exec(sqlUpsert, bucket, key, value)
+
+	return err
+}
+
+func (s *sqlStore) PutMany(bucket string, values map[string][]byte) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for key, value := range values {
+		if _, err = tx.Exec(sqlUpsert, bucket, key, value); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// Update takes an advisory lock on the key for the transaction, as a row
+// lock alone doesn't stop two instances from updating a key which doesn't
+// exist yet at the same time.
+func (s *sqlStore) Update(bucket, key string, fn func(value []byte) ([]byte, error)) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err = tx.Exec(`SELECT pg_advisory_xact_lock(hashtext($1 || '/' || $2))`, bucket, key); err != nil {
+		return err
+	}
+
+	var current []byte
+	err = tx.QueryRow(`SELECT value FROM dnscheck_store WHERE bucket = $1 AND key = $2 FOR UPDATE`, bucket, key).Scan(&current)
+	if err != nil && err != sql.ErrNoRows {
+		return err
+	}
+
+	value, err := fn(current)
+	if err != nil {
+		return err
+	}
+
+	if _, err = tx.Exec(sqlUpsert, bucket, key, value); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (s *sqlStore) Delete(bucket, key string) error {
+	_, err := s.db.Exec(`DELETE FROM dnscheck_store WHERE bucket = $1 AND key = $2`, bucket, key)
+
+	return err
+}
+
+func (s *sqlStore) DeleteMany(bucket string, keys []string) error {
+	_, err := s.db.Exec(`DELETE FROM dnscheck_store WHERE bucket = $1 AND key = ANY($2)`, bucket, pq.Array(keys))
+
+	return err
+}
+
+func (s *sqlStore) DeletePrefix(bucket, prefix string) error {
+	_, err := s.db.Exec(`DELETE FROM dnscheck_store WHERE bucket = $1 AND key LIKE $2`, bucket, likePrefix(prefix))
+
+	return err
+}
+
+// each calls fn for every row of rows, closing rows once done.
+func (s *sqlStore) each(rows *sql.Rows, fn func(key string, value []byte) error) error {
+	defer rows.Close()
+
+	for rows.Next() {
+		var key string
+		var value []byte
+
+		if err := rows.Scan(&key, &value); err != nil {
+			return err
+		}
+
+		if err := fn(key, value); err != nil {
+			return err
+		}
+	}
+
+	return rows.Err()
+}
+
+func (s *sqlStore) ForEach(bucket, prefix string, fn func(key string, value []byte) error) error {
+	rows, err := s.db.Query(`SELECT key, value FROM dnscheck_store WHERE bucket = $1 AND key LIKE $2 ORDER BY key`, bucket, likePrefix(prefix))
+	if err != nil {
+		return err
+	}
+
+	return s.each(rows, fn)
+}
+
+func (s *sqlStore) ForEachReverse(bucket, prefix string, n int, fn func(key string, value []byte) error) error {
+	// a NULL limit is no limit.
+	var limit interface{}
+	if n > 0 {
+		limit = n
+	}
+
+	rows, err := s.db.Query(`SELECT key, value FROM dnscheck_store WHERE bucket = $1 AND key LIKE $2 ORDER BY key DESC LIMIT $3`, bucket, likePrefix(prefix), limit)
+	if err != nil {
+		return err
+	}
+
+	return s.each(rows, fn)
+}
+
+func (s *sqlStore) Close() error {
+	return s.db.Close()
+}
@@ -1,3 +1,45 @@
 $(document).ready(function() {
     $("body").tooltip({selector: '[data-toggle=tooltip]'});
-});
\ No newline at end of file
+
+    if ($("#geo-map").length) {
+        geoMap();
+    }
+});
+
+// geoMap plots which answer each resolver received for the selected query.
+function geoMap() {
+    var points = JSON.parse($("#geo-points").text());
+    var colors = ["#18bc9c", "#3498db", "#f39c12", "#9b59b6", "#e74c3c", "#2c3e50", "#95a5a6", "#d35400"];
+
+    var map = L.map("geo-map").setView([20, 0], 2);
+    L.tileLayer("https://{s}.tile.openstreetmap.org/{z}/{x}/{y}.png", {
+        attribution: '&copy; <a href="http://osm.org/copyright">OpenStreetMap</a> contributors'
+    }).addTo(map);
+
+    var layer = L.layerGroup().addTo(map);
+
+    function render() {
+        var query = $("#geo-query").val();
+        var answers = {};
+
+        layer.clearLayers();
+
+        $.each(points, function(i, point) {
+            if (point.Query != query) {
+                return;
+            }
+
+            var answer = point.Error ? "error: " + point.Error : (point.Answer || "no answer");
+            if (!(answer in answers)) {
+                answers[answer] = colors[Object.keys(answers).length % colors.length];
+            }
+
+            L.circleMarker([point.Lat, point.Long], {color: answers[answer], fillOpacity: 0.8, radius: 8})
+                .bindPopup("<strong>" + point.Resolver + "</strong> (" + point.Country + ")<br>" + $("<div>").text(answer).html())
+                .addTo(layer);
+        });
+    }
+
+    $("#geo-query").on("change", render);
+    render();
+}
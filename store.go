@@ -0,0 +1,62 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Store is where results, monitors and everything else dnscheck saves are
+// stored. Keys are grouped into buckets, and are ordered (byte-wise) within
+// a bucket, so they can be iterated over by prefix. Values are opaque, DB
+// encodes structs into them.
+type Store interface {
+	// Get returns the value of key, or nil if it doesn't exist.
+	Get(bucket, key string) ([]byte, error)
+	// Put sets the value of key.
+	Put(bucket, key string, value []byte) error
+	// PutMany sets the value of each key within values, atomically.
+	PutMany(bucket string, values map[string][]byte) error
+	// Update calls fn with the value of key (nil if it doesn't exist), and
+	// sets the value to what fn returns, atomically. If fn returns an error,
+	// nothing is written.
+	Update(bucket, key string, fn func(value []byte) ([]byte, error)) error
+	// Delete removes key, if it exists.
+	Delete(bucket, key string) error
+	// DeleteMany removes each of keys which exist, atomically.
+	DeleteMany(bucket string, keys []string) error
+	// DeletePrefix removes every key starting with prefix.
+	DeletePrefix(bucket, prefix string) error
+	// ForEach calls fn for every key starting with prefix, in key order.
+	// value is only valid within fn. Returning an error from fn stops the
+	// iteration.
+	ForEach(bucket, prefix string, fn func(key string, value []byte) error) error
+	// ForEachReverse is like ForEach, but iterates in reverse key order, and
+	// stops after n keys (if n is above 0).
+	ForEachReverse(bucket, prefix string, n int, fn func(key string, value []byte) error) error
+	// Close closes the store. It's not used after.
+	Close() error
+}
+
+// Compacter is implemented by stores which have to be compacted to reclaim
+// the space left by removed keys.
+type Compacter interface {
+	// Compact compacts the store, returning its size before and after. It's
+	// never called concurrently with any other method of the store.
+	Compact() (before, after int64, err error)
+}
+
+var errNotCompactable = errors.New("storage doesn't support compaction")
+
+// openStore opens the storage configured by c.
+func openStore(c *Config) (Store, error) {
+	switch c.Storage {
+	case "bolt":
+		return openBoltStore(c.Database)
+	case "memory":
+		return newMemoryStore(), nil
+	case "postgres":
+		return openSQLStore(c.DatabaseURL)
+	}
+
+	return nil, fmt.Errorf("unknown storage %q", c.Storage)
+}
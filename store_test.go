@@ -0,0 +1,248 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+// testStores calls fn with each store which can be tested without any
+// external services.
+func testStores(t *testing.T, fn func(t *testing.T, s Store)) {
+	t.Run("memory", func(t *testing.T) {
+		fn(t, newMemoryStore())
+	})
+
+	t.Run("bolt", func(t *testing.T) {
+		dir, err := ioutil.TempDir("", "dnscheck")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+
+		s, err := openBoltStore(filepath.Join(dir, "dns.db"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer s.Close()
+
+		fn(t, s)
+	})
+}
+
+// putKeys sets each of keys on bucket, with the key as the value.
+func putKeys(t *testing.T, s Store, bucket string, keys ...string) {
+	values := make(map[string][]byte)
+	for _, key := range keys {
+		values[key] = []byte(key)
+	}
+
+	if err := s.PutMany(bucket, values); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// collect returns the keys iterated over by ForEach (or ForEachReverse, if
+// n isn't -1), checking each value is the key.
+func collect(t *testing.T, s Store, bucket, prefix string, n int) (out []string) {
+	fn := func(key string, value []byte) error {
+		if string(value) != key {
+			t.Errorf("value of %q is %q", key, value)
+		}
+
+		out = append(out, key)
+		return nil
+	}
+
+	var err error
+	if n == -1 {
+		err = s.ForEach(bucket, prefix, fn)
+	} else {
+		err = s.ForEachReverse(bucket, prefix, n, fn)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return out
+}
+
+func TestStoreGetPut(t *testing.T) {
+	testStores(t, func(t *testing.T, s Store) {
+		if value, err := s.Get("records", "missing"); value != nil || err != nil {
+			t.Errorf("Get(missing) = %q, %v, want nil, nil", value, err)
+		}
+
+		if err := s.Put("records", "a", []byte("1")); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.Put("records", "a", []byte("2")); err != nil {
+			t.Fatal(err)
+		}
+
+		if value, _ := s.Get("records", "a"); string(value) != "2" {
+			t.Errorf("Get(a) = %q, want %q", value, "2")
+		}
+
+		// buckets are separate.
+		if value, _ := s.Get("monitors", "a"); value != nil {
+			t.Errorf("Get(monitors, a) = %q, want nil", value)
+		}
+
+		if err := s.Delete("records", "a"); err != nil {
+			t.Fatal(err)
+		}
+		if value, _ := s.Get("records", "a"); value != nil {
+			t.Errorf("Get(a) after Delete = %q, want nil", value)
+		}
+	})
+}
+
+func TestStoreOrder(t *testing.T) {
+	testStores(t, func(t *testing.T, s Store) {
+		putKeys(t, s, "monitor-runs", "b/2", "a/3", "a/1", "b/1", "a/2", "ab/1", "a")
+
+		tests := []struct {
+			prefix string
+			n      int
+			want   []string
+		}{
+			{"", -1, []string{"a", "a/1", "a/2", "a/3", "ab/1", "b/1", "b/2"}},
+			{"a/", -1, []string{"a/1", "a/2", "a/3"}},
+			{"c/", -1, nil},
+			{"a/", 0, []string{"a/3", "a/2", "a/1"}},
+			{"a/", 2, []string{"a/3", "a/2"}},
+			{"a/", 10, []string{"a/3", "a/2", "a/1"}},
+			{"b/", 1, []string{"b/2"}},
+			{"", 3, []string{"b/2", "b/1", "ab/1"}},
+			{"c/", 0, nil},
+		}
+
+		for _, tt := range tests {
+			if got := collect(t, s, "monitor-runs", tt.prefix, tt.n); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("prefix %q, n %d: got %q, want %q", tt.prefix, tt.n, got, tt.want)
+			}
+		}
+	})
+}
+
+func TestStoreDelete(t *testing.T) {
+	testStores(t, func(t *testing.T, s Store) {
+		putKeys(t, s, "monitor-runs", "a/1", "a/2", "ab/1", "b/1", "b/2", "b/3")
+
+		if err := s.DeletePrefix("monitor-runs", "a/"); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := s.DeleteMany("monitor-runs", []string{"b/1", "b/3", "missing"}); err != nil {
+			t.Fatal(err)
+		}
+
+		want := []string{"ab/1", "b/2"}
+		if got := collect(t, s, "monitor-runs", "", -1); !reflect.DeepEqual(got, want) {
+			t.Errorf("got %q, want %q", got, want)
+		}
+
+		if err := s.DeletePrefix("monitor-runs", ""); err != nil {
+			t.Fatal(err)
+		}
+
+		if got := collect(t, s, "monitor-runs", "", -1); got != nil {
+			t.Errorf("got %q after removing everything", got)
+		}
+	})
+}
+
+func TestStoreUpdate(t *testing.T) {
+	testStores(t, func(t *testing.T, s Store) {
+		const workers, increments = 8, 25
+
+		var wg sync.WaitGroup
+		for i := 0; i < workers; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+
+				for j := 0; j < increments; j++ {
+					err := s.Update("apikeys", "counter", func(value []byte) ([]byte, error) {
+						n, _ := strconv.Atoi(string(value))
+						return []byte(strconv.Itoa(n + 1)), nil
+					})
+					if err != nil {
+						t.Error(err)
+					}
+				}
+			}()
+		}
+		wg.Wait()
+
+		if value, _ := s.Get("apikeys", "counter"); string(value) != strconv.Itoa(workers*increments) {
+			t.Errorf("counter = %s, want %d", value, workers*increments)
+		}
+
+		// nothing is written if fn fails.
+		errFail := errors.New("fail")
+		err := s.Update("apikeys", "counter", func(value []byte) ([]byte, error) {
+			return []byte("0"), errFail
+		})
+		if err != errFail {
+			t.Errorf("Update returned %v, want %v", err, errFail)
+		}
+
+		if value, _ := s.Get("apikeys", "counter"); string(value) != strconv.Itoa(workers*increments) {
+			t.Errorf("counter = %s after a failed update, want %d", value, workers*increments)
+		}
+	})
+}
+
+func TestBoltCompact(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dnscheck")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	fn := filepath.Join(dir, "dns.db")
+
+	s, err := openBoltStore(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { s.Close() }()
+
+	var keys []string
+	for i := 0; i < 1000; i++ {
+		keys = append(keys, strconv.Itoa(i))
+	}
+	putKeys(t, s, "records", keys...)
+
+	if err = s.DeleteMany("records", keys[1:]); err != nil {
+		t.Fatal(err)
+	}
+
+	before, after, err := s.Compact()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if after > before {
+		t.Errorf("compacted from %d to %d bytes", before, after)
+	}
+
+	if value, _ := s.Get("records", "0"); string(value) != "0" {
+		t.Errorf("Get(0) after compacting = %q", value)
+	}
+
+	if err = s.Put("records", "1", []byte("1")); err != nil {
+		t.Errorf("Put after compacting: %s", err)
+	}
+
+	if _, err = os.Stat(fn + ".old"); !os.IsNotExist(err) {
+		t.Error("the original database wasn't removed")
+	}
+}
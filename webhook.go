@@ -0,0 +1,330 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Webhook events.
+const (
+	EventScanCompleted    = "scan.completed"
+	EventMonitorCompleted = "monitor.completed"
+	EventHostChanged      = "host.changed"
+)
+
+// Host states, as tracked between monitor runs.
+const (
+	StateMatched    = "matched"
+	StateMismatched = "mismatched"
+	StateError      = "error"
+)
+
+const (
+	// webhookAttempts is the max number of attempts made to deliver a
+	// payload, with webhookBackoff doubling between each.
+	webhookAttempts = 5
+	webhookBackoff  = 2 * time.Second
+	webhookTimeout  = 10 * time.Second
+
+	// webhookLogSize is the number of deliveries shown in the delivery log,
+	// and kept for each webhook.
+	webhookLogSize = 100
+)
+
+var webhookClient = &http.Client{Timeout: webhookTimeout}
+
+// hostState returns the state of an answer.
+func hostState(ans *DNSAnswer) string {
+	if ans.Error != "" {
+		return StateError
+	}
+
+	if ans.IsMatch {
+		return StateMatched
+	}
+
+	return StateMismatched
+}
+
+// StateChange is a host which changed state between two monitor runs.
+type StateChange struct {
+	Type  string
+	Host  string
+	From  string
+	To    string
+	Scan  string
+	Prior string
+}
+
+// WebhookPayload is the json body POSTed to each webhook.
+type WebhookPayload struct {
+	Event   string
+	Time    string
+	Monitor string         `json:",omitempty"`
+	Scans   []*SavedScan   `json:",omitempty"`
+	Changes []*StateChange `json:",omitempty"`
+}
+
+// WebhookDelivery is an entry in the delivery log.
+type WebhookDelivery struct {
+	ID         string
+	URL        string
+	Event      string
+	Created    time.Time
+	Updated    time.Time
+	Attempts   int
+	StatusCode int
+	Error      string
+	Delivered  bool
+}
+
+func saveWebhookDelivery(d *WebhookDelivery) error {
+	db, err := newDB()
+	if err != nil {
+		return err
+	}
+	defer db.Clean()
+
+	return db.SetStruct("webhooks", d.ID, d)
+}
+
+// getWebhookDeliveries returns the most recent deliveries, newest first.
+// Webhook URLs may contain tokens, so only their scheme and host are
+// returned (see redactURL).
+func getWebhookDeliveries() (out []*WebhookDelivery, err error) {
+	db, err := newDB()
+	if err != nil {
+		return nil, err
+	}
+	defer db.Clean()
+
+	err = db.ForEachReverse("webhooks", "", webhookLogSize, func(key string, data []byte) error {
+		d := &WebhookDelivery{}
+		if err := db.GetReceivedStruct(data, d); err != nil {
+			return err
+		}
+
+		redacted := redactURL(d.URL)
+		d.Error = strings.Replace(d.Error, d.URL, redacted, -1)
+		d.URL = redacted
+
+		out = append(out, d)
+		return nil
+	})
+
+	return out, err
+}
+
+// pruneWebhookDeliveries removes all but the webhookLogSize most recent
+// deliveries of each webhook.
+func pruneWebhookDeliveries() error {
+	db, err := newDB()
+	if err != nil {
+		return err
+	}
+	defer db.Clean()
+
+	var expired []string
+	seen := make(map[string]int)
+
+	err = db.ForEachReverse("webhooks", "", 0, func(key string, data []byte) error {
+		d := &WebhookDelivery{}
+		if err := db.GetReceivedStruct(data, d); err != nil {
+			return err
+		}
+
+		if seen[d.URL]++; seen[d.URL] > webhookLogSize {
+			expired = append(expired, key)
+		}
+
+		return nil
+	})
+	if err != nil || len(expired) == 0 {
+		return err
+	}
+
+	return db.DeleteKeys("webhooks", expired)
+}
+
+// redactURL returns only the scheme and host of rawurl, as the path or query
+// of a webhook may contain a token.
+func redactURL(rawurl string) string {
+	u, err := url.Parse(rawurl)
+	if err != nil || u.Host == "" {
+		return "(invalid url)"
+	}
+
+	return u.Scheme + "://" + u.Host
+}
+
+// signPayload returns the signature of body, sent in the
+// X-DNSCheck-Signature header.
+func signPayload(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// deliver POSTs body to a single webhook, retrying with backoff, and logs
+// each attempt.
+func deliver(d *WebhookDelivery, secret string, body []byte) {
+	backoff := webhookBackoff
+
+	for d.Attempts < webhookAttempts {
+		if d.Attempts > 0 {
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+
+		d.Attempts++
+		d.Updated = time.Now()
+		d.Error = ""
+
+		req, err := http.NewRequest("POST", d.URL, bytes.NewReader(body))
+		if err != nil {
+			d.Error = err.Error()
+			saveWebhookDelivery(d)
+			return
+		}
+
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("User-Agent", "dnscheck")
+		req.Header.Set("X-DNSCheck-Event", d.Event)
+		req.Header.Set("X-DNSCheck-Delivery", d.ID)
+		if secret != "" {
+			req.Header.Set("X-DNSCheck-Signature", signPayload(secret, body))
+		}
+
+		resp, err := webhookClient.Do(req)
+		if err == nil {
+			resp.Body.Close()
+			d.StatusCode = resp.StatusCode
+
+			if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+				d.Delivered = true
+			} else {
+				err = fmt.Errorf("unexpected status: %s", resp.Status)
+			}
+		}
+
+		if err != nil {
+			d.Error = err.Error()
+		}
+
+		if err := saveWebhookDelivery(d); err != nil {
+			logger.Printf("webhook %s: unable to log delivery: %s", d.ID, err)
+		}
+
+		if d.Delivered {
+			return
+		}
+	}
+
+	logger.Printf("webhook %s: giving up on %s after %d attempts: %s", d.ID, d.URL, d.Attempts, d.Error)
+}
+
+// notify sends payload to every configured webhook, in the background.
+func notify(payload *WebhookPayload) {
+	c := conf()
+	if len(c.Webhooks) == 0 {
+		return
+	}
+
+	payload.Time = time.Now().Format(time.RFC3339)
+
+	body, err := json.Marshal(payload)
+	if err != nil {
+		logger.Printf("unable to encode webhook payload: %s", err)
+		return
+	}
+
+	now := time.Now()
+	for i, hook := range c.Webhooks {
+		d := &WebhookDelivery{
+			ID:      fmt.Sprintf("%020d-%d", now.UnixNano(), i),
+			URL:     hook,
+			Event:   payload.Event,
+			Created: now,
+		}
+
+		go deliver(d, c.WebhookSecret, body)
+	}
+
+	if err := pruneWebhookDeliveries(); err != nil {
+		logger.Printf("unable to prune webhook deliveries: %s", err)
+	}
+}
+
+// notifyScan notifies the webhooks of a completed scan.
+func notifyScan(key string, results *DNSResults) {
+	notify(&WebhookPayload{Event: EventScanCompleted, Scans: []*SavedScan{newSavedScan(key, results)}})
+}
+
+// stateChanges returns the hosts which changed state between two runs.
+func stateChanges(prev, run *MonitorRun) (out []*StateChange) {
+	if prev == nil {
+		return nil
+	}
+
+	before := make(map[string]*MonitorLookup)
+	for _, lookup := range prev.Lookups {
+		before[lookup.Type] = lookup
+	}
+
+	for _, lookup := range run.Lookups {
+		old, ok := before[lookup.Type]
+		if !ok {
+			continue
+		}
+
+		for host, state := range lookup.States {
+			if from, ok := old.States[host]; ok && from != state {
+				out = append(out, &StateChange{
+					Type:  lookup.Type,
+					Host:  strings.Replace(host, "|", " via ", 1),
+					From:  from,
+					To:    state,
+					Scan:  lookup.Key,
+					Prior: old.Key,
+				})
+			}
+		}
+	}
+
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Host != out[j].Host {
+			return out[i].Host < out[j].Host
+		}
+
+		return out[i].Type < out[j].Type
+	})
+
+	return out
+}
+
+// notifyMonitorRun notifies the webhooks of a completed monitor run, and of
+// any hosts which changed state since the previous run.
+func notifyMonitorRun(m *Monitor, run, prev *MonitorRun) {
+	payload := &WebhookPayload{Event: EventMonitorCompleted, Monitor: m.Name}
+	for _, lookup := range run.Lookups {
+		if lookup.results != nil {
+			payload.Scans = append(payload.Scans, newSavedScan(lookup.Key, lookup.results))
+		}
+	}
+
+	notify(payload)
+
+	if changes := stateChanges(prev, run); len(changes) > 0 {
+		notify(&WebhookPayload{Event: EventHostChanged, Monitor: m.Name, Changes: changes})
+	}
+}